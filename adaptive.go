@@ -0,0 +1,162 @@
+package ledger
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//adaptiveSample interval between two samples of the state of the workers
+const adaptiveSample = 10 * time.Millisecond
+
+//adaptiveSamples samples taken before each adjustment of the worker count
+const adaptiveSamples = 20
+
+//adaptiveGate limit how many shards are processed concurrently,
+//with a limit that can change while the shards are processed
+type adaptiveGate struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	//maximum number of shards processed concurrently
+	limit int
+	//shards being processed
+	active int
+	//shards waiting for the limit
+	waiting int
+	//shards processed so far
+	completed int
+}
+
+//newAdaptiveGate build a gate with the given initial limit
+func newAdaptiveGate(limit int) *adaptiveGate {
+	g := &adaptiveGate{limit: limit}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+//wrap apply the limit of the gate to a process function
+func (g *adaptiveGate) wrap(process ProcessFunc) ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		g.mu.Lock()
+		g.waiting++
+		for g.active >= g.limit {
+			g.cond.Wait()
+		}
+		g.waiting--
+		g.active++
+		g.mu.Unlock()
+		defer func() {
+			g.mu.Lock()
+			g.active--
+			g.completed++
+			g.mu.Unlock()
+			g.cond.Signal()
+		}()
+		return process(inp)
+	}
+}
+
+//starved report whether the gate has room that no shard is using,
+//because the workers are waiting for the reader or the writer
+func (g *adaptiveGate) starved() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.waiting == 0 && g.active < g.limit
+}
+
+//adjust change the limit by delta, keeping it in [1, maxLimit]
+//return the new limit
+func (g *adaptiveGate) adjust(delta, maxLimit int) int {
+	g.mu.Lock()
+	g.limit += delta
+	if g.limit < 1 {
+		g.limit = 1
+	}
+	if g.limit > maxLimit {
+		g.limit = maxLimit
+	}
+	limit := g.limit
+	g.mu.Unlock()
+	g.cond.Broadcast()
+	return limit
+}
+
+//done number of shards processed so far
+func (g *adaptiveGate) done() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.completed
+}
+
+//control tune the limit of the gate until stop is closed
+//maxLimit maximum limit
+//every adaptiveSamples samples the limit is lowered if the workers were often
+//waiting for input or output, since more workers would not help, otherwise
+//it is raised as long as this improves the throughput
+func (g *adaptiveGate) control(maxLimit int, stop <-chan struct{}) {
+	ticker := time.NewTicker(adaptiveSample)
+	defer ticker.Stop()
+	samples, starved := 0, 0
+	lastDone, lastRate, lastDelta := 0, 0.0, 0
+	start := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		samples++
+		if g.starved() {
+			starved++
+		}
+		if samples < adaptiveSamples {
+			continue
+		}
+		now := time.Now()
+		done := g.done()
+		rate := float64(done-lastDone) / now.Sub(start).Seconds()
+		delta := 1
+		switch {
+		case starved*2 > samples:
+			//the workers are not the bottleneck
+			delta = -1
+		case lastDelta > 0 && rate < lastRate*1.05:
+			//the last worker added brought no gain
+			delta = -1
+		case lastDelta < 0 && rate >= lastRate*0.95:
+			//the last worker removed was not needed, keep the level
+			delta = 0
+		}
+		g.adjust(delta, maxLimit)
+		samples, starved = 0, 0
+		lastDone, lastRate, lastDelta = done, rate, delta
+		start = now
+	}
+}
+
+//ProcessFileAdaptive process a file as ProcessFile, tuning the number of workers
+//parameters as in ProcessFile, without num and resume
+//the processing starts with runtime.NumCPU() workers, and their number is
+//adjusted while the file is processed, between 1 and 4*runtime.NumCPU():
+//it is reduced when the workers often wait for the reader or the writer,
+//and increased while this raises the throughput, so that CPU-bound and
+//I/O-bound process functions both get a suitable level of concurrency
+//return what was written, or the first error encountered reading the input
+//or writing the output
+func ProcessFileAdaptive(ctx context.Context, inputFile, outputFile string, process ProcessFunc, size int, framed, manifest bool, mode WriteMode, progress ProgressFunc) (Result, error) {
+	maxWorkers := 4 * runtime.NumCPU()
+	gate := newAdaptiveGate(runtime.NumCPU())
+	stop := make(chan struct{})
+	defer close(stop)
+	go gate.control(maxWorkers, stop)
+	//enough workers for the largest limit, the gate decides how many run
+	return processFile(ctx, inputFile, outputFile, gate.wrap(process), ProcessOptions{
+		Workers:   maxWorkers,
+		ChunkSize: size,
+		Framed:    framed,
+		Manifest:  manifest,
+		Mode:      mode,
+		Progress:  progress,
+	})
+}
@@ -0,0 +1,56 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+//the runs last long enough for the worker count to be adjusted a few times
+//(see adaptiveSamples), the fixed counts are the bounds of the adaptive one
+func BenchmarkProcessFileAdaptive(b *testing.B) {
+	const size = 16 * 1024
+	loads := []struct {
+		name    string
+		process ProcessFunc
+	}{
+		{"cpu-bound", func(inp Shard) (Shard, error) {
+			sum := sha256.Sum256(inp.Value)
+			for i := 0; i < 2; i++ {
+				sum = sha256.Sum256(append(sum[:], inp.Value...))
+			}
+			copy(inp.Value, sum[:])
+			return inp, nil
+		}},
+		{"io-bound", func(inp Shard) (Shard, error) {
+			time.Sleep(200 * time.Microsecond)
+			return inp, nil
+		}},
+	}
+	in := writeInput(b, 2048*size)
+	out := filepath.Join(filepath.Dir(in), "out")
+	for _, load := range loads {
+		for _, num := range []int{runtime.NumCPU(), 4 * runtime.NumCPU()} {
+			b.Run(fmt.Sprintf("%s/fixed %d", load.name, num), func(b *testing.B) {
+				b.SetBytes(2048 * size)
+				for i := 0; i < b.N; i++ {
+					if _, err := ProcessFile(context.Background(), in, out, load.process, num, size, false, false, false, WriteTruncate, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		b.Run(load.name+"/adaptive", func(b *testing.B) {
+			b.SetBytes(2048 * size)
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessFileAdaptive(context.Background(), in, out, load.process, size, false, false, WriteTruncate, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package ledger
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//AESGCMNonceSize byte size of the nonce prepended to each encrypted shard
+const AESGCMNonceSize = 12
+
+//AESGCMTagSize byte size of the authentication tag appended to each encrypted shard
+const AESGCMTagSize = 16
+
+//AESGCMOverhead bytes added by the encryptor to each shard
+//an input chunk of n bytes is encrypted into a shard of n+AESGCMOverhead bytes
+const AESGCMOverhead = AESGCMNonceSize + AESGCMTagSize
+
+//AESGCMShardSize size of the encrypted shards
+//size chunk size used for encryption
+//return the chunk size to use to process the encrypted file
+//only the last shard can be shorter, as it is for the plaintext
+func AESGCMShardSize(size int) int {
+	return size + AESGCMOverhead
+}
+
+//newAESGCM build the AEAD used by encryptor and decryptor
+//key AES key of 16, 24 or 32 bytes
+//return the AEAD or the error for an invalid key
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES key: %w", err)
+	}
+	return cipher.NewGCMWithNonceSize(block, AESGCMNonceSize)
+}
+
+//NewAESGCMEncryptor build a process function that encrypts each shard with AES-GCM
+//key AES key of 16, 24 or 32 bytes
+//each output shard is nonce || ciphertext || tag, with a fresh random nonce,
+//so it is AESGCMOverhead bytes longer than the input one (see AESGCMShardSize)
+//the process function fails if no random nonce can be generated
+//return the process function, or an error if the key is invalid
+func NewAESGCMEncryptor(key []byte) (ProcessFunc, error) {
+	return NewAESGCMEncryptorWithOptions(key, AEADOptions{})
+}
+
+//NewAESGCMEncryptorWithOptions build a process function that encrypts each
+//shard with AES-GCM, as NewAESGCMEncryptor
+//key AES key of 16, 24 or 32 bytes
+//opts settings of the encryption, the decryptor needs the same ones
+//return the process function, or an error if the key or opts are invalid
+func NewAESGCMEncryptorWithOptions(key []byte, opts AEADOptions) (ProcessFunc, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aeadEncryptor(aead, key, opts)
+}
+
+//NewAESGCMDecryptor build a process function that decrypts shards encrypted by NewAESGCMEncryptor
+//key AES key used for encryption
+//the nonce is stripped and the tag verified, so each output shard is
+//AESGCMOverhead bytes shorter than the input one
+//the process function fails if a shard is malformed or fails authentication,
+//aborting ProcessFile, since no unauthenticated plaintext must ever be written
+//return the process function, or an error if the key is invalid
+func NewAESGCMDecryptor(key []byte) (ProcessFunc, error) {
+	return NewAESGCMDecryptorWithOptions(key, AEADOptions{})
+}
+
+//NewAESGCMDecryptorWithOptions build a process function that decrypts shards
+//encrypted by NewAESGCMEncryptorWithOptions, as NewAESGCMDecryptor
+//key AES key used for encryption
+//opts settings used for encryption
+//return the process function, or an error if the key is invalid
+func NewAESGCMDecryptorWithOptions(key []byte, opts AEADOptions) (ProcessFunc, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aeadDecryptor(aead, opts), nil
+}
+
+//AEADOptions settings of the AEAD encryptors and decryptors
+//the zero value selects the defaults
+type AEADOptions struct {
+	//AAD additional data authenticated with each shard, given its index,
+	//nil for none; the decryptor must compute the same data, or every
+	//shard fails authentication, so it binds the shards to their position
+	//and to a context, for example with IndexAAD
+	AAD func(index int) []byte
+	//Deterministic true to derive the nonce of each shard from the key,
+	//its index, its AAD and its plaintext instead of drawing it at random,
+	//so that encrypting the same file twice gives the same bytes, as
+	//needed to reproduce the ledger commitments; the nonces differ unless
+	//all of these are equal, but the ciphertexts then reveal which shards
+	//at the same index of two files encrypted with the same key are equal
+	//the decryptor reads the nonce from the shard and ignores this setting
+	Deterministic bool
+	//Nonce source of the nonce of each shard, given its index, instead of
+	//crypto/rand, for example a counter kept by an HSM; nil for random
+	//nonces, it cannot be set together with Deterministic
+	//the nonces must have the size of the AEAD, or the shard fails, and
+	//must never repeat under the same key: a nonce reused for two
+	//plaintexts breaks both the confidentiality and the authentication
+	//the decryptor reads the nonce from the shard and ignores this setting
+	Nonce func(index int) []byte
+}
+
+//aad additional data of a shard
+//index index of the shard
+//return the output of AAD, or nil if it is not set
+func (opts AEADOptions) aad(index int) []byte {
+	if opts.AAD == nil {
+		return nil
+	}
+	return opts.AAD(index)
+}
+
+//IndexAAD build an AAD function binding each shard to a context and to its index
+//context identifier of the data, for example a document ID
+//a shard then fails authentication if it is moved to another position or
+//pasted into the file of another context
+//return the function giving context || big-endian 64 bit index
+func IndexAAD(context []byte) func(index int) []byte {
+	context = append([]byte(nil), context...)
+	return func(index int) []byte {
+		aad := make([]byte, len(context)+8)
+		copy(aad, context)
+		binary.BigEndian.PutUint64(aad[len(context):], uint64(index))
+		return aad
+	}
+}
+
+//nonceLabel label of the derivation of the key of the deterministic nonces
+var nonceLabel = []byte("public_ledger_sensitive_data nonce")
+
+//aeadEncryptor build a process function that encrypts each shard with an AEAD
+//aead cipher used to seal the shards
+//key key of aead, used only to derive the deterministic nonces
+//opts settings of the encryption
+//each output shard is nonce || ciphertext || tag, with a fresh random nonce,
+//one derived by deterministicNonce if opts.Deterministic is set, or the one
+//given by opts.Nonce
+//return the process function, failing on a nonce of opts.Nonce of the wrong
+//size, or an error if both opts.Deterministic and opts.Nonce are set
+func aeadEncryptor(aead cipher.AEAD, key []byte, opts AEADOptions) (ProcessFunc, error) {
+	if opts.Deterministic && opts.Nonce != nil {
+		return nil, errors.New("deterministic nonces and a nonce source are exclusive")
+	}
+	var nonceKey []byte
+	if opts.Deterministic {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(nonceLabel)
+		nonceKey = mac.Sum(nil)
+	}
+	return func(inp Shard) (Shard, error) {
+		aad := opts.aad(inp.Index)
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(inp.Value)+aead.Overhead())
+		switch {
+		case nonceKey != nil:
+			copy(nonce, deterministicNonce(nonceKey, inp.Index, aad, inp.Value))
+		case opts.Nonce != nil:
+			given := opts.Nonce(inp.Index)
+			if len(given) != len(nonce) {
+				return Shard{}, fmt.Errorf("nonce of shard %d has %d bytes instead of %d", inp.Index, len(given), len(nonce))
+			}
+			copy(nonce, given)
+		default:
+			if _, err := rand.Read(nonce); err != nil {
+				return Shard{}, fmt.Errorf("error generating nonce: %w", err)
+			}
+		}
+		//append ciphertext and tag after the nonce
+		ct := aead.Seal(nonce, nonce, inp.Value, aad)
+		return Shard{inp.Index, ct}, nil
+	}, nil
+}
+
+//deterministicNonce derive the nonce of a shard
+//nonceKey key derived from the key of the AEAD
+//index index of the shard
+//aad additional data of the shard
+//plaintext content of the shard
+//return HMAC-SHA256(nonceKey, index || len(aad) || aad || plaintext), with
+//index and length as big-endian 64 bit integers, to be truncated to the
+//nonce size
+func deterministicNonce(nonceKey []byte, index int, aad, plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, nonceKey)
+	var prefix [16]byte
+	binary.BigEndian.PutUint64(prefix[:8], uint64(index))
+	binary.BigEndian.PutUint64(prefix[8:], uint64(len(aad)))
+	mac.Write(prefix[:])
+	mac.Write(aad)
+	mac.Write(plaintext)
+	return mac.Sum(nil)
+}
+
+//aeadDecryptor build a process function that decrypts shards sealed by aeadEncryptor
+//aead cipher used to seal the shards
+//opts settings used for encryption
+//return the process function, failing on malformed shards, and with an
+//ErrAuthFailure on unauthenticated ones
+func aeadDecryptor(aead cipher.AEAD, opts AEADOptions) ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		if len(inp.Value) < aead.NonceSize()+aead.Overhead() {
+			return Shard{}, errors.New("too short to be decrypted")
+		}
+		nonce, ct := inp.Value[:aead.NonceSize()], inp.Value[aead.NonceSize():]
+		//decrypt in place, the input shard is not used afterwards
+		pt, err := aead.Open(ct[:0], nonce, ct, opts.aad(inp.Index))
+		if err != nil {
+			return Shard{}, ErrAuthFailure{inp.Index, err}
+		}
+		return Shard{inp.Index, pt}, nil
+	}
+}
+
+//AEADID identifier of the AEAD used to encrypt the shards of a file,
+//so that a reader can pick the matching decryptor
+type AEADID byte
+
+const (
+	//AEADNone the shards are not encrypted
+	AEADNone AEADID = iota
+	//AEADAESGCM the shards are encrypted by NewAESGCMEncryptor
+	AEADAESGCM
+	//AEADChaCha20Poly1305 the shards are encrypted by NewChaCha20Poly1305Encryptor
+	AEADChaCha20Poly1305
+)
+
+//NewAEADEncryptor build the encryptor of an AEAD
+//id identifier of the AEAD
+//key key of the AEAD
+//return the process function, or an error if id is unknown or the key is invalid
+func NewAEADEncryptor(id AEADID, key []byte) (ProcessFunc, error) {
+	switch id {
+	case AEADAESGCM:
+		return NewAESGCMEncryptor(key)
+	case AEADChaCha20Poly1305:
+		return NewChaCha20Poly1305Encryptor(key)
+	}
+	return nil, fmt.Errorf("unknown AEAD %d", id)
+}
+
+//NewAEADDecryptor build the decryptor of an AEAD
+//id identifier of the AEAD
+//key key of the AEAD
+//return the process function, or an error if id is unknown or the key is invalid
+func NewAEADDecryptor(id AEADID, key []byte) (ProcessFunc, error) {
+	switch id {
+	case AEADAESGCM:
+		return NewAESGCMDecryptor(key)
+	case AEADChaCha20Poly1305:
+		return NewChaCha20Poly1305Decryptor(key)
+	}
+	return nil, fmt.Errorf("unknown AEAD %d", id)
+}
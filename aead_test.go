@@ -0,0 +1,165 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+//counterNonce nonce source deriving each nonce of size bytes from a counter
+//starting at base, offset by the index of the shard
+func counterNonce(base uint64, size int) func(index int) []byte {
+	return func(index int) []byte {
+		nonce := make([]byte, size)
+		binary.BigEndian.PutUint64(nonce[size-8:], base+uint64(index))
+		return nonce
+	}
+}
+
+func TestAEADNonceSource(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	tests := []struct {
+		name      string
+		encryptor func(AEADOptions) (ProcessFunc, error)
+		decryptor func() (ProcessFunc, error)
+		nonceSize int
+	}{
+		{"AES-GCM", func(opts AEADOptions) (ProcessFunc, error) {
+			return NewAESGCMEncryptorWithOptions(key, opts)
+		}, func() (ProcessFunc, error) {
+			return NewAESGCMDecryptor(key)
+		}, 12},
+		{"ChaCha20-Poly1305", func(opts AEADOptions) (ProcessFunc, error) {
+			return NewChaCha20Poly1305EncryptorWithOptions(key, opts)
+		}, func() (ProcessFunc, error) {
+			return NewChaCha20Poly1305Decryptor(key)
+		}, 12},
+	}
+	in := writeInput(t, 10000)
+	dir := filepath.Dir(in)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//the same counter gives the same ciphertext on every run
+			var outputs [][]byte
+			for run, base := range []uint64{1000, 1000, 2000} {
+				encrypt, err := tt.encryptor(AEADOptions{Nonce: counterNonce(base, tt.nonceSize)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				out := filepath.Join(dir, "out")
+				if _, err := ProcessFile(context.Background(), in, out, encrypt, 1+run*4, 100, false, false, false, WriteTruncate, nil); err != nil {
+					t.Fatal(err)
+				}
+				output, err := ioutil.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, output)
+				//and it decrypts back to the input
+				decrypt, err := tt.decryptor()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := VerifyRoundTrip(in, out, decrypt, AESGCMShardSize(100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(outputs[0], outputs[1]) {
+				t.Error("same nonces, different ciphertexts")
+			}
+			if bytes.Equal(outputs[0], outputs[2]) {
+				t.Error("different nonces, same ciphertexts")
+			}
+			//the nonces must have the size of the AEAD
+			for _, size := range []int{tt.nonceSize - 1, tt.nonceSize + 1} {
+				encrypt, err := tt.encryptor(AEADOptions{Nonce: counterNonce(0, size)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := encrypt(Shard{0, []byte("value")}); err == nil {
+					t.Errorf("nonce of %d bytes accepted", size)
+				}
+			}
+			//a nonce source excludes the deterministic mode
+			if _, err := tt.encryptor(AEADOptions{Nonce: counterNonce(0, tt.nonceSize), Deterministic: true}); err == nil {
+				t.Error("Nonce accepted together with Deterministic")
+			}
+		})
+	}
+}
+
+func TestAESSIVDeterministic(t *testing.T) {
+	key := bytes.Repeat([]byte{5}, 32)
+	encrypt, err := NewAESSIVEncryptor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypt, err := NewAESSIVDecryptor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(index int, value string) []byte {
+		out, err := encrypt(Shard{index, []byte(value)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Index != index || len(out.Value) != len(value)+AESSIVOverhead {
+			t.Fatalf("shard %d of %d bytes", out.Index, len(out.Value))
+		}
+		pt, err := decrypt(out)
+		if err != nil || string(pt.Value) != value {
+			t.Fatalf("decrypted %q, %v", pt.Value, err)
+		}
+		return out.Value
+	}
+	//identical shards are identical ciphertexts, wherever they are
+	for _, value := range []string{"", "short", "a record of more than one block"} {
+		if !bytes.Equal(seal(0, value), seal(0, value)) || !bytes.Equal(seal(0, value), seal(7, value)) {
+			t.Errorf("%q: identical shards, different ciphertexts", value)
+		}
+	}
+	if bytes.Equal(seal(0, "record 1"), seal(1, "record 2")) {
+		t.Error("different shards, same ciphertexts")
+	}
+	//a different associated data is a different ciphertext, and fails the
+	//authentication of the other one
+	siv, err := newAESSIV(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt := []byte("record")
+	ct := siv.seal([][]byte{[]byte("ad 1")}, pt)
+	if bytes.Equal(ct, siv.seal([][]byte{[]byte("ad 2")}, pt)) || bytes.Equal(ct, siv.seal(nil, pt)) {
+		t.Error("different associated data, same ciphertexts")
+	}
+	if _, err := siv.open([][]byte{[]byte("ad 2")}, ct); err == nil {
+		t.Error("ciphertext opened with a different associated data")
+	}
+	//RFC 5297 A.1
+	vector := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	siv, err = newAESSIV(vector("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := vector("101112131415161718191a1b1c1d1e1f2021222324252627")
+	got := siv.seal([][]byte{ad}, vector("112233445566778899aabbccddee"))
+	if want := vector("85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c"); !bytes.Equal(got, want) {
+		t.Errorf("RFC 5297 A.1: %x, want %x", got, want)
+	}
+	//the keys must be of AES-SIV
+	for _, size := range []int{16, 31, 65} {
+		if _, err := NewAESSIVEncryptor(make([]byte, size)); err == nil {
+			t.Errorf("key of %d bytes accepted", size)
+		}
+	}
+}
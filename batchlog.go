@@ -0,0 +1,195 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ErrBatchLogTampered an entry of a batch log does not chain to the previous one
+var ErrBatchLogTampered = errors.New("batch log tampered")
+
+//ErrBatchLogTorn a batch log ends with an incomplete entry, as left by an
+//append interrupted by a crash (see RepairBatchLog)
+var ErrBatchLogTorn = errors.New("batch log ends with an incomplete entry")
+
+//BatchRecord summary of a run of ProcessFile, to append to a batch log
+type BatchRecord struct {
+	//Time when the run completed
+	Time time.Time
+	//InputHash digest of the input file, for example FileDigest(inputFile)
+	InputHash []byte
+	//OutputHash digest of the output file
+	OutputHash []byte
+	//Shards number of shards written
+	Shards int
+}
+
+//encodeBatchRecord format a record as a line of the batch log
+//rec record to encode
+//prev hash of the previous line, empty for the first one
+//return the line, without the newline
+func encodeBatchRecord(rec BatchRecord, prev []byte) string {
+	return fmt.Sprintf("%d:%x:%x:%d:%x", rec.Time.UnixNano(), rec.InputHash, rec.OutputHash, rec.Shards, prev)
+}
+
+//parseBatchLine decode a line of the batch log
+//line line to decode, without the newline
+//return the record and the hash of the previous line listed in the line
+func parseBatchLine(line string) (BatchRecord, []byte, error) {
+	parts := strings.Split(line, ":")
+	if len(parts) != 5 {
+		return BatchRecord{}, nil, fmt.Errorf("malformed batch log line %q", line)
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return BatchRecord{}, nil, fmt.Errorf("malformed batch log time %q", parts[0])
+	}
+	rec := BatchRecord{Time: time.Unix(0, nanos)}
+	rec.InputHash, err = hex.DecodeString(parts[1])
+	if err == nil {
+		rec.OutputHash, err = hex.DecodeString(parts[2])
+	}
+	if err != nil {
+		return BatchRecord{}, nil, fmt.Errorf("malformed batch log digest in %q", line)
+	}
+	rec.Shards, err = strconv.Atoi(parts[3])
+	if err != nil || rec.Shards < 0 {
+		return BatchRecord{}, nil, fmt.Errorf("malformed batch log shard count %q", parts[3])
+	}
+	prev, err := hex.DecodeString(parts[4])
+	if err != nil || (len(prev) != 0 && len(prev) != sha256.Size) {
+		return BatchRecord{}, nil, fmt.Errorf("malformed batch log chain hash %q", parts[4])
+	}
+	return rec, prev, nil
+}
+
+//batchLogLines split the content of a batch log in lines
+//data content of the log
+//return the lines without the newlines, or ErrBatchLogTorn if the last one
+//is not terminated, as after an interrupted append
+func batchLogLines(data []byte) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[len(data)-1] != '\n' {
+		return nil, ErrBatchLogTorn
+	}
+	return strings.Split(string(bytes.TrimSuffix(data, []byte{'\n'})), "\n"), nil
+}
+
+//AppendBatchRecord append a record to a batch log
+//logPath path to the log, created if missing
+//rec record to append
+//each line of the log is "time:input:output:shards:prev", with the time in
+//nanoseconds since the epoch, the digests in hex and prev the SHA-256 of
+//the previous line, empty for the first one, so that changing or removing
+//an entry breaks the chain (see VerifyBatchLog)
+//the log must not be appended to by several processes at once
+//the entry is synced to stable storage before the function returns, so an
+//entry reported as appended survives a crash; an append interrupted by a
+//crash can leave an incomplete last line, after which the appends fail with
+//ErrBatchLogTorn until RepairBatchLog drops it
+//return the error encountered reading or writing the log
+func AppendBatchRecord(logPath string, rec BatchRecord) (err error) {
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fileError(ErrReadInput, "error reading batch log", err)
+	}
+	lines, err := batchLogLines(data)
+	if err != nil {
+		return err
+	}
+	var prev []byte
+	if len(lines) > 0 {
+		last := lines[len(lines)-1]
+		if _, _, err := parseBatchLine(last); err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(last))
+		prev = sum[:]
+	}
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, OutputPerm)
+	if err != nil {
+		return fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//close file on exit
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fileError(ErrCloseOutput, "error closing file", cerr)
+		}
+	}()
+	if _, err := file.WriteString(encodeBatchRecord(rec, prev) + "\n"); err != nil {
+		return fileError(ErrWriteOutput, "error writing batch log", err)
+	}
+	return syncOutput(file)
+}
+
+//RepairBatchLog drop the incomplete last line of a batch log
+//logPath path to the log written by AppendBatchRecord
+//the incomplete line is an append interrupted before it was synced, so it
+//was never reported as appended and the record is to be appended again; the
+//complete entries are kept as they are, to be checked by VerifyBatchLog
+//return the number of bytes dropped, 0 if the log ends with a complete
+//entry, or the error encountered reading or truncating the log
+func RepairBatchLog(logPath string) (int, error) {
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		return 0, fileError(ErrReadInput, "error reading batch log", err)
+	}
+	if _, err := batchLogLines(data); !errors.Is(err, ErrBatchLogTorn) {
+		return 0, nil
+	}
+	keep := bytes.LastIndexByte(data, '\n') + 1
+	file, err := os.OpenFile(logPath, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	if err := file.Truncate(int64(keep)); err != nil {
+		return 0, fileError(ErrWriteOutput, "error truncating batch log", err)
+	}
+	if err := syncOutput(file); err != nil {
+		return 0, err
+	}
+	return len(data) - keep, nil
+}
+
+//VerifyBatchLog check the hash chain of a batch log
+//logPath path to the log written by AppendBatchRecord
+//nothing chains to the last entry, so it is protected only once another one
+//is appended, or if its hash is also kept elsewhere
+//return nil if every entry chains to the previous one, an error wrapping
+//ErrBatchLogTampered naming the first entry that does not, or the error
+//reading or parsing the log
+func VerifyBatchLog(logPath string) error {
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		return fileError(ErrReadInput, "error reading batch log", err)
+	}
+	lines, err := batchLogLines(data)
+	if err != nil {
+		return err
+	}
+	var expected []byte
+	for i, line := range lines {
+		_, prev, err := parseBatchLine(line)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		if !bytes.Equal(prev, expected) {
+			return fmt.Errorf("%w: entry %d does not match the previous one", ErrBatchLogTampered, i)
+		}
+		sum := sha256.Sum256([]byte(line))
+		expected = sum[:]
+	}
+	return nil
+}
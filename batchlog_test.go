@@ -0,0 +1,78 @@
+package ledger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBatchLog(t *testing.T) {
+	tests := []struct {
+		name string
+		//damage change the content of a log of three entries
+		damage func(data []byte) []byte
+		want   error
+	}{
+		{"valid chain", func(data []byte) []byte { return data }, nil},
+		{"modified entry", func(data []byte) []byte {
+			return bytes.Replace(data, []byte(":2:"), []byte(":7:"), 1)
+		}, ErrBatchLogTampered},
+		{"removed entry", func(data []byte) []byte {
+			first := bytes.IndexByte(data, '\n') + 1
+			second := first + bytes.IndexByte(data[first:], '\n') + 1
+			return append(data[:first:first], data[second:]...)
+		}, ErrBatchLogTampered},
+		{"torn tail", func(data []byte) []byte { return append(data, "1234:ab"...) }, ErrBatchLogTorn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "batch.log")
+			for i := 1; i <= 3; i++ {
+				rec := BatchRecord{time.Unix(int64(i), 0), []byte{byte(i)}, []byte{byte(i * 2)}, i}
+				if err := AppendBatchRecord(logPath, rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(logPath, tt.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err = VerifyBatchLog(logPath)
+			if !errors.Is(err, tt.want) || tt.want == nil && err != nil {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if tt.want != ErrBatchLogTorn {
+				return
+			}
+			//a torn tail blocks the appends until it is dropped
+			rec := BatchRecord{time.Unix(4, 0), []byte{4}, []byte{8}, 4}
+			if err := AppendBatchRecord(logPath, rec); !errors.Is(err, ErrBatchLogTorn) {
+				t.Fatalf("append after torn tail: %v", err)
+			}
+			dropped, err := RepairBatchLog(logPath)
+			if err != nil || dropped != len("1234:ab") {
+				t.Fatalf("dropped %d bytes, %v", dropped, err)
+			}
+			if fi, err := os.Stat(logPath); err != nil || fi.Size() != int64(len(data)) {
+				t.Fatalf("repaired log %v, %v", fi, err)
+			}
+			if err := AppendBatchRecord(logPath, rec); err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyBatchLog(logPath); err != nil {
+				t.Fatal(err)
+			}
+			//an intact log is left alone
+			if dropped, err := RepairBatchLog(logPath); err != nil || dropped != 0 {
+				t.Fatalf("dropped %d bytes of an intact log, %v", dropped, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//BlobSuffix extension of the files written by ProcessFileToBlob
+const BlobSuffix = ".blob"
+
+//BlobPath path of a content-addressed output
+//dir directory of the outputs
+//hash SHA-256 of the content of the output
+//return dir/<hex of hash>.blob
+func BlobPath(dir string, hash []byte) string {
+	return filepath.Join(dir, hex.EncodeToString(hash)+BlobSuffix)
+}
+
+//ProcessFileToBlob process a file into an output named after its content
+//ctx context to cancel the processing
+//inputFile path to input file, it must be a regular file (see ErrNotRegular)
+//dir directory where the output is stored, as BlobPath(dir, hash)
+//process function that processes each chunk
+//opts settings of the processing as in ProcessFileWithOptions, Manifest and
+//Resume are not supported since the output name is only known at the end
+//the output is written on a temporary file in dir, hashed with SHA-256 and
+//renamed atomically, so its name identifies and verifies it and no partial
+//output is ever found under a final name; if an output with the same hash is
+//already in dir it is kept and the new one discarded, so identical outputs
+//are stored once
+//return the SHA-256 of the output and what was written, or the first error
+//encountered, in which case no output is left in dir
+func ProcessFileToBlob(ctx context.Context, inputFile, dir string, process ProcessFunc, opts ProcessOptions) (hash []byte, res Result, err error) {
+	defer zeroizeAll(opts.Zeroize)
+	opts, err = opts.withDefaults()
+	if err != nil {
+		return nil, res, err
+	}
+	if opts.Manifest || opts.Resume {
+		return nil, res, errors.New("manifest and resume are not supported for content-addressed outputs")
+	}
+	opts.Mode = WriteTruncate
+	tmp, err := ioutil.TempFile(dir, ".blob")
+	if err != nil {
+		return nil, res, fileError(ErrOpenOutput, "error creating file", err)
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	//remove the temporary file unless it was renamed
+	defer os.Remove(tmpName)
+	res, err = processFile(ctx, inputFile, tmpName, process, opts)
+	if err != nil {
+		return nil, res, err
+	}
+	//the temporary file is created private
+	if err := os.Chmod(tmpName, opts.Perm); err != nil {
+		return nil, res, fileError(ErrOpenOutput, "error setting permissions", err)
+	}
+	hash, err = hashFile(tmpName)
+	if err != nil {
+		return nil, res, err
+	}
+	blobPath := BlobPath(dir, hash)
+	//the same content is already stored
+	if _, err := os.Lstat(blobPath); err == nil {
+		return hash, res, nil
+	}
+	if err := os.Rename(tmpName, blobPath); err != nil {
+		return nil, res, fileError(ErrWriteOutput, "error renaming file", err)
+	}
+	if !opts.NoSync {
+		if err := syncDir(dir); err != nil {
+			return nil, res, err
+		}
+	}
+	return hash, res, nil
+}
+
+//hashFile compute the SHA-256 of a file, reading it as a stream
+//filePath path to the file
+//return the hash, or the error encountered reading the file
+func hashFile(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, fileError(ErrReadInput, "error reading file", err)
+	}
+	return h.Sum(nil), nil
+}
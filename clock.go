@@ -0,0 +1,71 @@
+package ledger
+
+import "time"
+
+//clock source of time of the features that wait: the flush timeout of the
+//ordering, the throttling of the input and the backoff of the retries
+//each run takes its own, so that a clock advanced by hand drives their
+//timing deterministically
+type clock interface {
+	//Now current time
+	Now() time.Time
+	//After channel that receives the current time once d has elapsed, the
+	//timer cannot be stopped, so NewTimer is used where the wait can be cut short
+	After(d time.Duration) <-chan time.Time
+	//Sleep wait for d to elapse
+	Sleep(d time.Duration)
+	//NewTimer timer expiring once d has elapsed
+	NewTimer(d time.Duration) clockTimer
+}
+
+//clockTimer timer of a clock, as time.Timer
+type clockTimer interface {
+	//C channel that receives the time on expiry
+	C() <-chan time.Time
+	//Stop stop the timer, to release it before its expiry
+	//return true if it was stopped, false if it had already expired
+	Stop() bool
+}
+
+//realClock clock of the system, through the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+//realTimer timer of the system clock
+type realTimer struct {
+	//timer timer of the time package
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+//orRealClock the clock to use
+//c clock of the run, nil for the system clock
+//return c, or realClock if it is nil
+func orRealClock(c clock) clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
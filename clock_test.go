@@ -0,0 +1,119 @@
+package ledger
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock clock advanced by hand with Advance
+// its timers expire synchronously: Advance returns once every timer it
+// expires has been received from, so the code waiting on it has moved on
+type fakeClock struct {
+	mu sync.Mutex
+	//now current time
+	now time.Time
+	//timers timers started and neither expired nor stopped
+	timers []*fakeTimer
+	//created receives the duration of every timer started, to wait for the
+	//code under test to block on it
+	created chan time.Duration
+	//slept durations passed to Sleep, which advances the clock
+	slept []time.Duration
+}
+
+// fakeTimer timer of a fakeClock
+type fakeTimer struct {
+	clock *fakeClock
+	//due time of expiry
+	due time.Time
+	//c channel of the expiry, unbuffered
+	c chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), created: make(chan time.Duration, 64)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *fakeClock) Sleep(d time.Duration) {
+	f.mu.Lock()
+	f.slept = append(f.slept, d)
+	f.mu.Unlock()
+	f.Advance(d)
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) clockTimer {
+	f.mu.Lock()
+	t := &fakeTimer{f, f.now.Add(d), make(chan time.Time)}
+	f.timers = append(f.timers, t)
+	f.mu.Unlock()
+	f.created <- d
+	return t
+}
+
+// Advance move the clock forward, expiring the timers due by then
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	now := f.now
+	var expired, running []*fakeTimer
+	for _, t := range f.timers {
+		if t.due.After(now) {
+			running = append(running, t)
+		} else {
+			expired = append(expired, t)
+		}
+	}
+	f.timers = running
+	f.mu.Unlock()
+	for _, t := range expired {
+		t.c <- now
+	}
+}
+
+// active number of timers started and neither expired nor stopped
+func (f *fakeClock) active() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// waitTimer wait for the code under test to start a timer
+// return the duration of the timer
+func (f *fakeClock) waitTimer(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-f.created:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timer started")
+		return 0
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
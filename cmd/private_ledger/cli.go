@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ledger "github.com/gaetanorusso/public_ledger_sensitive_data"
+)
+
+//default plaintext chunk size of the command line tool
+const defChunk = ledger.DefaultChunkSize
+
+//exit status of the command line tool when it is interrupted, 128+SIGINT
+//as for the shells
+const exitInterrupted = 130
+
+//errInterrupted the command line tool stopped on SIGINT or SIGTERM before
+//processing the whole file
+var errInterrupted = errors.New("interrupted")
+
+//runTool encrypt, decrypt or verify a file with AES-GCM
+//mode one of encrypt, decrypt or verify
+//in path to input file: the plaintext to encrypt, or the ciphertext to decrypt or verify
+//out path to output file, not used to verify
+//keyFile path to the file containing the raw AES key of 16, 24 or 32 bytes
+//workers number of concurrent workers, 0 for one per CPU
+//chunk plaintext chunk size, the same must be used to encrypt and decrypt
+//dryRun true to only check the input, the key and the output, printing the
+//number of shards and the size of the output, without processing the file
+//resume checkpoint the run, writing the output in place, and continue the
+//run interrupted on the same output instead of starting over; without it the
+//output is written on a temporary file renamed into place once complete
+//verify decrypts every shard discarding the plaintext, checking that the
+//ciphertext is intact and encrypted with the key
+//on SIGINT or SIGTERM the processing stops; with resume the shards already
+//processed in order are written and checkpointed, so that running again
+//with resume continues from them, without it the output is left as it was
+//return the first error encountered, wrapping errInterrupted if the run was
+//stopped by a signal
+func runTool(mode, in, out, keyFile string, workers, chunk int, dryRun, resume bool) error {
+	if mode != "encrypt" && mode != "decrypt" && mode != "verify" {
+		return fmt.Errorf("unknown mode %q: use encrypt, decrypt or verify", mode)
+	}
+	if in == "" {
+		return errors.New("missing input file (-in)")
+	}
+	if out == "" && mode != "verify" {
+		return errors.New("missing output file (-out)")
+	}
+	if chunk <= 0 {
+		return errors.New("chunk size must be positive")
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading key: %w", err)
+	}
+	//build the process function, checking the key
+	var process ledger.ProcessFunc
+	size := ledger.AESGCMShardSize(chunk)
+	if mode == "encrypt" {
+		process, err = ledger.NewAESGCMEncryptor(key)
+		size = chunk
+	} else {
+		process, err = ledger.NewAESGCMDecryptor(key)
+	}
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return planTool(mode, in, out, size)
+	}
+	//stop cleanly on the first signal
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "%v: stopping after the shards being processed\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if mode == "verify" {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		err = ledger.ProcessReader(ctx, file, ioutil.Discard, process, workers, size, false, nil)
+		if errors.Is(err, context.Canceled) {
+			return fmt.Errorf("%w: verification incomplete", errInterrupted)
+		}
+		return err
+	}
+	//a fresh run drops the checkpoint of a previous one
+	checkpointFile := out + ledger.ProgressSuffix
+	if !resume {
+		if err := os.Remove(checkpointFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing checkpoint: %w", err)
+		}
+	}
+	//only a resumable run writes the output in place, the others are atomic
+	res, err := ledger.ProcessFile(ctx, in, out, process, workers, size, false, false, resume, ledger.WriteTruncate, nil)
+	if errors.Is(err, context.Canceled) && resume {
+		return fmt.Errorf("%w: %d shards written to %s, run again with -resume to continue", errInterrupted, res.ShardsWritten, out)
+	}
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: nothing written to %s, use -resume for a run that can be continued", errInterrupted, out)
+	}
+	//ProcessFile removes the checkpoint once the output is complete
+	return err
+}
+
+//planTool print what runTool would do, see Plan
+//mode one of encrypt, decrypt or verify
+//in path to input file
+//out path to output file, not used to verify
+//size size of the chunks of the input file
+//return the first problem found
+func planTool(mode, in, out string, size int) error {
+	//the output is not written to verify, so only the input is checked
+	if mode == "verify" {
+		out = os.DevNull
+	}
+	shards, inputBytes, err := ledger.Plan(in, out, size)
+	if err != nil {
+		return err
+	}
+	outputBytes := inputBytes + int64(shards)*ledger.AESGCMOverhead
+	if mode != "encrypt" {
+		outputBytes = inputBytes - int64(shards)*ledger.AESGCMOverhead
+	}
+	fmt.Printf("%s: %d bytes in %d shards of %d bytes\n", in, inputBytes, shards, size)
+	if inputBytes%int64(size) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: the last shard is partial, %d bytes\n", inputBytes%int64(size))
+	}
+	if mode == "decrypt" && inputBytes%int64(size) != 0 && inputBytes%int64(size) <= ledger.AESGCMOverhead {
+		return errors.New("last shard too short to be decrypted, wrong chunk size?")
+	}
+	if mode != "verify" {
+		fmt.Printf("%s: %d bytes\n", out, outputBytes)
+	}
+	return nil
+}
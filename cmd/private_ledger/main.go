@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	ledger "github.com/gaetanorusso/public_ledger_sensitive_data"
 	curve "github.com/gaetanorusso/public_ledger_sensitive_data/miracl/go/core/BN254"
 )
 
@@ -17,15 +20,38 @@ const defSettings string = "test/settings.txt"
 
 func main() {
 	/* try this if you want to test */
-	fmt.Println("Private Ledger: Welcome!")
 	//flag -settings to set up the test
 	settings := flag.String("settings", defSettings, "settings file path")
+	//flags to process a file on its own, see runTool
+	mode := flag.String("mode", "", "process a file instead of running the test: encrypt, decrypt or verify")
+	in := flag.String("in", "", "input file path")
+	out := flag.String("out", "", "output file path")
+	keyFile := flag.String("keyfile", "", "path to the file containing the AES key")
+	workers := flag.Int("workers", 0, "number of concurrent workers, 0 for one per CPU")
+	chunk := flag.Int("chunk", defChunk, "plaintext chunk size in bytes")
+	dryRun := flag.Bool("dry-run", false, "check the input, key and output, without processing the file")
+	resume := flag.Bool("resume", false, "checkpoint the run writing the output in place, continuing a run interrupted on the same output")
 	flag.Parse()
+	if *mode != "" {
+		err := runTool(*mode, *in, *out, *keyFile, *workers, *chunk, *dryRun, *resume)
+		if errors.Is(err, errInterrupted) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	//the demo shows the diagnostic messages along with its own
+	ledger.Log = log.New(os.Stdout, "", 0)
+	fmt.Println("Private Ledger: Welcome!")
 	//load settings
-	ledger := LoadSettings(*settings)
+	l := LoadSettings(*settings)
 	fmt.Println("Loaded settings from:", *settings)
 	//reset files
-	toClean := []string{ledger.KeysFile, ledger.ShardsFile}
+	toClean := []string{l.KeysFile, l.ShardsFile}
 	for _, filename := range toClean {
 		err := os.Remove(filename)
 		if err != nil {
@@ -35,12 +61,12 @@ func main() {
 	//generate shards and get time-key
 	fmt.Println("Initiating ledger setup...")
 	startTime := time.Now()
-	s := ledger.Init()
+	s := l.Init()
 	fmt.Println("Completed in", time.Now().Sub(startTime).Seconds(), "s")
 	//generate user keys
-	u := GenUser()
+	u := ledger.GenUser()
 	//compute encryption token
-	token := TokenGen(u.PublicKey, s)
+	token := ledger.TokenGen(u.PublicKey, s)
 	//ask the user which file to encrypt
 	reader := bufio.NewReader(os.Stdin)
 	defFile := "docs/private-ledger.pdf"
@@ -53,36 +79,36 @@ func main() {
 	//add a block
 	fmt.Println("Encrypting file", path)
 	startTime = time.Now()
-	index := u.AddBlock(ledger, token, path)
+	index := u.AddBlock(l, token, path)
 	fmt.Println("Block added with index", index)
 	fmt.Println("Completed in", time.Now().Sub(startTime).Seconds(), "s")
 	//unlock key from the ledger
-	unlocked := u.UnlockKey(ledger.GetEncKey(index))
+	unlocked := u.UnlockKey(l.GetEncKey(index))
 	//decrypt file
 	decPath := "test/dec"
 	fmt.Println("Testing decryption to", decPath)
 	startTime = time.Now()
-	ledger.DecryptBlock(index, unlocked, decPath)
+	l.DecryptBlock(index, unlocked, decPath)
 	fmt.Println("Decryption Successful!")
 	fmt.Println("Completed in", time.Now().Sub(startTime).Seconds(), "s")
 	//update ledger
 	fmt.Println("Initiating ledger update...")
 	startTime = time.Now()
-	sNew := ledger.Update(s)
+	sNew := l.Update(s)
 	fmt.Println("Completed in", time.Now().Sub(startTime).Seconds(), "s")
 	//compare time keys
 	fmt.Println("Time keys:")
 	fmt.Println(s.ToString())
 	fmt.Println(sNew.ToString())
 	//get updated encapsulated key from ledger
-	keyEncNew := ledger.GetEncKey(index)
+	keyEncNew := l.GetEncKey(index)
 	//unlock key
 	unlockedNew := u.UnlockKey(keyEncNew)
 	//decrypt file again
 	decPath = "test/dec2"
 	fmt.Println("Testing decryption to", decPath)
 	startTime = time.Now()
-	ledger.DecryptBlock(index, unlockedNew, decPath)
+	l.DecryptBlock(index, unlockedNew, decPath)
 	fmt.Println("Decryption Successful!")
 	fmt.Println("Completed in", time.Now().Sub(startTime).Seconds(), "s")
 }
@@ -91,7 +117,7 @@ func main() {
 //settingsFile path to settings file
 //returns a ledger struct
 //also modifies global variables ShardSize and MaxShards
-func LoadSettings(settingsFile string) Ledger {
+func LoadSettings(settingsFile string) ledger.Ledger {
 	//open settings file
 	file, err := os.Open(settingsFile)
 	if err != nil {
@@ -109,22 +135,22 @@ func LoadSettings(settingsFile string) Ledger {
 	if !scanner.Scan() {
 		panic(scanner.Err())
 	}
-	PadSize, err = strconv.Atoi(scanner.Text())
+	ledger.PadSize, err = strconv.Atoi(scanner.Text())
 	if err != nil {
 		panic(err)
 	}
-	if PadSize < int(2*curve.MODBYTES) {
+	if ledger.PadSize < int(2*curve.MODBYTES) {
 		panic("Incorrect settings: Pad size outside limits")
 	}
 	//read number of shards to create
 	if !scanner.Scan() {
 		panic(scanner.Err())
 	}
-	MaxShards, err = strconv.Atoi(scanner.Text())
+	ledger.MaxShards, err = strconv.Atoi(scanner.Text())
 	if err != nil {
 		panic(err)
 	}
-	if PadSize < 1 {
+	if ledger.PadSize < 1 {
 		panic("Incorrect settings: non-positive number of shards")
 	}
 	//read paths for the ledger struct
@@ -145,5 +171,5 @@ func LoadSettings(settingsFile string) Ledger {
 	}
 	encryptPath := scanner.Text()
 	//return ledger
-	return Ledger{shardsFile, keysFile, rootPath, encryptPath}
+	return ledger.Ledger{ShardsFile: shardsFile, KeysFile: keysFile, RootPath: rootPath, EncryptPath: encryptPath}
 }
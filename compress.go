@@ -0,0 +1,47 @@
+package ledger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+//NewGzipCompressor build a process function that compresses each shard with gzip
+//the compressed shards have variable length, so the output must be written
+//with framed shards (ProcessFile fails with ErrVariableLength otherwise)
+//and read with ReadFramedValue instead of ReadValue
+//return the process function
+func NewGzipCompressor() ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		var buffer bytes.Buffer
+		zw := gzip.NewWriter(&buffer)
+		_, err := zw.Write(inp.Value)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return Shard{}, err
+		}
+		return Shard{inp.Index, buffer.Bytes()}, nil
+	}
+}
+
+//NewGzipDecompressor build a process function that decompresses shards compressed by NewGzipCompressor
+//the process function fails if a shard is not valid gzip data, aborting ProcessFile
+//return the process function
+func NewGzipDecompressor() ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		zr, err := gzip.NewReader(bytes.NewReader(inp.Value))
+		if err != nil {
+			return Shard{}, err
+		}
+		pt, err := ioutil.ReadAll(zr)
+		if err == nil {
+			err = zr.Close()
+		}
+		if err != nil {
+			return Shard{}, err
+		}
+		return Shard{inp.Index, pt}, nil
+	}
+}
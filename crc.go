@@ -0,0 +1,83 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+//CRC32CSize byte size of the checksum appended to each shard by NewCRC32CSealer
+const CRC32CSize = 4
+
+//castagnoli table of the CRC32C polynomial
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//ErrShardCorrupt the checksum of a shard, or its digest in a manifest, does
+//not match its content, so the stored data is damaged
+type ErrShardCorrupt struct {
+	//Index index of the damaged shard
+	Index int
+}
+
+//Error describe the damaged shard
+func (e ErrShardCorrupt) Error() string {
+	return fmt.Sprintf("shard %d corrupt: checksum mismatch", e.Index)
+}
+
+//NewCRC32CSealer build a process function that appends to each shard its CRC32C
+//chain it as the last stage, after the encryption, for example
+//Chain(enc, NewCRC32CSealer()), so that the checksum covers the stored bytes
+//each output shard is value || big-endian CRC32C(value), CRC32CSize bytes
+//longer than the input one, so it can be written framed or not
+//return the process function
+func NewCRC32CSealer() ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		var sum [CRC32CSize]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.Checksum(inp.Value, castagnoli))
+		return Shard{inp.Index, append(inp.Value, sum[:]...)}, nil
+	}
+}
+
+//NewCRC32CVerifier build a process function that checks and strips the checksum added by NewCRC32CSealer
+//chain it as the first stage, before the decryption, for example
+//Chain(NewCRC32CVerifier(), dec), so that damaged data is told apart from a wrong key
+//the process function fails with ErrShardCorrupt if a shard does not match
+//its checksum, aborting ProcessFile with an error that wraps it
+//return the process function
+func NewCRC32CVerifier() ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		value, err := CheckCRC32C(inp.Index, inp.Value)
+		if err != nil {
+			return Shard{}, err
+		}
+		return Shard{inp.Index, value}, nil
+	}
+}
+
+//CheckCRC32C check and strip the checksum added by NewCRC32CSealer
+//index index of the shard, reported in the error
+//value shard read from file
+//return the shard without the checksum, or ErrShardCorrupt if it does not match
+func CheckCRC32C(index int, value []byte) ([]byte, error) {
+	if len(value) < CRC32CSize {
+		return nil, ErrShardCorrupt{index}
+	}
+	data := value[:len(value)-CRC32CSize]
+	if binary.BigEndian.Uint32(value[len(data):]) != crc32.Checksum(data, castagnoli) {
+		return nil, ErrShardCorrupt{index}
+	}
+	return data, nil
+}
+
+//ReadCheckedValue read a single value from a file written with framed, checksummed shards
+//filePath path to the file containing a series of framed values sealed by NewCRC32CSealer
+//index index of the desired value
+//return the value read without the checksum, ErrShardCorrupt if it does not
+//match, or the errors of ReadFramedValue
+func ReadCheckedValue(filePath string, index int64) ([]byte, error) {
+	value, err := ReadFramedValue(filePath, index)
+	if err != nil {
+		return nil, err
+	}
+	return CheckCRC32C(int(index), value)
+}
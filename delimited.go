@@ -0,0 +1,73 @@
+package ledger
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//ErrRecordTooLong a delimited record is longer than the maximum size
+var ErrRecordTooLong = errors.New("record too long")
+
+//ReadDelimitedChunks read delimited records to process them concurrently
+//ctx context that stops the reading when cancelled
+//r reader of the records, for example newline-delimited JSON
+//output channel where the records are fed, one shard per record
+//delim byte terminating each record
+//maxSize maximum length of a record, delimiter included
+//every shard holds a record with its delimiter, so that the shards
+//concatenated are the data read; a final record without delimiter is fed as
+//it is, and no empty shard follows a final delimiter
+//the records have variable length, so the processed shards must be written
+//with framing
+//return the first error encountered while reading, an error wrapping
+//ErrInvalidSize if maxSize is not positive, an error wrapping
+//ErrRecordTooLong if a record exceeds maxSize, after feeding the previous
+//ones, or ctx.Err() if the context is cancelled before the end of the data
+func ReadDelimitedChunks(ctx context.Context, r io.Reader, output chan Shard, delim byte, maxSize int) error {
+	//close channel on exit to signal end of input operations
+	defer close(output)
+	if maxSize <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, maxSize)
+	}
+	//buffered reading
+	reader := bufio.NewReader(r)
+	for i := 0; ; i++ {
+		//stop reading as soon as the context is cancelled
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var record []byte
+		var err error
+		//a record longer than the buffer comes in several fragments
+		for {
+			var fragment []byte
+			fragment, err = reader.ReadSlice(delim)
+			record = append(record, fragment...)
+			if len(record) > maxSize {
+				return fmt.Errorf("%w: record %d is longer than %d bytes", ErrRecordTooLong, i, maxSize)
+			}
+			if err != bufio.ErrBufferFull {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			return fileError(ErrReadInput, "error reading file", err)
+		}
+		//no data left after the last delimiter
+		if len(record) == 0 {
+			return nil
+		}
+		//feed record to channel
+		select {
+		case output <- Shard{i, record}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+//DiffShards find the shards that differ between two files, for example two
+//encryptions of the same dataset, so that only those are anchored again
+//fileA path to the first file
+//fileB path to the second file
+//size size of the shards, 0 if both files were written with framed shards;
+//if positive, the shards are read after the header if any, as in ReadValue
+//the shards are compared byte by byte at the same index: with framed shards
+//both files are indexed with BuildShardIndex and the values are read only
+//when their lengths are equal; the shards present in only one of the files,
+//because the other is shorter, are all reported as changed, and so is a
+//last shard of fixed size whose length differs
+//return the indices of the shards that differ, in increasing order, or the
+//first error reading the files, wrapping ErrInvalidSize for a negative size,
+//ErrSizeMismatch or ErrShortValue as ReadValue and BuildShardIndex
+func DiffShards(fileA, fileB string, size int64) (changed []int64, err error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	if size == 0 {
+		return diffFramed(fileA, fileB)
+	}
+	//open input files
+	a, err := os.Open(fileA)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close files on exit
+	defer a.Close()
+	b, err := os.Open(fileB)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	defer b.Close()
+	readerA, err := valueStream(a, size)
+	if err != nil {
+		return nil, err
+	}
+	readerB, err := valueStream(b, size)
+	if err != nil {
+		return nil, err
+	}
+	bufferA := make([]byte, size)
+	bufferB := make([]byte, size)
+	for i := int64(0); ; i++ {
+		na, err := readValueFrom(readerA, bufferA)
+		if err != nil {
+			return nil, err
+		}
+		nb, err := readValueFrom(readerB, bufferB)
+		if err != nil {
+			return nil, err
+		}
+		if na == 0 && nb == 0 {
+			return changed, nil
+		}
+		if !bytes.Equal(bufferA[:na], bufferB[:nb]) {
+			changed = append(changed, i)
+		}
+	}
+}
+
+//valueStream buffered reader of the values of a file of same-size values
+//file file to read, positioned at its beginning
+//size size of the values
+//return the reader positioned after the header if any, or the errors of
+//valueStart
+func valueStream(file *os.File, size int64) (io.Reader, error) {
+	start, err := valueStart(file, size)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, fileError(ErrReadInput, "error seeking file", err)
+	}
+	return bufio.NewReader(file), nil
+}
+
+//readValueFrom read the next value of a stream of same-size values
+//r stream to read
+//buffer where to read the value, of the size of the values
+//return the length of the value read, shorter than buffer for the last one
+//and 0 at the end of the stream, or the read error
+func readValueFrom(r io.Reader, buffer []byte) (int, error) {
+	n, err := io.ReadFull(r, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	if err != nil {
+		return 0, fileError(ErrReadInput, "error reading file", err)
+	}
+	return n, nil
+}
+
+//diffFramed find the shards that differ between two files of framed shards
+//fileA path to the first file
+//fileB path to the second file
+//return the indices of the shards that differ, as DiffShards
+func diffFramed(fileA, fileB string) ([]int64, error) {
+	idxA, err := BuildShardIndex(fileA)
+	if err != nil {
+		return nil, err
+	}
+	idxB, err := BuildShardIndex(fileB)
+	if err != nil {
+		return nil, err
+	}
+	//open input files
+	a, err := os.Open(fileA)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close files on exit
+	defer a.Close()
+	b, err := os.Open(fileB)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	defer b.Close()
+	common, total := idxA.Len(), idxB.Len()
+	if common > total {
+		common, total = total, common
+	}
+	var changed []int64
+	for i := 0; i < common; i++ {
+		if idxA.lengths[i] != idxB.lengths[i] {
+			changed = append(changed, int64(i))
+			continue
+		}
+		valueA, err := idxA.readAt(a, i)
+		if err != nil {
+			return nil, err
+		}
+		valueB, err := idxB.readAt(b, i)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(valueA, valueB) {
+			changed = append(changed, int64(i))
+		}
+	}
+	for i := common; i < total; i++ {
+		changed = append(changed, int64(i))
+	}
+	return changed, nil
+}
@@ -0,0 +1,135 @@
+package ledger
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+//syncOutput flush a file just written to stable storage
+//file output file, still open
+//the directory holding the file is synced too, so that a file just created
+//survives a crash along with its directory entry
+//each sync waits for the device, which costs a few milliseconds per file on
+//disks and more on network storage (see ProcessOptions.NoSync)
+//return the error encountered syncing the file or its directory
+func syncOutput(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return fileError(ErrWriteOutput, "error syncing file", err)
+	}
+	return syncDir(filepath.Dir(file.Name()))
+}
+
+//syncDir flush the entries of a directory to stable storage
+//dir path to the directory
+//return the error encountered syncing the directory, nil on Windows where
+//directories cannot be synced
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fileError(ErrOpenInput, "error opening directory", err)
+	}
+	//close directory on exit
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fileError(ErrWriteOutput, "error syncing directory", err)
+	}
+	return nil
+}
+
+//TempSuffix suffix of the temporary file where an output is written before
+//being renamed into place
+const TempSuffix = ".tmp"
+
+//createTemp open the temporary file of an output
+//filename path of the output
+//mode how an existing output is treated, WriteExclusive fails at once if
+//it exists
+//perm permissions of the output if it is created
+//return filename+TempSuffix opened for writing, truncated if left by an
+//interrupted run, with the permissions of the existing output if any
+func createTemp(filename string, mode WriteMode, perm os.FileMode) (*os.File, error) {
+	info, err := os.Stat(filename)
+	if err == nil && mode == WriteExclusive {
+		return nil, fileError(ErrOpenOutput, "error opening file", &os.PathError{Op: "open", Path: filename, Err: os.ErrExist})
+	}
+	//the rename would fail only once the whole output is written
+	if err == nil && info.IsDir() {
+		return nil, fileError(ErrOpenOutput, "error opening file", &os.PathError{Op: "open", Path: filename, Err: errors.New("is a directory")})
+	}
+	file, err := os.OpenFile(filename+TempSuffix, WriteTruncate.openFlags(), perm)
+	if err != nil {
+		return nil, fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//an overwritten output keeps its permissions
+	if info != nil {
+		if err := file.Chmod(info.Mode().Perm()); err != nil {
+			file.Close()
+			return nil, fileError(ErrOpenOutput, "error setting permissions", err)
+		}
+	}
+	return file, nil
+}
+
+//commitTemp move a temporary file written in full onto its output
+//file temporary file opened by createTemp, closed by the function
+//filename path of the output
+//mode WriteExclusive to fail if the output was created meanwhile
+//sync true to sync the file before the rename, and the directory after it,
+//so the output is either the previous one or the new one in full, even
+//after a crash; false only renames, as with ProcessOptions.NoSync
+//return the error encountered, in which case the temporary file is left for
+//the caller to remove
+func commitTemp(file *os.File, filename string, mode WriteMode, sync bool) error {
+	var err error
+	if sync {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fileError(ErrWriteOutput, "error syncing file", err)
+	}
+	if mode == WriteExclusive {
+		//a link, unlike a rename, fails if the output exists
+		if err := os.Link(file.Name(), filename); err != nil {
+			return fileError(ErrWriteOutput, "error renaming file", err)
+		}
+		os.Remove(file.Name())
+	} else if err := os.Rename(file.Name(), filename); err != nil {
+		return fileError(ErrWriteOutput, "error renaming file", err)
+	}
+	if !sync {
+		return nil
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+//writeOutput write an output in full through its temporary file
+//outputFile path of the output
+//write function writing the whole output on the temporary file
+//the output is synced and moved into place (see commitTemp) only if write
+//succeeds, otherwise the temporary file is removed and an existing output
+//stays as it was
+//return the error of write, or the error encountered committing the output
+func writeOutput(outputFile string, write func(out *os.File) error) error {
+	out, err := createTemp(outputFile, WriteTruncate, OutputPerm)
+	if err != nil {
+		return err
+	}
+	if err := write(out); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := commitTemp(out, outputFile, WriteTruncate, true); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return nil
+}
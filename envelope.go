@@ -0,0 +1,282 @@
+package ledger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+//KeyWrapper protect the data keys of the files encrypted with envelope encryption
+//under a key encryption key, which can be kept in a KMS or HSM
+type KeyWrapper interface {
+	//WrapKey encrypt a data key
+	WrapKey(dataKey []byte) ([]byte, error)
+	//UnwrapKey decrypt a data key wrapped by WrapKey, failing if it is not authentic
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+//EnvelopeKeySlot bytes reserved in the header for the wrapped data key
+//the slot has a fixed size, so that a rewrapped key leaves the shards where they are
+const EnvelopeKeySlot = 512
+
+//EnvelopeHeaderSize byte size of the header of a file with envelope encryption:
+//magic string, length of the wrapped key as big-endian uint16, key slot
+const EnvelopeHeaderSize = 8 + 2 + EnvelopeKeySlot
+
+//EnvelopeDataKeySize byte size of the random data key of each file, used for AES-256-GCM
+const EnvelopeDataKeySize = 32
+
+//envelopeMagic first bytes of a file with envelope encryption
+var envelopeMagic = [8]byte{'P', 'L', 'E', 'N', 'V', 'L', 'P', '1'}
+
+//aesGCMKeyWrapper KeyWrapper with a local AES key
+type aesGCMKeyWrapper struct {
+	kek []byte
+}
+
+//NewAESGCMKeyWrapper build a KeyWrapper that wraps data keys with AES-GCM
+//kek key encryption key, AES key of 16, 24 or 32 bytes
+//each wrapped key is nonce || encrypted key || tag
+//return the KeyWrapper, or an error if the key is invalid
+func NewAESGCMKeyWrapper(kek []byte) (KeyWrapper, error) {
+	if _, err := newAESGCM(kek); err != nil {
+		return nil, err
+	}
+	return aesGCMKeyWrapper{append([]byte(nil), kek...)}, nil
+}
+
+//WrapKey encrypt a data key with a fresh random nonce
+func (w aesGCMKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	aead, err := newAESGCM(w.kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, AESGCMNonceSize, AESGCMShardSize(len(dataKey)))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, dataKey, envelopeMagic[:]), nil
+}
+
+//UnwrapKey decrypt a data key, verifying its tag
+func (w aesGCMKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	aead, err := newAESGCM(w.kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < AESGCMOverhead {
+		return nil, errors.New("wrapped key too short")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:AESGCMNonceSize], wrapped[AESGCMNonceSize:], envelopeMagic[:])
+	if err != nil {
+		return nil, fmt.Errorf("wrapped key not authentic: %w", err)
+	}
+	return dataKey, nil
+}
+
+//encodeEnvelopeHeader build the header holding a wrapped key
+//wrapped wrapped data key
+//return the header, or an error if the key does not fit the slot
+func encodeEnvelopeHeader(wrapped []byte) ([]byte, error) {
+	if len(wrapped) > EnvelopeKeySlot {
+		return nil, fmt.Errorf("wrapped key of %d bytes does not fit in the %d bytes slot", len(wrapped), EnvelopeKeySlot)
+	}
+	header := make([]byte, EnvelopeHeaderSize)
+	copy(header, envelopeMagic[:])
+	binary.BigEndian.PutUint16(header[8:], uint16(len(wrapped)))
+	copy(header[10:], wrapped)
+	return header, nil
+}
+
+//readEnvelopeHeader read the header of a file with envelope encryption
+//r reader positioned at the start of the file
+//return the wrapped data key
+func readEnvelopeHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, EnvelopeHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fileError(ErrReadInput, "error reading envelope header", err)
+	}
+	if string(header[:8]) != string(envelopeMagic[:]) {
+		return nil, errors.New("not a file with envelope encryption")
+	}
+	length := int(binary.BigEndian.Uint16(header[8:]))
+	if length > EnvelopeKeySlot {
+		return nil, errors.New("malformed envelope header")
+	}
+	return header[10 : 10+length], nil
+}
+
+//checkDistinct check that input and output are not the same file
+func checkDistinct(input *os.File, outputFile string) error {
+	if ofi, err := os.Stat(outputFile); err == nil {
+		if ifi, err := input.Stat(); err == nil && os.SameFile(ifi, ofi) {
+			return errors.New("input and output are the same file")
+		}
+	}
+	return nil
+}
+
+//EncryptFileEnvelope encrypt a file with a random data key wrapped in its header
+//ctx context to cancel the processing
+//inputFile path to the plaintext file
+//outputFile path to the encrypted file, it must be different from inputFile
+//wrapper KeyWrapper protecting the data key
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size plaintext chunk size, the same must be used to decrypt
+//the output is the header (see EnvelopeHeaderSize) followed by the shards
+//encrypted with AES-256-GCM under the data key (see NewAESGCMEncryptor),
+//so that the key encryption key can be rotated with RewrapKey; it is
+//written on outputFile+TempSuffix, synced and renamed over outputFile once
+//complete, as ProcessFile does, so a failed run keeps an existing output
+//return the first error encountered
+func EncryptFileEnvelope(ctx context.Context, inputFile, outputFile string, wrapper KeyWrapper, num, size int) error {
+	//generate and wrap the data key
+	dataKey := make([]byte, EnvelopeDataKeySize)
+	//wipe the data key once the file is encrypted
+	defer Zeroize(dataKey)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("error generating data key: %w", err)
+	}
+	wrapped, err := wrapper.WrapKey(dataKey)
+	if err != nil {
+		return fmt.Errorf("error wrapping data key: %w", err)
+	}
+	header, err := encodeEnvelopeHeader(wrapped)
+	if err != nil {
+		return err
+	}
+	enc, err := NewAESGCMEncryptor(dataKey)
+	if err != nil {
+		return err
+	}
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	if err := checkDistinct(file, outputFile); err != nil {
+		return err
+	}
+	//write the header and the shards on the temporary output
+	return writeOutput(outputFile, func(out *os.File) error {
+		if _, err := out.Write(header); err != nil {
+			return fileError(ErrWriteOutput, "error writing file", err)
+		}
+		return ProcessReader(ctx, file, out, enc, num, size, false, nil)
+	})
+}
+
+//DecryptFileEnvelope decrypt a file written by EncryptFileEnvelope
+//ctx context to cancel the processing
+//inputFile path to the encrypted file
+//outputFile path to the plaintext file, it must be different from inputFile
+//wrapper KeyWrapper protecting the data key of the file
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size plaintext chunk size used to encrypt
+//the data key is unwrapped, and so authenticated, before any shard is decrypted
+//the plaintext is written on outputFile+TempSuffix and renamed over
+//outputFile once complete, so a shard failing to decrypt leaves no output
+//return the first error encountered, for example if the wrapped key or
+//a shard is not authentic
+func DecryptFileEnvelope(ctx context.Context, inputFile, outputFile string, wrapper KeyWrapper, num, size int) error {
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	if err := checkDistinct(file, outputFile); err != nil {
+		return err
+	}
+	//recover the data key, the reading continues after the header
+	wrapped, err := readEnvelopeHeader(file)
+	if err != nil {
+		return err
+	}
+	dataKey, err := wrapper.UnwrapKey(wrapped)
+	if err != nil {
+		return fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	defer Zeroize(dataKey)
+	dec, err := NewAESGCMDecryptor(dataKey)
+	if err != nil {
+		return err
+	}
+	return writeOutput(outputFile, func(out *os.File) error {
+		return ProcessReader(ctx, file, out, dec, num, AESGCMShardSize(size), false, nil)
+	})
+}
+
+//RewrapKey rotate the key encryption key of a file written by EncryptFileEnvelope
+//filePath path to the encrypted file
+//oldWrapper KeyWrapper that wrapped the data key of the file
+//newWrapper KeyWrapper that wraps it from now on
+//the encrypted shards are unchanged, but the file is copied with the new
+//header on filePath+TempSuffix, synced and renamed over filePath (see
+//commitTemp): the header holds the only copy of the wrapped data key, so it
+//is never overwritten in place, where a crash or a full disk partway would
+//leave the whole file unrecoverable
+//return an error if the wrapped key is not authentic under oldWrapper,
+//if the key wrapped by newWrapper does not fit in EnvelopeKeySlot, or
+//the error encountered copying the file, in which case it is left as it was
+func RewrapKey(filePath string, oldWrapper, newWrapper KeyWrapper) error {
+	return rewrapKey(filePath, oldWrapper, newWrapper, nil)
+}
+
+//rewrapKey rotate the key encryption key of a file, as RewrapKey
+//wrap function wrapping the writer of the copy, nil for none, to inject
+//failures in the tests
+func rewrapKey(filePath string, oldWrapper, newWrapper KeyWrapper, wrap func(io.Writer) io.Writer) (err error) {
+	file, err := openRegular(filePath)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	wrapped, err := readEnvelopeHeader(file)
+	if err != nil {
+		return err
+	}
+	dataKey, err := oldWrapper.UnwrapKey(wrapped)
+	if err != nil {
+		return fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	defer Zeroize(dataKey)
+	rewrapped, err := newWrapper.WrapKey(dataKey)
+	if err != nil {
+		return fmt.Errorf("error wrapping data key: %w", err)
+	}
+	header, err := encodeEnvelopeHeader(rewrapped)
+	if err != nil {
+		return err
+	}
+	//copy the file with the new header, the reading continues after the old one
+	out, err := createTemp(filePath, WriteTruncate, OutputPerm)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = out
+	if wrap != nil {
+		w = wrap(w)
+	}
+	if _, err = w.Write(header); err == nil {
+		_, err = io.Copy(w, file)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return fileError(ErrWriteOutput, "error writing file", err)
+	}
+	if err := commitTemp(out, filePath, WriteTruncate, true); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return nil
+}
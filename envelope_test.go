@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//failingWriter writer failing with err once after bytes have been written
+type failingWriter struct {
+	w     io.Writer
+	after int
+	err   error
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.after {
+		n, _ := f.w.Write(p[:f.after])
+		f.after = 0
+		return n, f.err
+	}
+	n, err := f.w.Write(p)
+	f.after -= n
+	return n, err
+}
+
+func TestRewrapKey(t *testing.T) {
+	injected := errors.New("injected write error")
+	tests := []struct {
+		name string
+		//failAfter bytes of the copy written before it fails, -1 for no failure
+		failAfter int
+	}{
+		{"rewrapped", -1},
+		{"failing before the header", 0},
+		{"failing within the header", 10},
+		{"failing within the shards", EnvelopeHeaderSize + 500},
+	}
+	oldWrapper, err := NewAESGCMKeyWrapper(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWrapper, err := NewAESGCMKeyWrapper(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 5000)
+			dir := filepath.Dir(in)
+			enc := filepath.Join(dir, "enc")
+			if err := EncryptFileEnvelope(context.Background(), in, enc, oldWrapper, 4, 100); err != nil {
+				t.Fatal(err)
+			}
+			before, err := ioutil.ReadFile(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wrap func(io.Writer) io.Writer
+			if tt.failAfter >= 0 {
+				wrap = func(w io.Writer) io.Writer {
+					return &failingWriter{w, tt.failAfter, injected}
+				}
+			}
+			err = rewrapKey(enc, oldWrapper, newWrapper, wrap)
+			if _, serr := os.Stat(enc + TempSuffix); !os.IsNotExist(serr) {
+				t.Errorf("temporary file left: %v", serr)
+			}
+			after, rerr := ioutil.ReadFile(enc)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			//the file is still readable with the wrapper of its header
+			wrapper := newWrapper
+			if tt.failAfter >= 0 {
+				if !errors.Is(err, injected) {
+					t.Fatalf("err = %v, want %v", err, injected)
+				}
+				if !bytes.Equal(after, before) {
+					t.Fatal("file changed by a failed rewrap")
+				}
+				wrapper = oldWrapper
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(after[EnvelopeHeaderSize:], before[EnvelopeHeaderSize:]) {
+					t.Error("shards changed by the rewrap")
+				}
+				if err := DecryptFileEnvelope(context.Background(), enc, filepath.Join(dir, "old"), oldWrapper, 4, 100); err == nil {
+					t.Error("rewrapped file decrypted with the old wrapper")
+				}
+			}
+			dec := filepath.Join(dir, "dec")
+			if err := DecryptFileEnvelope(context.Background(), enc, dec, wrapper, 4, 100); err != nil {
+				t.Fatal(err)
+			}
+			assertSameFile(t, dec, in)
+		})
+	}
+}
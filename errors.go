@@ -0,0 +1,87 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+)
+
+//ErrOpenInput a file to read cannot be opened
+var ErrOpenInput = errors.New("cannot open input")
+
+//ErrReadInput reading a file failed after it was opened
+var ErrReadInput = errors.New("cannot read input")
+
+//ErrOpenOutput a file to write cannot be created or opened
+var ErrOpenOutput = errors.New("cannot open output")
+
+//ErrWriteOutput writing a file failed, after the retries of WriteRetry for
+//the transient failures
+var ErrWriteOutput = errors.New("cannot write output")
+
+//ErrCloseOutput closing a written file failed, so its last writes may be lost
+var ErrCloseOutput = errors.New("cannot close output")
+
+//ioError failure of a file operation, matching with errors.Is both the
+//category of the failure and the error of the operation, for example
+//ErrOpenInput and os.ErrNotExist for an input file that does not exist
+type ioError struct {
+	//kind category of the failure, one of the Err*put sentinels
+	kind error
+	//msg description of the operation that failed
+	msg string
+	//err error of the operation
+	err error
+}
+
+//fileError categorize the failure of a file operation
+//kind category of the failure, for example ErrReadInput
+//msg description of the operation that failed, for example "error reading file"
+//err error of the operation
+//return the error, printed as msg: err
+func fileError(kind error, msg string, err error) error {
+	return &ioError{kind, msg, err}
+}
+
+func (e *ioError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+//Is report whether target is the category of the failure
+func (e *ioError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *ioError) Unwrap() error {
+	return e.err
+}
+
+//ErrMissingShard a shard expected, for example listed in a manifest, is not
+//present in the data; a shard that is present but damaged is reported as
+//ErrShardCorrupt instead
+type ErrMissingShard struct {
+	//Index index of the missing shard
+	Index int
+}
+
+//Error describe the missing shard
+func (e ErrMissingShard) Error() string {
+	return fmt.Sprintf("shard %d missing", e.Index)
+}
+
+//ErrAuthFailure a shard fails the authentication of its AEAD: it was
+//tampered with, moved, or encrypted with another key or additional data
+type ErrAuthFailure struct {
+	//Index index of the shard
+	Index int
+	//Err error of the AEAD
+	Err error
+}
+
+//Error describe the shard that failed authentication
+func (e ErrAuthFailure) Error() string {
+	return fmt.Sprintf("shard %d failed authentication: %v", e.Index, e.Err)
+}
+
+func (e ErrAuthFailure) Unwrap() error {
+	return e.Err
+}
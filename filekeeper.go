@@ -1,9 +1,9 @@
-package main
+package ledger
 
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -37,7 +37,7 @@ func (ledger Ledger) CheckConsistency(target int64, ptDigest []byte) bool {
 		//compute number of keys (and therefore blocks) present
 		fi, err := os.Stat(ledger.KeysFile)
 		if err != nil {
-			fmt.Println(err)
+			logln(err)
 			return false
 		}
 		tot = fi.Size() / int64(curve.MODBYTES+1)
@@ -49,7 +49,7 @@ func (ledger Ledger) CheckConsistency(target int64, ptDigest []byte) bool {
 		filename := ledger.RootPath + strconv.FormatInt(i+1, 16)
 		content, err := ioutil.ReadFile(filename)
 		if err != nil {
-			fmt.Println("File reading error", err)
+			logln("File reading error", err)
 			return false
 		}
 		//check link with previous block
@@ -89,7 +89,10 @@ func (ledger Ledger) DecryptBlock(index int64, unlocked *curve.ECP, out string)
 	eps := ledger.GetShards(MaxShards)
 	//decrypt file
 	ctName := ledger.EncryptPath + strconv.FormatInt(index, 16) + ".enc"
-	EncryptFile(ctName, out, eps[:], unlocked)
+	err := EncryptFile(ctName, out, eps[:], unlocked)
+	if err != nil {
+		panic(err)
+	}
 	//check integrity
 	ptDigest := FileDigest(out)
 	if !ledger.CheckConsistency(index, ptDigest) {
@@ -112,8 +115,8 @@ func (ledger Ledger) Init() *curve.BIG {
 	//generate time-key
 	s := GenExp()
 	//channels for concurrent generation
-	shardChannel := make(chan shard, MaxShards)
-	done := make(chan bool)
+	shardChannel := make(chan Shard, MaxShards)
+	done := make(chan error, 1)
 	//concurrently generate each shard
 	var wg sync.WaitGroup
 	for i := 0; i < MaxShards; i++ {
@@ -123,19 +126,20 @@ func (ledger Ledger) Init() *curve.BIG {
 			temp = curve.G2mul(temp, s)
 			encoded := make([]byte, 2*curve.MODBYTES+1)
 			temp.ToBytes(encoded, true)
-			shardChannel <- shard{i, string(encoded)}
+			shardChannel <- Shard{i, encoded}
 			wg.Done()
 		}(i)
 	}
 	//collect and write results
-	go writeResults(shardChannel, ledger.ShardsFile, done)
+	go writeResults(shardChannel, ledger.ShardsFile, WriteTruncate, false, MaxShards, nil, done)
 	wg.Wait()
 	close(shardChannel)
-	if <-done {
-		fmt.Println("Shards correctly written on file!")
-		return s
+	if err := <-done; err != nil {
+		logln(err)
+		return nil
 	}
-	return nil
+	logln("Shards correctly written on file!")
+	return s
 }
 
 //GetShards read masking shards from the ledger
@@ -146,13 +150,13 @@ func (ledger Ledger) GetShards(numShards int) []curve.ECP2 {
 	//open shardsFile
 	file, err := os.Open(ledger.ShardsFile)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
+		logln("Error opening file:", err)
 		return nil
 	}
 	//close file on exit
 	defer func() {
 		if err = file.Close(); err != nil {
-			fmt.Println("Error closing file:", err)
+			logln("Error closing file:", err)
 		}
 	}()
 	//buffered reading
@@ -163,7 +167,7 @@ func (ledger Ledger) GetShards(numShards int) []curve.ECP2 {
 	for i := 0; i < numShards; i++ {
 		_, err := io.ReadFull(reader, buffer)
 		if err != nil {
-			fmt.Println("Error reading file:", err)
+			logln("Error reading file:", err)
 			return nil
 		}
 		//decode shard
@@ -178,7 +182,11 @@ func (ledger Ledger) GetShards(numShards int) []curve.ECP2 {
 //return the masking shard
 func (ledger Ledger) GetSingleShard(index int64) *curve.ECP2 {
 	//read from file
-	encoded := ReadValue(ledger.ShardsFile, index, int64(2*curve.MODBYTES+1))
+	encoded, err := ReadValue(ledger.ShardsFile, index, int64(2*curve.MODBYTES+1))
+	if err != nil {
+		logln(err)
+		return nil
+	}
 	//decode key
 	return curve.ECP2_fromBytes(encoded)
 }
@@ -191,18 +199,18 @@ func (ledger Ledger) AppendEncapsulatedKey(encKey *curve.ECP) int64 {
 	//open output file
 	file, err := os.OpenFile(ledger.KeysFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		fmt.Println(err)
+		logln(err)
 		return -1
 	}
 	//close file on exit
 	defer func() {
 		if err = file.Close(); err != nil {
-			fmt.Println("Error closing file:", err)
+			logln("Error closing file:", err)
 		}
 	}()
 	fileinfo, err := file.Stat()
 	if err != nil {
-		fmt.Println(err)
+		logln(err)
 		return -1
 	}
 	//write encapsulated key on file
@@ -212,7 +220,7 @@ func (ledger Ledger) AppendEncapsulatedKey(encKey *curve.ECP) int64 {
 	encKey.ToBytes(encoded, true)
 	_, err = file.Write(encoded)
 	if err != nil {
-		fmt.Println(err)
+		logln(err)
 		return -1
 
 	}
@@ -225,7 +233,11 @@ func (ledger Ledger) AppendEncapsulatedKey(encKey *curve.ECP) int64 {
 //return the encapsulated key
 func (ledger Ledger) GetEncKey(index int64) *curve.ECP {
 	//read from file
-	encoded := ReadValue(ledger.KeysFile, index, int64(curve.MODBYTES+1))
+	encoded, err := ReadValue(ledger.KeysFile, index, int64(curve.MODBYTES+1))
+	if err != nil {
+		logln(err)
+		return nil
+	}
 	//decode key
 	return curve.ECP_fromBytes(encoded)
 }
@@ -239,31 +251,56 @@ func (ledger Ledger) Update(s *curve.BIG) *curve.BIG {
 	//generate time-key
 	sNew := GenExp()
 	//process shard file concurrently
-	shardUpd := func(inp shard) shard {
-		old := curve.ECP2_fromBytes([]byte(inp.value))
-		return shardUpdate(inp.index, old, s, sNew)
+	shardUpd := func(inp Shard) Shard {
+		old := curve.ECP2_fromBytes(inp.Value)
+		return shardUpdate(inp.Index, old, s, sNew)
+	}
+	err := updateFile(ledger.ShardsFile, Infallible(shardUpd), MaxShards, int(2*curve.MODBYTES+1))
+	if err != nil {
+		logln(err)
+		return nil
 	}
-	ProcessFile(ledger.ShardsFile, ledger.ShardsFile, shardUpd, MaxShards, int(2*curve.MODBYTES+1))
 	//process encapsulated key file cuncurrently
 	//compute file size to determine concurrency
 	fi, err := os.Stat(ledger.KeysFile)
 	if err != nil {
-		fmt.Println(err)
+		logln(err)
 		return nil
 	}
 	//compute number of keys
 	sizeKey := int(curve.MODBYTES + 1)
 	numKey := int(fi.Size()) / sizeKey
-	updKey := func(inp shard) shard {
+	updKey := func(inp Shard) Shard {
 		//import old key
-		old := curve.ECP_fromBytes([]byte(inp.value))
+		old := curve.ECP_fromBytes(inp.Value)
 		//update key
 		new := FracMult(old, sNew, s)
 		//encode key
 		encoded := make([]byte, sizeKey)
 		new.ToBytes(encoded, true)
-		return shard{inp.index, string(encoded)}
+		return Shard{inp.Index, encoded}
+	}
+	err = updateFile(ledger.KeysFile, Infallible(updKey), numKey, sizeKey)
+	if err != nil {
+		logln(err)
+		return nil
 	}
-	ProcessFile(ledger.KeysFile, ledger.KeysFile, updKey, numKey, sizeKey)
 	return sNew
 }
+
+//updateFile process a file of the ledger replacing its content
+//filename path to the file to update
+//process function that updates each value
+//num number of values to update concurrently
+//size size of the values
+//the result is written on a temporary file that replaces the original one
+//only if the processing succeeds
+func updateFile(filename string, process ProcessFunc, num, size int) error {
+	tmp := filename + ".tmp"
+	_, err := ProcessFile(context.Background(), filename, tmp, process, num, size, false, false, false, WriteTruncate, nil)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
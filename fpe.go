@@ -0,0 +1,241 @@
+package ledger
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+//fpeAlphabet symbols of the FPE shards, the first radix are used
+const fpeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+//fpeMinDomain minimum number of values a shard must be able to take, as
+//required by NIST SP 800-38G Rev. 1
+const fpeMinDomain = 1000000
+
+//fpeRounds number of Feistel rounds of FF1
+const fpeRounds = 10
+
+//ErrFPEDomain a shard cannot be encrypted by NewFPEEncryptor: it is too
+//short for its values to be kept secret, or it has symbols outside the radix
+var ErrFPEDomain = errors.New("shard outside the FPE domain")
+
+//ff1 format-preserving cipher FF1 of NIST SP 800-38G
+type ff1 struct {
+	//block AES, the only block cipher FF1 is defined for
+	block cipher.Block
+	//radix number of symbols of the alphabet
+	radix int
+	//minLen minimum length of the numeral strings
+	minLen int
+}
+
+//newFF1 build the FF1 cipher
+//key AES key of 16, 24 or 32 bytes
+//radix number of symbols, from 2 to len(fpeAlphabet)
+//return the cipher, or the error for an invalid key or radix
+func newFF1(key []byte, radix int) (*ff1, error) {
+	if radix < 2 || radix > len(fpeAlphabet) {
+		return nil, fmt.Errorf("invalid FPE radix %d, it must be between 2 and %d", radix, len(fpeAlphabet))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES key: %w", err)
+	}
+	//smallest length with radix^minLen >= fpeMinDomain, at least 2
+	minLen := 2
+	for domain := radix * radix; domain < fpeMinDomain; domain *= radix {
+		minLen++
+	}
+	return &ff1{block, radix, minLen}, nil
+}
+
+//NewFPEEncryptor build a process function that encrypts each shard with the
+//format-preserving cipher FF1 (NIST SP 800-38G), so that a fixed-width
+//identifier is encrypted into another identifier of the same width and
+//alphabet, which downstream systems accept in place of the original
+//key AES key of 16, 24 or 32 bytes
+//radix number of symbols of the shards, from 2 to 36: the symbols are the
+//ASCII digits followed by the lowercase letters, so radix 10 encrypts
+//decimal numbers into decimal numbers of the same length
+//the index of the shard is the tweak of FF1, so equal values at different
+//indices are encrypted differently and a shard cannot be moved unnoticed
+//by the decryptor; the shards are not authenticated, and their length is
+//preserved, so the output can be written without framing
+//the process function fails with an error wrapping ErrFPEDomain on a shard
+//with a symbol outside the radix, or too short to be securely encrypted:
+//radix^len must be at least 1000000, so 6 digits for radix 10
+//return the process function, or an error if the key or the radix is invalid
+func NewFPEEncryptor(key []byte, radix int) (ProcessFunc, error) {
+	f, err := newFF1(key, radix)
+	if err != nil {
+		return nil, err
+	}
+	return func(inp Shard) (Shard, error) {
+		return f.process(inp, false)
+	}, nil
+}
+
+//NewFPEDecryptor build a process function that decrypts shards encrypted
+//by NewFPEEncryptor
+//key AES key used for encryption
+//radix radix used for encryption
+//return the process function, or an error if the key or the radix is invalid
+func NewFPEDecryptor(key []byte, radix int) (ProcessFunc, error) {
+	f, err := newFF1(key, radix)
+	if err != nil {
+		return nil, err
+	}
+	return func(inp Shard) (Shard, error) {
+		return f.process(inp, true)
+	}, nil
+}
+
+//process encrypt or decrypt a shard, with its index as tweak
+//inp shard of symbols of fpeAlphabet
+//decrypt true to decrypt, false to encrypt
+//return the shard of the same length, or an error wrapping ErrFPEDomain
+func (f *ff1) process(inp Shard, decrypt bool) (Shard, error) {
+	if len(inp.Value) < f.minLen {
+		return Shard{}, fmt.Errorf("%w: shard %d has %d symbols, at least %d are needed for radix %d", ErrFPEDomain, inp.Index, len(inp.Value), f.minLen, f.radix)
+	}
+	if len(inp.Value) > 1<<31 {
+		return Shard{}, fmt.Errorf("%w: shard %d has %d symbols", ErrFPEDomain, inp.Index, len(inp.Value))
+	}
+	digits := make([]int, len(inp.Value))
+	for i, c := range inp.Value {
+		digits[i] = strings.IndexByte(fpeAlphabet[:f.radix], c)
+		if digits[i] < 0 {
+			return Shard{}, fmt.Errorf("%w: shard %d has symbol %q outside radix %d", ErrFPEDomain, inp.Index, c, f.radix)
+		}
+	}
+	tweak := make([]byte, 8)
+	binary.BigEndian.PutUint64(tweak, uint64(inp.Index))
+	digits = f.crypt(digits, tweak, decrypt)
+	//the input is not used afterwards, so it is overwritten
+	for i, d := range digits {
+		inp.Value[i] = fpeAlphabet[d]
+	}
+	return inp, nil
+}
+
+//crypt run the FF1 Feistel network, algorithms 7 and 8 of NIST SP 800-38G
+//x numeral string, of a length valid for the radix
+//tweak tweak of the encryption
+//decrypt true to run the rounds backwards
+//return the encrypted or decrypted numeral string
+func (f *ff1) crypt(x []int, tweak []byte, decrypt bool) []int {
+	n := len(x)
+	u := n / 2
+	v := n - u
+	a, b := x[:u], x[u:]
+	radix := big.NewInt(int64(f.radix))
+	//byte length of the numbers of v symbols, and of the round values
+	bound := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	byteLen := (bound.Sub(bound, big.NewInt(1)).BitLen() + 7) / 8
+	d := 4*((byteLen+3)/4) + 4
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	//P = [1]^1 || [2]^1 || [1]^1 || [radix]^3 || [10]^1 || [u mod 256]^1 || [n]^4 || [t]^4
+	p := make([]byte, aes.BlockSize)
+	p[0], p[1], p[2] = 1, 2, 1
+	p[3], p[4], p[5] = byte(f.radix>>16), byte(f.radix>>8), byte(f.radix)
+	p[6], p[7] = fpeRounds, byte(u)
+	binary.BigEndian.PutUint32(p[8:], uint32(n))
+	binary.BigEndian.PutUint32(p[12:], uint32(len(tweak)))
+	//Q = T || [0]^((-t-b-1) mod 16) || [i]^1 || [NUM(B)]^b
+	q := make([]byte, len(tweak)+(16-(len(tweak)+byteLen+1)%16)%16+1+byteLen)
+	copy(q, tweak)
+	c := new(big.Int)
+	for round := 0; round < fpeRounds; round++ {
+		i := round
+		if decrypt {
+			i = fpeRounds - 1 - round
+		}
+		//the half fed to the round function, B when encrypting and A when decrypting
+		in, out := b, a
+		if decrypt {
+			in, out = a, b
+		}
+		q[len(q)-byteLen-1] = byte(i)
+		numIn := f.num(in)
+		numBytes := numIn.Bytes()
+		for j := len(q) - byteLen; j < len(q); j++ {
+			q[j] = 0
+		}
+		copy(q[len(q)-len(numBytes):], numBytes)
+		y := new(big.Int).SetBytes(f.roundValue(p, q, d))
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+		if decrypt {
+			c.Sub(f.num(out), y)
+		} else {
+			c.Add(f.num(out), y)
+		}
+		c.Mod(c, mod)
+		next := f.str(c, m)
+		if decrypt {
+			a, b = next, a
+		} else {
+			a, b = b, next
+		}
+	}
+	return append(append([]int(nil), a...), b...)
+}
+
+//roundValue compute the round function S of FF1
+//p fixed block P
+//q block Q of the round
+//d byte length of the output
+//return the first d bytes of R || CIPH(R xor [1]^16) || CIPH(R xor [2]^16) ...
+//where R is the CBC-MAC of P || Q
+func (f *ff1) roundValue(p, q []byte, d int) []byte {
+	r := make([]byte, aes.BlockSize)
+	f.block.Encrypt(r, p)
+	for j := 0; j < len(q); j += aes.BlockSize {
+		for k := range r {
+			r[k] ^= q[j+k]
+		}
+		f.block.Encrypt(r, r)
+	}
+	s := append([]byte(nil), r...)
+	block := make([]byte, aes.BlockSize)
+	for j := 1; len(s) < d; j++ {
+		copy(block, r)
+		counter := binary.BigEndian.Uint64(block[8:]) ^ uint64(j)
+		binary.BigEndian.PutUint64(block[8:], counter)
+		f.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+	return s[:d]
+}
+
+//num value of a numeral string, most significant symbol first
+func (f *ff1) num(x []int) *big.Int {
+	radix := big.NewInt(int64(f.radix))
+	value := new(big.Int)
+	for _, d := range x {
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(d)))
+	}
+	return value
+}
+
+//str numeral string of m symbols of a value lower than radix^m
+func (f *ff1) str(value *big.Int, m int) []int {
+	radix := big.NewInt(int64(f.radix))
+	value = new(big.Int).Set(value)
+	digit := new(big.Int)
+	x := make([]int, m)
+	for i := m - 1; i >= 0; i-- {
+		value.DivMod(value, radix, digit)
+		x[i] = int(digit.Int64())
+	}
+	return x
+}
@@ -0,0 +1,173 @@
+package ledger
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+//FrameHeaderSize byte size of the length prefix of each framed shard
+const FrameHeaderSize = 4
+
+//writeFrame write a shard prefixed by its length
+//w where to write the frame
+//value content of the shard
+//the length is encoded as a FrameHeaderSize bytes big-endian unsigned integer
+//return the error encountered while writing
+func writeFrame(w io.Writer, value []byte) error {
+	if uint64(len(value)) > math.MaxUint32 {
+		return fmt.Errorf("shard of %d bytes too big to be framed", len(value))
+	}
+	var header [FrameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(value)))
+	_, err := w.Write(header[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(value)
+	return err
+}
+
+//readFrameHeader read the length prefix of the next framed shard
+//r where to read the header from
+//index index of the shard, used in errors
+//return the length of the shard, io.EOF if there are no more shards,
+//or an error wrapping ErrShortValue if the header is truncated
+func readFrameHeader(r io.Reader, index int64) (int64, error) {
+	var header [FrameHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return 0, err
+	}
+	if err == io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("%w: truncated header of value %d", ErrShortValue, index)
+	}
+	if err != nil {
+		return 0, fileError(ErrReadInput, "error reading file", err)
+	}
+	return int64(binary.BigEndian.Uint32(header[:])), nil
+}
+
+//ReadFramesFrom read framed shards to process them concurrently
+//ctx context that stops the reading when cancelled
+//r reader of data written with framed shards
+//output channel where the shards are fed, with their values stripped of the
+//length prefix
+//return the first error encountered while reading, an error wrapping
+//ErrShortValue if the data ends in the middle of a frame,
+//or ctx.Err() if the context is cancelled before the end of the data
+func ReadFramesFrom(ctx context.Context, r io.Reader, output chan Shard) error {
+	return readFramesFrom(ctx, r, output, 0, nil)
+}
+
+//readFramesFrom read framed shards to process them concurrently
+//parameters as in ReadFramesFrom, plus:
+//first index of the first shard read
+//window semaphore acquired before feeding each shard, in index order,
+//nil not to limit the shards fed
+//return the first error encountered while reading,
+//or ctx.Err() if the context is cancelled before the end of the data
+func readFramesFrom(ctx context.Context, r io.Reader, output chan Shard, first int, window chan struct{}) error {
+	//close channel on exit to signal end of input operations
+	defer close(output)
+	//buffered reading
+	reader := bufio.NewReader(r)
+	for i := first; ; i++ {
+		//stop reading as soon as the context is cancelled
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		length, err := readFrameHeader(reader, int64(i))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		buffer := make([]byte, length)
+		n, err := io.ReadFull(reader, buffer)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: value %d has %d of %d bytes", ErrShortValue, i, n, length)
+		}
+		if err != nil {
+			return fileError(ErrReadInput, "error reading file", err)
+		}
+		//wait for room in the window
+		if window != nil {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		//feed shard to channel
+		select {
+		case output <- Shard{i, buffer}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//ReadFramedValue read a single value from a file written with framed shards
+//filePath path to the file containing a series of framed values
+//index index of the desired value
+//the offset of the value is found by skipping the previous frames,
+//following their length prefixes
+//return the value read, or an error that wraps:
+//	ErrInvalidIndex if index is negative
+//	io.EOF if the value is past the end of the file
+//	ErrShortValue if the file ends in the middle of a frame
+//	the os.Open or read error otherwise
+func ReadFramedValue(filePath string, index int64) ([]byte, error) {
+	if index < 0 {
+		return nil, fmt.Errorf("%w: index %d", ErrInvalidIndex, index)
+	}
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	//skip the frames before index
+	for i, offset := int64(0), int64(0); ; i++ {
+		length, err := readFrameHeader(file, i)
+		if err == io.EOF {
+			return nil, fmt.Errorf("value %d not present: %w", index, io.EOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i < index {
+			offset, err = file.Seek(length, io.SeekCurrent)
+			if err != nil {
+				return nil, fileError(ErrReadInput, "error seeking file", err)
+			}
+			//a frame that goes past the end of the file is truncated
+			if offset > fi.Size() {
+				return nil, fmt.Errorf("%w: value %d is truncated", ErrShortValue, i)
+			}
+			continue
+		}
+		//read the desired value
+		buffer := make([]byte, length)
+		n, err := io.ReadFull(file, buffer)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: value %d has %d of %d bytes", ErrShortValue, index, n, length)
+		}
+		if err != nil {
+			return nil, fileError(ErrReadInput, "error reading file", err)
+		}
+		return buffer, nil
+	}
+}
@@ -4,6 +4,8 @@ go 1.14
 
 require (
   github.com/miracl/core v0.0.0-20200621154713-0c423b062913
+  github.com/prometheus/client_golang v1.7.1
   golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
-  golang.org/x/sys v0.0.0-20200124204421-9fbb57f87de9 // indirect
+  golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1 // indirect
+  golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
 )
\ No newline at end of file
@@ -0,0 +1,104 @@
+package ledger
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+//HashFunc hash algorithm of the commitments to the shards, in the manifests,
+//the Merkle trees and the ledger commitments
+//different ledgers expect different algorithms, so the name is recorded
+//along with the digests and verifiers look the algorithm up by it
+//(see LookupHash); the zero value selects HashSHA256
+type HashFunc struct {
+	//Name identifier of the algorithm recorded in the manifests, it must
+	//not contain ':' or newlines
+	Name string
+	//New factory of the hash
+	New func() hash.Hash
+}
+
+//HashSHA256 SHA-256, the default algorithm
+var HashSHA256 = HashFunc{"sha256", sha256.New}
+
+//HashSHA3_256 SHA3-256 as standardised in FIPS 202
+var HashSHA3_256 = HashFunc{"sha3-256", sha3.New256}
+
+//HashKeccak256 the original Keccak-256 used by Ethereum, which differs from
+//SHA3-256 in the padding
+var HashKeccak256 = HashFunc{"keccak-256", sha3.NewLegacyKeccak256}
+
+//HashBLAKE2b256 unkeyed BLAKE2b with 256 bit digests
+var HashBLAKE2b256 = HashFunc{"blake2b-256", func() hash.Hash {
+	//only keys longer than 64 bytes are rejected
+	h, _ := blake2b.New256(nil)
+	return h
+}}
+
+//hashRegistry algorithms known by name, guarded by hashMutex
+var hashRegistry = map[string]HashFunc{}
+
+//hashMutex mutex guarding hashRegistry
+var hashMutex sync.RWMutex
+
+func init() {
+	for _, hf := range []HashFunc{HashSHA256, HashSHA3_256, HashKeccak256, HashBLAKE2b256} {
+		hashRegistry[hf.Name] = hf
+	}
+}
+
+//RegisterHash make an algorithm known to LookupHash, so that the manifests
+//written with it can be verified
+//hf algorithm to register, replacing any with the same name
+func RegisterHash(hf HashFunc) {
+	hashMutex.Lock()
+	defer hashMutex.Unlock()
+	hashRegistry[hf.Name] = hf
+}
+
+//LookupHash find an algorithm by name
+//name name recorded in a manifest
+//return the algorithm, or an error if it is neither built in nor registered
+func LookupHash(name string) (HashFunc, error) {
+	hashMutex.RLock()
+	defer hashMutex.RUnlock()
+	hf, ok := hashRegistry[name]
+	if !ok {
+		return HashFunc{}, fmt.Errorf("unknown hash algorithm %q", name)
+	}
+	return hf, nil
+}
+
+//orDefault the algorithm to use
+//return hf, or HashSHA256 if hf is the zero value
+func (hf HashFunc) orDefault() HashFunc {
+	if hf.New == nil {
+		return HashSHA256
+	}
+	return hf
+}
+
+//Sum compute the digest of some data
+//data data to hash
+//return the digest, with HashSHA256 if hf is the zero value
+func (hf HashFunc) Sum(data []byte) []byte {
+	h := hf.orDefault().New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+//Size byte length of the digests
+func (hf HashFunc) Size() int {
+	return hf.orDefault().New().Size()
+}
+
+//isDefault report whether hf is HashSHA256, which is not recorded in the
+//manifests so that they stay readable by older verifiers
+func (hf HashFunc) isDefault() bool {
+	return hf.orDefault().Name == HashSHA256.Name
+}
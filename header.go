@@ -0,0 +1,308 @@
+package ledger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+//FileHeaderSize byte size of the header written by EncryptFileWithHeader
+const FileHeaderSize = 16
+
+//FileFormatVersion version of the format written by EncryptFileWithHeader
+const FileFormatVersion = 1
+
+//fileHeaderMagic first bytes of a file written by EncryptFileWithHeader
+var fileHeaderMagic = [4]byte{'P', 'L', 'S', 'D'}
+
+//ErrNoHeader the file does not start with a header written by EncryptFileWithHeader
+var ErrNoHeader = errors.New("missing file header")
+
+//ErrUnsupportedVersion the file header has a format version this code cannot read
+var ErrUnsupportedVersion = errors.New("unsupported format version")
+
+//ErrSizeMismatch the size of the values asked by the caller differs from the
+//one recorded in the file header, so the values would be read misaligned
+var ErrSizeMismatch = errors.New("value size does not match the file header")
+
+//HeaderFlags processing applied to the shards of a file, recorded in its header
+type HeaderFlags byte
+
+const (
+	//FlagFramed the shards are written prefixed by their length
+	FlagFramed HeaderFlags = 1 << iota
+	//FlagCompressed the chunks are compressed by NewGzipCompressor before encryption,
+	//it requires FlagFramed
+	FlagCompressed
+	//FlagCRC every shard is sealed by NewCRC32CSealer after encryption
+	FlagCRC
+)
+
+//knownFlags union of the flags defined by FileFormatVersion
+const knownFlags = FlagFramed | FlagCompressed | FlagCRC
+
+//FileHeader parameters needed to read a file, stored at its beginning
+type FileHeader struct {
+	//Version format version, set to FileFormatVersion when writing
+	Version byte
+	//ChunkSize size of the plaintext chunks
+	ChunkSize int
+	//AEAD cipher used to encrypt the chunks
+	AEAD AEADID
+	//Flags further processing of the shards
+	Flags HeaderFlags
+}
+
+//encode serialize the header
+//the header is the magic string, the version, the AEAD id, the flags, a
+//reserved byte and the chunk size as a big-endian 64 bit integer
+//return the FileHeaderSize bytes of the header
+func (h FileHeader) encode() []byte {
+	header := make([]byte, FileHeaderSize)
+	copy(header, fileHeaderMagic[:])
+	header[4] = h.Version
+	header[5] = byte(h.AEAD)
+	header[6] = byte(h.Flags)
+	binary.BigEndian.PutUint64(header[8:], uint64(h.ChunkSize))
+	return header
+}
+
+//validate check that the header describes a file this code can read
+//return an error wrapping ErrUnsupportedVersion for an unknown version,
+//or describing the first invalid parameter
+func (h FileHeader) validate() error {
+	if h.Version != FileFormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	if h.ChunkSize <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, h.ChunkSize)
+	}
+	if h.AEAD > AEADChaCha20Poly1305 {
+		return fmt.Errorf("unknown AEAD %d", h.AEAD)
+	}
+	if h.Flags&^knownFlags != 0 {
+		return fmt.Errorf("unknown header flags %#x", byte(h.Flags&^knownFlags))
+	}
+	if h.Flags&FlagCompressed != 0 && h.Flags&FlagFramed == 0 {
+		return fmt.Errorf("compressed %w", ErrVariableLength)
+	}
+	return nil
+}
+
+//readFileHeader read and validate the header of a file
+//r where to read the header from, the reading continues after it
+//return the header, or an error wrapping ErrNoHeader if r does not start with
+//a header, or the validation error
+func readFileHeader(r io.Reader) (FileHeader, error) {
+	var header [FileHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return FileHeader{}, fmt.Errorf("%w: file too short", ErrNoHeader)
+	}
+	if err != nil {
+		return FileHeader{}, fileError(ErrReadInput, "error reading file", err)
+	}
+	if [4]byte{header[0], header[1], header[2], header[3]} != fileHeaderMagic {
+		return FileHeader{}, ErrNoHeader
+	}
+	chunkSize := binary.BigEndian.Uint64(header[8:])
+	if chunkSize > math.MaxInt32 {
+		return FileHeader{}, fmt.Errorf("%w: %d", ErrInvalidSize, chunkSize)
+	}
+	h := FileHeader{
+		Version:   header[4],
+		ChunkSize: int(chunkSize),
+		AEAD:      AEADID(header[5]),
+		Flags:     HeaderFlags(header[6]),
+	}
+	return h, h.validate()
+}
+
+//ReadFileHeader read the header of a file written by EncryptFileWithHeader
+//filePath path to the file
+//return the header, or an error wrapping ErrNoHeader or ErrUnsupportedVersion
+//if the file cannot be read by this code
+func ReadFileHeader(filePath string) (FileHeader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return FileHeader{}, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	return readFileHeader(file)
+}
+
+//valueStart find where the values of a file start, checking their size
+//file file of same-size values, with or without a header
+//size size of the values expected by the caller
+//return 0 if the file has no header, FileHeaderSize if it has one recording
+//shards of size bytes, an error wrapping ErrSizeMismatch if the header
+//records shards of another size or framed ones, or the error reading or
+//validating the header
+func valueStart(file *os.File, size int64) (int64, error) {
+	header, err := readFileHeader(io.NewSectionReader(file, 0, FileHeaderSize))
+	if errors.Is(err, ErrNoHeader) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	shardSize := int64(header.ShardSize())
+	if shardSize == 0 {
+		return 0, fmt.Errorf("%w: framed shards, use ReadFramedValue", ErrSizeMismatch)
+	}
+	if size != shardSize {
+		return 0, fmt.Errorf("%w: %d instead of %d", ErrSizeMismatch, size, shardSize)
+	}
+	return FileHeaderSize, nil
+}
+
+//valueSection view of the values of a file, after its header if any
+//file file of same-size values
+//start offset of the values (see valueStart)
+//return a ReaderAt whose offset 0 is the first value
+func valueSection(file *os.File, start int64) io.ReaderAt {
+	if start == 0 {
+		return file
+	}
+	return io.NewSectionReader(file, start, math.MaxInt64-start)
+}
+
+//ShardSize size of the shards written after the header
+//return the size of every shard but the last one, or 0 if they are framed
+func (h FileHeader) ShardSize() int {
+	if h.Flags&FlagFramed != 0 {
+		return 0
+	}
+	size := h.ChunkSize
+	if h.AEAD != AEADNone {
+		size = AESGCMShardSize(size)
+	}
+	if h.Flags&FlagCRC != 0 {
+		size += CRC32CSize
+	}
+	return size
+}
+
+//encoder build the process function writing the shards described by the header
+//key key of the AEAD, ignored if the shards are not encrypted
+//return compression, encryption and checksum chained in this order
+func (h FileHeader) encoder(key []byte) (ProcessFunc, error) {
+	var stages []ProcessFunc
+	if h.Flags&FlagCompressed != 0 {
+		stages = append(stages, NewGzipCompressor())
+	}
+	if h.AEAD != AEADNone {
+		enc, err := NewAEADEncryptor(h.AEAD, key)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, enc)
+	}
+	if h.Flags&FlagCRC != 0 {
+		stages = append(stages, NewCRC32CSealer())
+	}
+	return Chain(stages...), nil
+}
+
+//decoder build the process function reading the shards described by the header
+//key key of the AEAD, ignored if the shards are not encrypted
+//return the inverse of encoder
+func (h FileHeader) decoder(key []byte) (ProcessFunc, error) {
+	var stages []ProcessFunc
+	if h.Flags&FlagCRC != 0 {
+		stages = append(stages, NewCRC32CVerifier())
+	}
+	if h.AEAD != AEADNone {
+		dec, err := NewAEADDecryptor(h.AEAD, key)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, dec)
+	}
+	if h.Flags&FlagCompressed != 0 {
+		stages = append(stages, NewGzipDecompressor())
+	}
+	return Chain(stages...), nil
+}
+
+//EncryptFileWithHeader encrypt a file that records how to read it
+//ctx context to cancel the processing
+//inputFile path to the plaintext file
+//outputFile path to the encrypted file, it must be different from inputFile
+//key key of the AEAD, ignored if header.AEAD is AEADNone
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//header chunk size, AEAD and flags to use, the version is set by the function
+//the output is the header (see FileHeaderSize) followed by the shards, so
+//that DecryptFileWithHeader only needs the key; it is written on
+//outputFile+TempSuffix, synced and renamed over outputFile once complete,
+//as ProcessFile does, so a failed run keeps an existing output
+//return the first error encountered, or the validation error of header
+func EncryptFileWithHeader(ctx context.Context, inputFile, outputFile string, key []byte, num int, header FileHeader) error {
+	header.Version = FileFormatVersion
+	if err := header.validate(); err != nil {
+		return err
+	}
+	enc, err := header.encoder(key)
+	if err != nil {
+		return err
+	}
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	if err := checkDistinct(file, outputFile); err != nil {
+		return err
+	}
+	//write the header and the shards on the temporary output
+	return writeOutput(outputFile, func(out *os.File) error {
+		if _, err := out.Write(header.encode()); err != nil {
+			return fileError(ErrWriteOutput, "error writing file", err)
+		}
+		return ProcessReader(ctx, file, out, enc, num, header.ChunkSize, header.Flags&FlagFramed != 0, nil)
+	})
+}
+
+//DecryptFileWithHeader decrypt a file written by EncryptFileWithHeader
+//ctx context to cancel the processing
+//inputFile path to the encrypted file
+//outputFile path to the plaintext file, it must be different from inputFile
+//key key of the AEAD used to encrypt
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//chunk size, AEAD and flags are read from the header, which is validated
+//before any shard is read
+//the plaintext is written on outputFile+TempSuffix and renamed over
+//outputFile once complete, so a shard failing to decrypt leaves no output
+//return the first error encountered, wrapping ErrUnsupportedVersion if the
+//file has a version this code cannot read
+func DecryptFileWithHeader(ctx context.Context, inputFile, outputFile string, key []byte, num int) error {
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	if err := checkDistinct(file, outputFile); err != nil {
+		return err
+	}
+	//the reading continues after the header
+	header, err := readFileHeader(file)
+	if err != nil {
+		return err
+	}
+	dec, err := header.decoder(key)
+	if err != nil {
+		return err
+	}
+	return writeOutput(outputFile, func(out *os.File) error {
+		return ProcessReader(ctx, file, out, dec, num, header.ShardSize(), false, nil)
+	})
+}
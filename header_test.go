@@ -0,0 +1,91 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileHelpersAtomicOutput(t *testing.T) {
+	key := bytes.Repeat([]byte{4}, 32)
+	wrapper, err := NewAESGCMKeyWrapper(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := FileHeader{ChunkSize: 100, AEAD: AEADAESGCM}
+	//corrupt flip a byte of the shards of an encrypted file
+	corrupt := func(t *testing.T, enc string) {
+		data, err := ioutil.ReadFile(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-50] ^= 1
+		if err := ioutil.WriteFile(enc, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		encrypt func(ctx context.Context, in, out string) error
+		decrypt func(in, out string) error
+	}{
+		{"with header", func(ctx context.Context, in, out string) error {
+			return EncryptFileWithHeader(ctx, in, out, key, 4, header)
+		}, func(in, out string) error {
+			return DecryptFileWithHeader(context.Background(), in, out, key, 4)
+		}},
+		{"envelope", func(ctx context.Context, in, out string) error {
+			return EncryptFileEnvelope(ctx, in, out, wrapper, 4, 100)
+		}, func(in, out string) error {
+			return DecryptFileEnvelope(context.Background(), in, out, wrapper, 4, 100)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 5000)
+			dir := filepath.Dir(in)
+			enc, dec := filepath.Join(dir, "enc"), filepath.Join(dir, "dec")
+			previous := []byte("previous output")
+			for _, out := range []string{enc, dec} {
+				if err := ioutil.WriteFile(out, previous, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			//kept checks that a failed run left the previous output alone
+			kept := func(out string) {
+				t.Helper()
+				if _, err := os.Stat(out + TempSuffix); !os.IsNotExist(err) {
+					t.Errorf("temporary file left: %v", err)
+				}
+				if data, err := ioutil.ReadFile(out); err != nil || !bytes.Equal(data, previous) {
+					t.Errorf("previous output changed to %q, %v", data, err)
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := tt.encrypt(ctx, in, enc); err == nil {
+				t.Fatal("cancelled encryption succeeded")
+			}
+			kept(enc)
+			if err := tt.encrypt(context.Background(), in, enc); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.decrypt(enc, dec); err != nil {
+				t.Fatal(err)
+			}
+			assertSameFile(t, dec, in)
+			//a shard failing to decrypt leaves the previous plaintext
+			if err := ioutil.WriteFile(dec, previous, 0600); err != nil {
+				t.Fatal(err)
+			}
+			corrupt(t, enc)
+			if err := tt.decrypt(enc, dec); err == nil {
+				t.Fatal("corrupt file decrypted")
+			}
+			kept(dec)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package ledger
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//HMACSuffix suffix appended to the output file name to get its HMAC tag
+const HMACSuffix = ".hmac"
+
+//ErrHMACMismatch the file does not match its HMAC tag
+var ErrHMACMismatch = errors.New("HMAC tag mismatch")
+
+//ProcessFileWithHMAC process a file as ProcessFile and authenticate the whole result
+//parameters as in ProcessFile, plus:
+//key HMAC-SHA256 key, not empty
+//the tag is computed over the bytes of the output file, length prefixes
+//included if framed, fed in index order as the shards are written, so it
+//detects shards reordered, swapped, removed or truncated, which the per-shard
+//authentication of an AEAD cannot; it is written on outputFile+HMACSuffix
+//return the HMAC-SHA256 tag of the output file (see VerifyFileHMAC)
+func ProcessFileWithHMAC(ctx context.Context, inputFile, outputFile string, process ProcessFunc, key []byte, num, size int, framed, manifest bool, mode WriteMode, progress ProgressFunc) (tag []byte, err error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty HMAC key")
+	}
+	mac := hmac.New(sha256.New, key)
+	observe := func(ct Shard) error {
+		if framed {
+			return writeFrame(mac, ct.Value)
+		}
+		_, err := mac.Write(ct.Value)
+		return err
+	}
+	_, err = processFile(ctx, inputFile, outputFile, process, ProcessOptions{
+		Workers:   num,
+		ChunkSize: size,
+		Framed:    framed,
+		Manifest:  manifest,
+		Mode:      mode,
+		Progress:  progress,
+	}, observe)
+	if err != nil {
+		return nil, err
+	}
+	tag = mac.Sum(nil)
+	err = ioutil.WriteFile(outputFile+HMACSuffix, tag, OutputPerm)
+	if err != nil {
+		return nil, fileError(ErrWriteOutput, "error writing HMAC tag", err)
+	}
+	return tag, nil
+}
+
+//VerifyFileHMAC check a file against its HMAC tag
+//filePath path to the file written by ProcessFileWithHMAC
+//key HMAC-SHA256 key used to write the file
+//expectedTag tag returned by ProcessFileWithHMAC, or read from filePath+HMACSuffix
+//return nil if the tag matches, an error wrapping ErrHMACMismatch if it does not,
+//or the error encountered reading the file
+func VerifyFileHMAC(filePath string, key []byte, expectedTag []byte) error {
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	mac := hmac.New(sha256.New, key)
+	if _, err := io.Copy(mac, bufio.NewReader(file)); err != nil {
+		return fileError(ErrReadInput, "error reading file", err)
+	}
+	if !hmac.Equal(mac.Sum(nil), expectedTag) {
+		return fmt.Errorf("%w: %s", ErrHMACMismatch, filePath)
+	}
+	return nil
+}
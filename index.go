@@ -0,0 +1,330 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+//ShardIndex offsets of the shards of a file written with framed shards,
+//to read any of them with a single seek
+type ShardIndex struct {
+	//path to the indexed file
+	filePath string
+	//size of the indexed file when the index was built
+	fileSize int64
+	//offset of the value of each shard, after its length prefix
+	offsets []int64
+	//length of the value of each shard
+	lengths []int64
+	//offset of the plaintext of each shard in the original input, followed
+	//by its total length, nil until SetPlaintextLengths is called
+	plainOffsets []int64
+}
+
+//shardIndexMagic first bytes of a serialized ShardIndex
+var shardIndexMagic = [8]byte{'S', 'H', 'R', 'D', 'I', 'D', 'X', '1'}
+
+//BuildShardIndex scan the length prefixes of a file written with framed shards
+//filePath path to the file containing a series of framed values
+//the whole file is scanned once, skipping the values with Seek
+//return the index of the shards, or an error wrapping ErrShortValue if the
+//file ends in the middle of a frame
+func BuildShardIndex(filePath string) (*ShardIndex, error) {
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx := &ShardIndex{filePath: filePath, fileSize: fi.Size()}
+	for i, offset := int64(0), int64(0); ; i++ {
+		length, err := readFrameHeader(file, i)
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += FrameHeaderSize
+		if offset+length > idx.fileSize {
+			return nil, fmt.Errorf("%w: value %d is truncated", ErrShortValue, i)
+		}
+		idx.offsets = append(idx.offsets, offset)
+		idx.lengths = append(idx.lengths, length)
+		offset, err = file.Seek(length, io.SeekCurrent)
+		if err != nil {
+			return nil, fileError(ErrReadInput, "error seeking file", err)
+		}
+	}
+}
+
+//Len number of shards in the index
+func (idx *ShardIndex) Len() int {
+	return len(idx.offsets)
+}
+
+//Read read a single value of the indexed file
+//index index of the desired value
+//return the value read, or an error that wraps:
+//	ErrInvalidIndex if index is negative
+//	io.EOF if the value is past the end of the file
+//	ErrShortValue if the file is shorter than when it was indexed
+//	the os.Open or read error otherwise
+func (idx *ShardIndex) Read(index int) ([]byte, error) {
+	if err := idx.checkIndex(int64(index)); err != nil {
+		return nil, err
+	}
+	//open input file
+	file, err := os.Open(idx.filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	return idx.readAt(file, index)
+}
+
+//checkIndex check that a value is in the index
+//index index of the value
+//return an error wrapping ErrInvalidIndex if index is negative, or io.EOF
+//if it is past the last value
+func (idx *ShardIndex) checkIndex(index int64) error {
+	if index < 0 {
+		return fmt.Errorf("%w: index %d", ErrInvalidIndex, index)
+	}
+	if index >= int64(len(idx.offsets)) {
+		return fmt.Errorf("value %d not present: %w", index, io.EOF)
+	}
+	return nil
+}
+
+//readAt read a value of the indexed file
+//r the indexed file
+//index index of the value, it must be in the index
+//return the value read, or the errors described in Read
+func (idx *ShardIndex) readAt(r io.ReaderAt, index int) ([]byte, error) {
+	buffer := make([]byte, idx.lengths[index])
+	n, err := r.ReadAt(buffer, idx.offsets[index])
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: value %d has %d of %d bytes", ErrShortValue, index, n, len(buffer))
+	}
+	if err != nil {
+		return nil, fileError(ErrReadInput, "error reading file", err)
+	}
+	return buffer, nil
+}
+
+//ReadFramedValues read a batch of values from a file written with framed shards
+//filePath path to the file containing a series of framed values
+//indices indices of the desired values
+//the file is indexed with BuildShardIndex, so every value is read with a
+//single ReadAt after one scan of the length prefixes
+//return the values read, by index; if some cannot be read they are missing
+//from the map and the error is an IndexErrors with an entry for each of
+//them, wrapping io.EOF for the indices past the last value and the errors
+//returned by ShardIndex.Read otherwise; the error of the indexing or the
+//opening of the file fails the whole batch
+func ReadFramedValues(filePath string, indices []int64) (map[int64][]byte, error) {
+	idx, err := BuildShardIndex(filePath)
+	if err != nil {
+		return nil, err
+	}
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	values := make(map[int64][]byte, len(indices))
+	var failed IndexErrors
+	for _, index := range indices {
+		if _, ok := values[index]; ok {
+			continue
+		}
+		err := idx.checkIndex(index)
+		var value []byte
+		if err == nil {
+			value, err = idx.readAt(file, int(index))
+		}
+		if err != nil {
+			failed = append(failed, &IndexError{index, err})
+			continue
+		}
+		values[index] = value
+	}
+	if len(failed) > 0 {
+		return values, failed
+	}
+	return values, nil
+}
+
+//Save write the index on file, to be loaded with LoadShardIndex
+//indexPath path to the file where the index is written
+//the index is stored as a magic string, the size of the indexed file,
+//the number of shards and the offset and length of each shard, all
+//big-endian 64 bit integers
+//return the error encountered while writing
+func (idx *ShardIndex) Save(indexPath string) (err error) {
+	file, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, OutputPerm)
+	if err != nil {
+		return fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//close file on exit
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fileError(ErrCloseOutput, "error closing file", cerr)
+		}
+	}()
+	w := bufio.NewWriter(file)
+	w.Write(shardIndexMagic[:])
+	binary.Write(w, binary.BigEndian, idx.fileSize)
+	binary.Write(w, binary.BigEndian, int64(len(idx.offsets)))
+	for i := range idx.offsets {
+		binary.Write(w, binary.BigEndian, idx.offsets[i])
+		binary.Write(w, binary.BigEndian, idx.lengths[i])
+	}
+	if err = w.Flush(); err != nil {
+		return fileError(ErrWriteOutput, "error writing index", err)
+	}
+	return nil
+}
+
+//LoadShardIndex read an index written by Save
+//indexPath path to the file where the index was written
+//filePath path to the indexed file, it must have the same size it had
+//when the index was built
+//return the index, or an error if it is malformed or does not match the file
+func LoadShardIndex(indexPath, filePath string) (*ShardIndex, error) {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var magic [8]byte
+	var count int64
+	idx := &ShardIndex{filePath: filePath}
+	if _, err = io.ReadFull(r, magic[:]); err == nil {
+		err = binary.Read(r, binary.BigEndian, &idx.fileSize)
+	}
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &count)
+	}
+	if err != nil || magic != shardIndexMagic || count < 0 {
+		return nil, errors.New("malformed shard index")
+	}
+	//the file must not have changed since it was indexed
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != idx.fileSize {
+		return nil, fmt.Errorf("shard index built for %d bytes, file has %d", idx.fileSize, fi.Size())
+	}
+	for i := int64(0); i < count; i++ {
+		var offset, length int64
+		err = binary.Read(r, binary.BigEndian, &offset)
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &length)
+		}
+		//compare without adding, which could overflow
+		if err != nil || offset < 0 || length < 0 || offset > idx.fileSize || length > idx.fileSize-offset {
+			return nil, fmt.Errorf("malformed shard index entry %d", i)
+		}
+		idx.offsets = append(idx.offsets, offset)
+		idx.lengths = append(idx.lengths, length)
+	}
+	return idx, nil
+}
+
+//SetPlaintextLengths record the length of the input chunk of every shard,
+//needed to read by plaintext offset with ReadAtPlaintextOffset
+//lengths length of the chunk of each shard, as returned by ManifestLengths
+//for the manifest written with the indexed file
+//return an error if lengths does not match the shards of the index
+func (idx *ShardIndex) SetPlaintextLengths(lengths []int64) error {
+	if len(lengths) != len(idx.offsets) {
+		return fmt.Errorf("index has %d shards, %d lengths given", len(idx.offsets), len(lengths))
+	}
+	offsets := make([]int64, len(lengths)+1)
+	for i, length := range lengths {
+		if length < 0 || length > math.MaxInt64-offsets[i] {
+			return fmt.Errorf("invalid length %d of shard %d", length, i)
+		}
+		offsets[i+1] = offsets[i] + length
+	}
+	idx.plainOffsets = offsets
+	return nil
+}
+
+//ReadAtPlaintextOffset read a byte range of the input of an indexed file
+//idx index of the file, with the lengths set by SetPlaintextLengths
+//process function that decrypts a shard
+//offset offset of the range in the input
+//length length of the range
+//only the shards covering [offset, offset+length) are read and decrypted,
+//and a range spanning several shards is stitched from their plaintexts;
+//the range is clamped at the end of the input
+//return the bytes of the range, or an error that wraps:
+//	ErrInvalidIndex if offset or length are negative
+//	io.EOF if offset is past the end of the input
+//	the error of idx.Read or of process otherwise
+func ReadAtPlaintextOffset(idx *ShardIndex, process ProcessFunc, offset, length int64) ([]byte, error) {
+	if idx.plainOffsets == nil {
+		return nil, errors.New("plaintext lengths not set on the shard index")
+	}
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("%w: offset %d, length %d", ErrInvalidIndex, offset, length)
+	}
+	total := idx.plainOffsets[len(idx.offsets)]
+	if offset > total || (offset == total && length > 0) {
+		return nil, fmt.Errorf("offset %d past the end of the input: %w", offset, io.EOF)
+	}
+	//compare without adding, which could overflow
+	end := total
+	if length < total-offset {
+		end = offset + length
+	}
+	result := make([]byte, 0, end-offset)
+	//first shard ending after offset
+	first := sort.Search(len(idx.offsets), func(i int) bool {
+		return idx.plainOffsets[i+1] > offset
+	})
+	for i := first; i < len(idx.offsets) && idx.plainOffsets[i] < end; i++ {
+		value, err := idx.Read(i)
+		if err != nil {
+			return nil, err
+		}
+		pt, err := safeProcess(process, Shard{i, value})
+		if err != nil {
+			return nil, err
+		}
+		start, stop := idx.plainOffsets[i], idx.plainOffsets[i+1]
+		if int64(len(pt.Value)) != stop-start {
+			return nil, fmt.Errorf("shard %d has %d bytes of plaintext, %d expected", i, len(pt.Value), stop-start)
+		}
+		//keep the part of the shard inside the range
+		from, to := int64(0), stop-start
+		if offset > start {
+			from = offset - start
+		}
+		if end < stop {
+			to = end - start
+		}
+		result = append(result, pt.Value[from:to]...)
+	}
+	return result, nil
+}
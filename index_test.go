@@ -0,0 +1,62 @@
+package ledger
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardIndexOffsetOverflow(t *testing.T) {
+	in := writeInput(t, 100)
+	out := filepath.Join(filepath.Dir(in), "out")
+	if _, err := ProcessFileWithOptions(context.Background(), in, out, identity, ProcessOptions{ChunkSize: 10, Framed: true, NoSync: true}); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := BuildShardIndex(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengths := make([]int64, idx.Len())
+	tests := []struct {
+		name    string
+		lengths func() []int64
+		wantErr bool
+	}{
+		{"valid", func() []int64 {
+			for i := range lengths {
+				lengths[i] = 10
+			}
+			return lengths
+		}, false},
+		{"sum overflows", func() []int64 {
+			overflowing := append([]int64(nil), lengths...)
+			overflowing[0], overflowing[1] = math.MaxInt64, 1
+			return overflowing
+		}, true},
+		{"negative length", func() []int64 {
+			negative := append([]int64(nil), lengths...)
+			negative[3] = -1
+			return negative
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := idx.SetPlaintextLengths(tt.lengths())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	//restore the valid lengths: a length reaching past the end is clamped
+	if err := idx.SetPlaintextLengths(tests[0].lengths()); err != nil {
+		t.Fatal(err)
+	}
+	value, err := ReadAtPlaintextOffset(idx, identity, 95, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 5 {
+		t.Errorf("%d bytes read, want the 5 up to the end", len(value))
+	}
+}
@@ -0,0 +1,87 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+//ProcessInPlace process a file overwriting each shard with its processed
+//version, so that no second copy of the file is needed on disk
+//filePath path to the file, it must be a regular file (see ErrNotRegular)
+//process function that processes each chunk, it must preserve the length of
+//the shards, as a stream cipher does
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of chunks to process, it must be positive since framed shards
+//could change length
+//each processed shard is written at the offset of its chunk, which was read
+//before, and the chunks do not overlap, so the workers never touch the
+//same bytes
+//WARNING: the file is modified while it is processed, if the run fails or
+//the process crashes the file is left partially processed, the shards before
+//some index processed and the following ones not, with no way to tell
+//them apart from the file alone: keep a backup, or use ProcessFile, unless
+//the data can be recovered otherwise
+//return nil once the whole file is processed and synced to stable storage,
+//an error wrapping ErrVariableLength as soon as a shard changes length,
+//or the first error encountered reading, processing or writing a shard
+func ProcessInPlace(filePath string, process ProcessFunc, num, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	//open input file
+	file, err := openRegular(filePath)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		return fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//close output on exit, it is closed explicitly on success
+	defer out.Close()
+	total := int(shardCount(fi.Size(), int64(size)))
+	//process file, until a write fails
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buffers := newChunkBuffers(size)
+	results, streamErr := processStream(ctx, file, process, num, size, 0, buffers, nil, lateShards{})
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- orderResults(context.Background(), results, 0, total, lateShards{}, func(ct Shard) error {
+			offset := int64(ct.Index) * int64(size)
+			//the last chunk can be partial
+			length := int64(size)
+			if remaining := fi.Size() - offset; remaining < length {
+				length = remaining
+			}
+			if int64(len(ct.Value)) != length {
+				cancel()
+				return fmt.Errorf("%w: shard %d has %d bytes instead of %d", ErrVariableLength, ct.Index, len(ct.Value), length)
+			}
+			if _, err := out.WriteAt(ct.Value, offset); err != nil {
+				cancel()
+				return fileError(ErrWriteOutput, "error writing file", err)
+			}
+			buffers.release(ct.Index)
+			return nil
+		})
+	}()
+	if err := waitProcessing(context.Background(), streamErr, writeErr); err != nil {
+		return err
+	}
+	if err := syncOutput(out); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fileError(ErrCloseOutput, "error closing file", err)
+	}
+	logln("file processed in place successfully!")
+	return nil
+}
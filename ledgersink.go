@@ -0,0 +1,94 @@
+package ledger
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+//LedgerClient client of a public ledger, where the commitments to the
+//shards are anchored
+type LedgerClient interface {
+	//Submit publish the commitment to a shard
+	//index index of the shard
+	//commitment hash of the shard, never the shard itself
+	//return the identifier of the transaction holding the commitment
+	Submit(index int, commitment []byte) (txid string, err error)
+}
+
+//LedgerSink ShardSink that anchors every shard to a public ledger: only the
+//hash of the shard is submitted, so the sensitive data never reaches the
+//chain, and the data itself can be stored by another sink
+type LedgerSink struct {
+	//Client ledger where the commitments are submitted
+	Client LedgerClient
+	//Data sink storing the shards themselves before their commitment is
+	//submitted, so the ledger never refers to a shard that was not stored,
+	//nil to submit the commitments only
+	Data ShardSink
+	//Hash algorithm of the commitments, the zero value for HashSHA256
+	Hash HashFunc
+	//Manifest where a line index:hex(hash(shard)):txid is written for every
+	//shard anchored, in index order, nil for none; it starts with a line
+	//hash:name unless Hash is HashSHA256, as the manifests of ProcessFile
+	Manifest io.Writer
+	//mutex guarding txids
+	mutex sync.Mutex
+	//txids transaction identifiers of the shards anchored, by index
+	txids []string
+}
+
+//Put store a shard in Data, then submit its commitment to the ledger
+//index index of the shard
+//data content of the shard, not kept after Put returns
+//return the error of Data, of the ledger, or writing the manifest; a shard
+//whose commitment was submitted is not submitted again if Put is retried
+//after a failure of the manifest
+func (s *LedgerSink) Put(index int, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if index < len(s.txids) {
+		return s.record(index, data)
+	}
+	if index != len(s.txids) {
+		return fmt.Errorf("%w: shard %d stored after %d", ErrShardOrder, index, len(s.txids)-1)
+	}
+	if s.Data != nil {
+		if err := s.Data.Put(index, data); err != nil {
+			return err
+		}
+	}
+	txid, err := s.Client.Submit(index, s.Hash.Sum(data))
+	if err != nil {
+		return fmt.Errorf("error submitting commitment: %w", err)
+	}
+	s.txids = append(s.txids, txid)
+	return s.record(index, data)
+}
+
+//record write the manifest line of an anchored shard
+//index index of the shard
+//data content of the shard
+//return the error writing the manifest
+func (s *LedgerSink) record(index int, data []byte) error {
+	if s.Manifest == nil {
+		return nil
+	}
+	if index == 0 && !s.Hash.isDefault() {
+		if _, err := fmt.Fprintf(s.Manifest, "%s%s\n", manifestHashPrefix, s.Hash.Name); err != nil {
+			return fileError(ErrWriteOutput, "error writing manifest", err)
+		}
+	}
+	if _, err := fmt.Fprintf(s.Manifest, "%d:%x:%s\n", index, s.Hash.Sum(data), s.txids[index]); err != nil {
+		return fileError(ErrWriteOutput, "error writing manifest", err)
+	}
+	return nil
+}
+
+//TxIDs identifiers of the transactions of the shards anchored so far
+//return the identifiers, by shard index
+func (s *LedgerSink) TxIDs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.txids...)
+}
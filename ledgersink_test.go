@@ -0,0 +1,126 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//mockLedger LedgerClient recording the commitments submitted
+type mockLedger struct {
+	//events log of the calls of the client and of the data sink, in order
+	events *[]string
+	//commitments submitted, by index
+	commitments [][]byte
+	//fail error returned by the next Submit, nil for none
+	fail error
+}
+
+func (l *mockLedger) Submit(index int, commitment []byte) (string, error) {
+	if err := l.fail; err != nil {
+		l.fail = nil
+		return "", err
+	}
+	*l.events = append(*l.events, fmt.Sprintf("submit %d", index))
+	l.commitments = append(l.commitments, append([]byte(nil), commitment...))
+	return fmt.Sprintf("tx%d", index), nil
+}
+
+//eventSink ShardSink recording the shards stored
+type eventSink struct {
+	events *[]string
+	shards [][]byte
+}
+
+func (s *eventSink) Put(index int, data []byte) error {
+	*s.events = append(*s.events, fmt.Sprintf("put %d", index))
+	s.shards = append(s.shards, append([]byte(nil), data...))
+	return nil
+}
+
+func TestLedgerSink(t *testing.T) {
+	in := writeInput(t, 250)
+	for _, hf := range []HashFunc{{}, HashSHA3_256} {
+		var events []string
+		client := &mockLedger{events: &events}
+		data := &eventSink{events: &events}
+		var manifest bytes.Buffer
+		sink := &LedgerSink{Client: client, Data: data, Hash: hf, Manifest: &manifest}
+		opts := ProcessOptions{ChunkSize: 100, NoSync: true}
+		if _, err := ProcessFileToSink(context.Background(), in, sink, identity, opts); err != nil {
+			t.Fatal(err)
+		}
+		//every shard is stored before its commitment is submitted
+		want := []string{"put 0", "submit 0", "put 1", "submit 1", "put 2", "submit 2"}
+		if !reflect.DeepEqual(events, want) {
+			t.Fatalf("%s: calls %v, want %v", hf.orDefault().Name, events, want)
+		}
+		//only the hashes of the shards reach the ledger
+		var lines []string
+		if !hf.isDefault() {
+			lines = append(lines, manifestHashPrefix+hf.Name)
+		}
+		for i, shard := range data.shards {
+			if !bytes.Equal(client.commitments[i], hf.Sum(shard)) {
+				t.Fatalf("%s: commitment %d is not the hash of the shard", hf.orDefault().Name, i)
+			}
+			lines = append(lines, fmt.Sprintf("%d:%x:tx%d", i, hf.Sum(shard), i))
+		}
+		if got := manifest.String(); got != strings.Join(lines, "\n")+"\n" {
+			t.Fatalf("%s: manifest %q", hf.orDefault().Name, got)
+		}
+		if got := sink.TxIDs(); !reflect.DeepEqual(got, []string{"tx0", "tx1", "tx2"}) {
+			t.Fatalf("%s: txids %v", hf.orDefault().Name, got)
+		}
+	}
+}
+
+//flakyWriter writer failing while fail is set
+type flakyWriter struct {
+	bytes.Buffer
+	fail error
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if w.fail != nil {
+		return 0, w.fail
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestLedgerSinkFailure(t *testing.T) {
+	var events []string
+	errLedger := errors.New("ledger unavailable")
+	client := &mockLedger{events: &events, fail: errLedger}
+	manifest := &flakyWriter{fail: errors.New("disk full")}
+	sink := &LedgerSink{Client: client, Manifest: manifest}
+	//a failed submission is submitted again when Put is retried
+	if err := sink.Put(0, []byte("a")); !errors.Is(err, errLedger) {
+		t.Fatalf("err = %v, want %v", err, errLedger)
+	}
+	if len(sink.TxIDs()) != 0 {
+		t.Fatal("failed submission recorded")
+	}
+	//a failed manifest write does not submit the shard again
+	if err := sink.Put(0, []byte("a")); !errors.Is(err, ErrWriteOutput) {
+		t.Fatalf("err = %v, want %v", err, ErrWriteOutput)
+	}
+	manifest.fail = nil
+	if err := sink.Put(0, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"submit 0"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("calls %v, want %v", events, want)
+	}
+	if got, want := manifest.String(), fmt.Sprintf("0:%x:tx0\n", HashSHA256.Sum([]byte("a"))); got != want {
+		t.Fatalf("manifest %q, want %q", got, want)
+	}
+	//the shards are anchored in index order
+	if err := sink.Put(2, []byte("c")); !errors.Is(err, ErrShardOrder) {
+		t.Fatalf("err = %v, want %v", err, ErrShardOrder)
+	}
+}
@@ -0,0 +1,27 @@
+package ledger
+
+//Logger destination of the diagnostic messages of the package,
+//such as the errors of the ledger operations and the completion of ProcessFile
+//*log.Logger satisfies it
+type Logger interface {
+	Println(v ...interface{})
+}
+
+//nopLogger logger that discards every message
+type nopLogger struct{}
+
+//Println discard the message
+func (nopLogger) Println(v ...interface{}) {}
+
+//Log logger receiving the diagnostic messages of the package
+//by default the messages are discarded, so that nothing is printed on the
+//standard output of the programs using the package, which may carry their
+//actual output: set it, for example, to log.New(os.Stderr, "", log.LstdFlags)
+var Log Logger = nopLogger{}
+
+//logln send a message to Log, if set
+func logln(v ...interface{}) {
+	if Log != nil {
+		Log.Println(v...)
+	}
+}
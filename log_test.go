@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+//captureLogger Logger recording the messages
+type captureLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) Println(v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, fmt.Sprintln(v...))
+}
+
+//discardSink ShardSink discarding the shards
+type discardSink struct{}
+
+func (discardSink) Put(index int, data []byte) error { return nil }
+
+func TestLogNotStdout(t *testing.T) {
+	//redirect the standard output to a pipe
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	printed := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		printed <- data
+	}()
+	defer func(log Logger) {
+		os.Stdout = stdout
+		Log = log
+	}(Log)
+	run := func() {
+		in := writeInput(t, 1000)
+		out := filepath.Join(filepath.Dir(in), "out")
+		if _, err := ProcessFile(context.Background(), in, out, identity, 4, 100, false, false, false, WriteTruncate, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ProcessInPlace(out, identity, 4, 100); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ProcessFileToSink(context.Background(), in, discardSink{}, identity, ProcessOptions{ChunkSize: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the messages are discarded by default
+	run()
+	//and sent to the logger installed
+	logger := &captureLogger{}
+	Log = logger
+	run()
+	os.Stdout = stdout
+	w.Close()
+	if data := <-printed; len(data) != 0 {
+		t.Fatalf("printed on the standard output: %q", data)
+	}
+	want := []string{"file written successfully!\n", "file processed in place successfully!\n", "shards stored successfully!\n"}
+	if !reflect.DeepEqual(logger.messages, want) {
+		t.Fatalf("logged %q, want %q", logger.messages, want)
+	}
+}
@@ -0,0 +1,433 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//ManifestSuffix suffix appended to the output file name to get its manifest
+const ManifestSuffix = ".manifest"
+
+//ErrManifestMismatch a shard of the file is not listed by the manifest, a
+//listed shard whose digest differs is reported as ErrShardCorrupt instead
+var ErrManifestMismatch = errors.New("shard does not match the manifest")
+
+//manifestHashPrefix prefix of the first line of a manifest naming its hash
+//algorithm, absent for HashSHA256
+const manifestHashPrefix = "hash:"
+
+//manifestObserver build the observer that writes the manifest of the shards
+//w where to write the manifest
+//size size of the input chunks
+//inputSize byte size of the input file, -1 if unknown
+//hf algorithm of the digests, its header line is written by openManifest
+//each shard gets a line index:hex(hash(value)):length, in index order,
+//where length is the byte length of the input chunk the shard was produced
+//from (only the last one can be shorter than size), omitted if inputSize is unknown
+//return the observer to pass to processFile
+func manifestObserver(w io.Writer, size int, inputSize int64, hf HashFunc) func(Shard) error {
+	return func(ct Shard) error {
+		digest := hf.Sum(ct.Value)
+		if inputSize < 0 {
+			_, err := fmt.Fprintf(w, "%d:%x\n", ct.Index, digest)
+			return err
+		}
+		length := inputSize - int64(ct.Index)*int64(size)
+		if length > int64(size) {
+			length = int64(size)
+		}
+		_, err := fmt.Fprintf(w, "%d:%x:%d\n", ct.Index, digest, length)
+		return err
+	}
+}
+
+//openManifest open the manifest of an output file for writing
+//outputFile path of the output file
+//last index of the last shard to keep from an existing manifest,
+//-1 to start a new manifest
+//resume true to write the manifest in place, as a resumed output is, false
+//to write a new one on its temporary file (see createTemp), to be committed
+//along with the output
+//mode how an existing manifest is treated when starting a new one
+//perm permissions of the manifest if it is created
+//hf algorithm of the digests, a new manifest starts with a line naming it
+//unless it is HashSHA256, and a resumed one must have been written with it
+//return the manifest file, positioned after the lines kept
+func openManifest(outputFile string, last int, resume bool, mode WriteMode, perm os.FileMode, hf HashFunc) (*os.File, error) {
+	name := outputFile + ManifestSuffix
+	header := ""
+	if !hf.isDefault() {
+		header = manifestHashPrefix + hf.Name + "\n"
+	}
+	if last < 0 {
+		var mf *os.File
+		var err error
+		if resume {
+			if mf, err = os.OpenFile(name, mode.openFlags(), perm); err != nil {
+				return nil, fileError(ErrOpenOutput, "error opening manifest", err)
+			}
+		} else if mf, err = createTemp(name, mode, perm); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(mf, header); err != nil {
+			mf.Close()
+			if !resume {
+				os.Remove(mf.Name())
+			}
+			return nil, fileError(ErrWriteOutput, "error writing manifest", err)
+		}
+		return mf, nil
+	}
+	mf, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, fileError(ErrOpenOutput, "error opening manifest", err)
+	}
+	//find the end of the line of shard last, after the header
+	offset := int64(0)
+	reader := bufio.NewReader(mf)
+	if header != "" {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != header {
+			mf.Close()
+			return nil, fmt.Errorf("manifest not written with %s", hf.Name)
+		}
+		offset += int64(len(line))
+	}
+	for i := 0; i <= last; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			mf.Close()
+			return nil, fmt.Errorf("manifest does not list shard %d: %w", i, err)
+		}
+		if strings.HasPrefix(line, manifestHashPrefix) {
+			mf.Close()
+			return nil, fmt.Errorf("manifest not written with %s", hf.orDefault().Name)
+		}
+		offset += int64(len(line))
+	}
+	//drop the lines of the shards written after the checkpoint
+	if err = mf.Truncate(offset); err == nil {
+		_, err = mf.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		mf.Close()
+		return nil, fmt.Errorf("error resuming manifest: %w", err)
+	}
+	return mf, nil
+}
+
+//manifestReader reader of the shard lines of a manifest
+type manifestReader struct {
+	//scanner of the lines
+	scanner *bufio.Scanner
+	//hash algorithm of the digests, named by the first line if it is not
+	//HashSHA256
+	hash HashFunc
+	//first shard line, read looking for the header, if not yet returned
+	first *string
+}
+
+//newManifestReader start reading a manifest
+//r reader of the manifest
+//return the reader, whose hash is the one recorded in the manifest, or an
+//error if the recorded algorithm is unknown (see RegisterHash)
+func newManifestReader(r io.Reader) (*manifestReader, error) {
+	m := &manifestReader{scanner: bufio.NewScanner(r), hash: HashSHA256}
+	if !m.scanner.Scan() {
+		return m, nil
+	}
+	line := m.scanner.Text()
+	if !strings.HasPrefix(line, manifestHashPrefix) {
+		m.first = &line
+		return m, nil
+	}
+	hf, err := LookupHash(strings.TrimPrefix(line, manifestHashPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("malformed manifest: %w", err)
+	}
+	m.hash = hf
+	return m, nil
+}
+
+//next read the next shard line
+//return the index, the digest and the original length listed in the line
+//as parseManifestLine, io.EOF after the last line, or an error if the line is
+//malformed or the manifest cannot be read
+func (m *manifestReader) next() (int, []byte, int64, error) {
+	var line string
+	switch {
+	case m.first != nil:
+		line, m.first = *m.first, nil
+	case m.scanner.Scan():
+		line = m.scanner.Text()
+	default:
+		if err := m.scanner.Err(); err != nil {
+			return 0, nil, 0, err
+		}
+		return 0, nil, 0, io.EOF
+	}
+	index, digest, length, err := parseManifestLine(line)
+	if err == nil && len(digest) != m.hash.Size() {
+		err = fmt.Errorf("malformed manifest digest of shard %d", index)
+	}
+	return index, digest, length, err
+}
+
+//parseManifestLine decode a line of the manifest
+//line line to decode, without the newline
+//return the index, the digest and the original length listed in the line,
+//the length is -1 if the line does not list it
+func parseManifestLine(line string) (int, []byte, int64, error) {
+	parts := strings.Split(line, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return 0, nil, 0, fmt.Errorf("malformed manifest line %q", line)
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("malformed manifest index %q", parts[0])
+	}
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil || len(digest) == 0 {
+		return 0, nil, 0, fmt.Errorf("malformed manifest digest of shard %d", index)
+	}
+	length := int64(-1)
+	if len(parts) == 3 {
+		length, err = strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || length < 0 {
+			return 0, nil, 0, fmt.Errorf("malformed manifest length of shard %d", index)
+		}
+	}
+	return index, digest, length, nil
+}
+
+//VerifyManifest check every shard of a file against its manifest
+//dataFile path to the file written by ProcessFile
+//manifestFile path to the manifest written along with dataFile
+//size size of the shards, 0 if dataFile was written with framed shards
+//the shards are hashed with the algorithm recorded in the manifest
+//return nil if the manifest lists exactly the shards of the file in order,
+//an error naming the first shard that does not match otherwise: an
+//ErrShardCorrupt if its digest differs, an error wrapping
+//ErrManifestMismatch if it is not listed, or wrapping ErrMissingShard if the
+//file ends before the last shard listed, as VerifyManifestParallel reports
+//them; an error wrapping ErrInvalidSize for a negative size
+func VerifyManifest(dataFile, manifestFile string, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	//open manifest
+	mf, err := os.Open(manifestFile)
+	if err != nil {
+		return fileError(ErrOpenInput, "error opening manifest", err)
+	}
+	defer mf.Close()
+	lines, err := newManifestReader(mf)
+	if err != nil {
+		return err
+	}
+	//open data
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return fileError(ErrOpenInput, "error opening file", err)
+	}
+	defer file.Close()
+	//read data shards
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shards := make(chan Shard)
+	readErr := make(chan error, 1)
+	go func() {
+		if size == 0 {
+			readErr <- ReadFramesFrom(ctx, file, shards)
+		} else {
+			readErr <- ReadChunksFrom(ctx, file, shards, size)
+		}
+	}()
+	//compare them with the manifest line by line
+	count := 0
+	for ct := range shards {
+		index, digest, _, err := lines.next()
+		if err == io.EOF {
+			cancel()
+			return fmt.Errorf("%w: shard %d not listed", ErrManifestMismatch, ct.Index)
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		if index != ct.Index {
+			cancel()
+			return fmt.Errorf("manifest lists shard %d instead of %d", index, ct.Index)
+		}
+		if !bytes.Equal(digest, lines.hash.Sum(ct.Value)) {
+			cancel()
+			return ErrShardCorrupt{ct.Index}
+		}
+		count++
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+	//the manifest should have no more lines
+	if _, _, _, err := lines.next(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("manifest lists more than the %d shards of the file: %w", count, ErrMissingShard{count})
+	}
+	return nil
+}
+
+//manifestDigests read the digests of the shards from a manifest
+//manifestFile path to the manifest written by ProcessFile
+//return the digest of each shard, in index order, and the algorithm they
+//were computed with, or an error if the manifest is malformed or does not
+//list the shards in order
+func manifestDigests(manifestFile string) ([][]byte, HashFunc, error) {
+	mf, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, HashFunc{}, fileError(ErrOpenInput, "error opening manifest", err)
+	}
+	defer mf.Close()
+	lines, err := newManifestReader(mf)
+	if err != nil {
+		return nil, HashFunc{}, err
+	}
+	digests := [][]byte{}
+	for {
+		index, digest, _, err := lines.next()
+		if err == io.EOF {
+			return digests, lines.hash, nil
+		}
+		if err != nil {
+			return nil, HashFunc{}, err
+		}
+		if index != len(digests) {
+			return nil, HashFunc{}, fmt.Errorf("manifest lists shard %d instead of %d", index, len(digests))
+		}
+		digests = append(digests, digest)
+	}
+}
+
+//VerifyManifestParallel check every shard of a file against its manifest,
+//hashing the shards concurrently
+//dataFile path to the file written by ProcessFile
+//manifestFile path to the manifest written along with dataFile
+//num number of shards to hash concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of the shards, 0 if dataFile was written with framed shards
+//unlike VerifyManifest the check goes on after a mismatch, so one pass
+//finds all the damaged shards
+//return nil if the manifest lists exactly the shards of the file, an
+//IndexErrors with an entry for every shard that does not match, wrapping
+//the error VerifyManifest would return for it: ErrShardCorrupt if it differs
+//from its entry, ErrManifestMismatch if it is not listed, ErrMissingShard if
+//it is listed but missing from the file; an error wrapping ErrInvalidSize
+//for a negative size, or the error encountered reading the file or the manifest
+func VerifyManifestParallel(dataFile, manifestFile string, num, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	digests, hf, err := manifestDigests(manifestFile)
+	if err != nil {
+		return err
+	}
+	//open data
+	file, err := openRegular(dataFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	//the workers replace each shard with its digest
+	hash := Infallible(func(inp Shard) Shard {
+		return Shard{inp.Index, hf.Sum(inp.Value)}
+	})
+	results, streamErr := processStream(context.Background(), file, hash, num, size, 0, nil, nil, lateShards{})
+	var failed IndexErrors
+	count := 0
+	for ct := range results {
+		switch {
+		case ct.Index >= len(digests):
+			failed = append(failed, &IndexError{int64(ct.Index), fmt.Errorf("%w: shard %d not listed", ErrManifestMismatch, ct.Index)})
+		case !bytes.Equal(ct.Value, digests[ct.Index]):
+			failed = append(failed, &IndexError{int64(ct.Index), ErrShardCorrupt{ct.Index}})
+		}
+		count++
+	}
+	if err := <-streamErr; err != nil {
+		return err
+	}
+	for i := count; i < len(digests); i++ {
+		failed = append(failed, &IndexError{int64(i), ErrMissingShard{i}})
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+//ManifestLengths read the original lengths of the shards from a manifest
+//manifestFile path to the manifest written by ProcessFile
+//return the byte length of the input chunk of each shard, in index order,
+//their sum is the length of the original file,
+//or an error if the manifest does not list the length of every shard
+func ManifestLengths(manifestFile string) ([]int64, error) {
+	mf, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening manifest", err)
+	}
+	defer mf.Close()
+	lines, err := newManifestReader(mf)
+	if err != nil {
+		return nil, err
+	}
+	lengths := []int64{}
+	for {
+		index, _, length, err := lines.next()
+		if err == io.EOF {
+			return lengths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if index != len(lengths) {
+			return nil, fmt.Errorf("manifest lists shard %d instead of %d", index, len(lengths))
+		}
+		if length < 0 {
+			return nil, fmt.Errorf("manifest does not list the length of shard %d", index)
+		}
+		lengths = append(lengths, length)
+	}
+}
+
+//NewLengthRestorer build a process function that cuts each shard to its original length
+//manifestFile path to the manifest written when the shards were produced,
+//typically by encryption
+//chain it after the decryptor, so that padding added to the shards is
+//dropped and the output has exactly the length of the original file,
+//even when the last chunk was a single byte
+//the process function fails if a shard is not listed in the manifest or is
+//shorter than its original length, aborting ProcessFile
+//return the process function, or an error if the manifest lacks the lengths
+func NewLengthRestorer(manifestFile string) (ProcessFunc, error) {
+	lengths, err := ManifestLengths(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	return func(inp Shard) (Shard, error) {
+		if inp.Index < 0 || inp.Index >= len(lengths) {
+			return Shard{}, errors.New("not listed in the manifest")
+		}
+		if int64(len(inp.Value)) < lengths[inp.Index] {
+			return Shard{}, errors.New("shorter than its original length")
+		}
+		return Shard{inp.Index, inp.Value[:lengths[inp.Index]]}, nil
+	}, nil
+}
@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyManifestSequentialParallel(t *testing.T) {
+	tests := []struct {
+		name string
+		//damage change the data file written with its manifest
+		damage func(data []byte) []byte
+		//size size given to the verifiers, 10 as written
+		size int
+		want error
+		//wantIndex index named by the error of a damaged shard, -1 for none
+		wantIndex int
+	}{
+		{"intact", func(data []byte) []byte { return data }, 10, nil, -1},
+		{"corrupt shard", func(data []byte) []byte {
+			data[55] ^= 1
+			return data
+		}, 10, ErrShardCorrupt{5}, 5},
+		{"missing shards", func(data []byte) []byte { return data[:980] }, 10, ErrMissingShard{98}, 98},
+		{"shard not listed", func(data []byte) []byte { return append(data, 1, 2, 3) }, 10, ErrManifestMismatch, 100},
+		{"negative size", func(data []byte) []byte { return data }, -1, ErrInvalidSize, -1},
+	}
+	verifiers := []struct {
+		name   string
+		verify func(data, manifest string, size int) error
+	}{
+		{"sequential", VerifyManifest},
+		{"parallel", func(data, manifest string, size int) error {
+			return VerifyManifestParallel(data, manifest, 4, size)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 1000)
+			out := filepath.Join(filepath.Dir(in), "out")
+			if _, err := ProcessFile(context.Background(), in, out, identity, 4, 10, false, true, false, WriteTruncate, nil); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(out, tt.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			//both verifiers give the same answer for the same file
+			for _, v := range verifiers {
+				err := v.verify(out, out+ManifestSuffix, tt.size)
+				if !errors.Is(err, tt.want) {
+					t.Errorf("%s: err = %v, want %v", v.name, err, tt.want)
+				}
+				if tt.wantIndex < 0 {
+					continue
+				}
+				var corrupt ErrShardCorrupt
+				var missing ErrMissingShard
+				switch {
+				case errors.As(tt.want, &corrupt):
+					if !errors.As(err, &corrupt) || corrupt.Index != tt.wantIndex {
+						t.Errorf("%s: err = %v, want shard %d corrupt", v.name, err, tt.wantIndex)
+					}
+				case errors.As(tt.want, &missing):
+					if !errors.As(err, &missing) || missing.Index != tt.wantIndex {
+						t.Errorf("%s: err = %v, want shard %d missing", v.name, err, tt.wantIndex)
+					}
+				}
+			}
+		})
+	}
+	//a framed file is verified with size 0 by both
+	in := writeInput(t, 1000)
+	out := filepath.Join(filepath.Dir(in), "framed")
+	if _, err := ProcessFile(context.Background(), in, out, identity, 4, 10, true, true, false, WriteTruncate, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range verifiers {
+		if err := v.verify(out, out+ManifestSuffix, 0); err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		}
+	}
+}
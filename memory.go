@@ -0,0 +1,57 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+//SmallInput size in bytes up to which ProcessBytes processes the chunks
+//sequentially on the calling goroutine: for a few KB the goroutines and
+//channels of ProcessStream cost more than they gain, above it the chunks are
+//processed concurrently as in ProcessReader
+var SmallInput = 64 * 1024
+
+//ProcessBytes process data already in memory
+//data data to process, left unchanged
+//process function that processes each chunk
+//size size of chunks to process, it must be positive
+//the processed shards are concatenated as they are, as ProcessReader does
+//with framed false, so for shards changing length use ProcessReader with a
+//bytes.Reader and framed true
+//return the processed data, empty if data is, or the first error encountered
+//processing a chunk, or an error wrapping ErrVariableLength if a shard but
+//the last has a different length, whatever the size of data
+func ProcessBytes(data []byte, process ProcessFunc, size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	if len(data) > SmallInput {
+		var out bytes.Buffer
+		out.Grow(len(data))
+		if err := ProcessReader(context.Background(), bytes.NewReader(data), &out, process, 0, size, false, nil); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	}
+	//the process function owns its input, so it works on a copy
+	input := append([]byte(nil), data...)
+	out := make([]byte, 0, len(data))
+	width := newWidthCheck()
+	for i := 0; i*size < len(input); i++ {
+		end := (i + 1) * size
+		if end > len(input) {
+			end = len(input)
+		}
+		//the capacity is cut so that appending to a chunk cannot overwrite the next
+		ct, err := safeProcess(process, Shard{i, input[i*size : end : end]})
+		if err != nil {
+			return nil, err
+		}
+		if err := width.check(ct); err != nil {
+			return nil, err
+		}
+		out = append(out, ct.Value...)
+	}
+	return out, nil
+}
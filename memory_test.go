@@ -0,0 +1,43 @@
+package ledger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestProcessBytesVariableLength(t *testing.T) {
+	//resize change the length of shard index to n bytes
+	resize := func(index, n int) ProcessFunc {
+		return func(inp Shard) (Shard, error) {
+			if inp.Index == index {
+				inp.Value = bytes.Repeat([]byte{1}, n)
+			}
+			return inp, nil
+		}
+	}
+	processes := []struct {
+		name    string
+		process func(shards int) ProcessFunc
+		err     error
+	}{
+		{"same length", func(int) ProcessFunc { return identity }, nil},
+		{"longer shard", func(int) ProcessFunc { return resize(1, 150) }, ErrVariableLength},
+		{"shorter shard in the middle", func(int) ProcessFunc { return resize(1, 50) }, ErrVariableLength},
+		{"shorter last shard", func(shards int) ProcessFunc { return resize(shards-1, 50) }, nil},
+		{"longer last shard", func(shards int) ProcessFunc { return resize(shards-1, 150) }, ErrVariableLength},
+	}
+	//the small inputs take the sequential path, the large the concurrent one
+	for _, length := range []int{1000, SmallInput/100*100 + 1000} {
+		for _, tt := range processes {
+			t.Run(fmt.Sprintf("%s, %d bytes", tt.name, length), func(t *testing.T) {
+				data := bytes.Repeat([]byte{7}, length)
+				_, err := ProcessBytes(data, tt.process(length/100), 100)
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+			})
+		}
+	}
+}
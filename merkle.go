@@ -0,0 +1,200 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+)
+
+//MerkleTree binary hash tree over the shards of a file
+//each leaf is SHA-256(0x00 || shard), in index order, each internal node is
+//SHA-256(0x01 || left || right), and a node without sibling is promoted
+//to the upper level as it is; the prefixes, as in RFC 6962, keep a leaf
+//from passing for an internal node; NewMerkleTreeWithHash uses another algorithm
+type MerkleTree struct {
+	//levels from the leaves (levels[0]) to the root (last level)
+	levels [][][]byte
+	//number of shards
+	count int
+}
+
+//merkleNode compute the hash of an internal node
+//hf hash algorithm of the tree
+//left hash of the left child
+//right hash of the right child
+//return hash(0x01 || left || right)
+func merkleNode(hf HashFunc, left, right []byte) []byte {
+	h := hf.orDefault().New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+//MerkleLeaf compute the leaf of a shard
+//hf hash algorithm of the tree, the zero value for HashSHA256
+//value content of the processed shard
+//return hash(0x00 || value)
+func MerkleLeaf(hf HashFunc, value []byte) []byte {
+	h := hf.orDefault().New()
+	h.Write([]byte{0})
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+//NewMerkleTree build the tree over the given leaves
+//leaves hashes of the shards in index order (see MerkleLeaf with HashSHA256)
+//return the tree, whose root is SHA-256 of the empty string if there are no leaves
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+	return NewMerkleTreeWithHash(leaves, HashSHA256)
+}
+
+//NewMerkleTreeWithHash build the tree over the given leaves, as NewMerkleTree
+//leaves hashes of the shards in index order, computed by MerkleLeaf with hf
+//hf hash algorithm of the leaves and of the nodes
+//return the tree, whose root is the hash of the empty string if there are no leaves
+func NewMerkleTreeWithHash(leaves [][]byte, hf HashFunc) *MerkleTree {
+	if len(leaves) == 0 {
+		return &MerkleTree{[][][]byte{{hf.Sum(nil)}}, 0}
+	}
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(hf, level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &MerkleTree{levels, len(leaves)}
+}
+
+//Root root hash of the tree, the commitment to all the shards
+func (tree *MerkleTree) Root() []byte {
+	return tree.levels[len(tree.levels)-1][0]
+}
+
+//MerkleProof compute the inclusion proof of a shard
+//index index of the shard
+//return the sibling hashes from the leaf level up to the root, levels
+//where the node is promoted without sibling are skipped
+func (tree *MerkleTree) MerkleProof(index int) ([][]byte, error) {
+	if index < 0 || index >= tree.count {
+		return nil, fmt.Errorf("%w: no leaf %d", ErrInvalidIndex, index)
+	}
+	var proof [][]byte
+	for _, level := range tree.levels[:len(tree.levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+//VerifyMerkleProof check the inclusion proof of a shard
+//root root hash the shard should be committed to
+//leaf leaf of the shard (see MerkleLeaf)
+//index index of the shard
+//count number of shards in the tree
+//proof sibling hashes returned by MerkleProof
+//return true if the proof links the leaf at index to root
+func VerifyMerkleProof(root, leaf []byte, index, count int, proof [][]byte) bool {
+	return VerifyMerkleProofWithHash(HashSHA256, root, leaf, index, count, proof)
+}
+
+//VerifyMerkleProofWithHash check the inclusion proof of a shard in a tree
+//built by NewMerkleTreeWithHash, as VerifyMerkleProof
+//hf hash algorithm of the tree
+//other parameters as in VerifyMerkleProof
+//return true if the proof links the leaf at index to root
+func VerifyMerkleProofWithHash(hf HashFunc, root, leaf []byte, index, count int, proof [][]byte) bool {
+	if index < 0 || index >= count {
+		return false
+	}
+	node := leaf
+	for width := count; width > 1; width = (width + 1) / 2 {
+		sibling := index ^ 1
+		if sibling < width {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				node = merkleNode(hf, node, proof[0])
+			} else {
+				node = merkleNode(hf, proof[0], node)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+	return len(proof) == 0 && bytes.Equal(node, root)
+}
+
+//BuildMerkleTree build the tree over the shards of a processed file
+//filePath path to the file written by ProcessFile
+//size size of the shards if the file is not framed
+//framed true if the file was written with framed shards
+//hf hash algorithm of the tree, the zero value for HashSHA256
+//return the same tree whose root was returned by ProcessFileWithCommitment
+//with the same hf
+func BuildMerkleTree(filePath string, size int, framed bool, hf HashFunc) (*MerkleTree, error) {
+	if !framed && size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	defer file.Close()
+	shards := make(chan Shard)
+	readErr := make(chan error, 1)
+	go func() {
+		if framed {
+			readErr <- ReadFramesFrom(context.Background(), file, shards)
+		} else {
+			readErr <- ReadChunksFrom(context.Background(), file, shards, size)
+		}
+	}()
+	var leaves [][]byte
+	for ct := range shards {
+		leaves = append(leaves, MerkleLeaf(hf, ct.Value))
+	}
+	if err := <-readErr; err != nil {
+		return nil, err
+	}
+	return NewMerkleTreeWithHash(leaves, hf.orDefault()), nil
+}
+
+//ProcessFileWithCommitment process a file as ProcessFile and commit to the result
+//hf hash algorithm of the tree and of the manifest, the zero value for HashSHA256
+//other parameters as in ProcessFile
+//the leaves are hashed in index order as the shards are written, so the
+//root does not depend on how the workers are scheduled
+//return the Merkle root of the written shards (see MerkleTree)
+func ProcessFileWithCommitment(ctx context.Context, inputFile, outputFile string, process ProcessFunc, num, size int, framed, manifest bool, hf HashFunc, mode WriteMode, progress ProgressFunc) (rootHash []byte, err error) {
+	var leaves [][]byte
+	observe := func(ct Shard) error {
+		leaves = append(leaves, MerkleLeaf(hf, ct.Value))
+		return nil
+	}
+	_, err = processFile(ctx, inputFile, outputFile, process, ProcessOptions{
+		Workers:   num,
+		ChunkSize: size,
+		Framed:    framed,
+		Manifest:  manifest,
+		Hash:      hf,
+		Mode:      mode,
+		Progress:  progress,
+	}, observe)
+	if err != nil {
+		return nil, err
+	}
+	return NewMerkleTreeWithHash(leaves, hf.orDefault()).Root(), nil
+}
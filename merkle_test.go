@@ -0,0 +1,111 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestMerkleLeaf(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"empty", []byte{}},
+		{"one byte", []byte{1}},
+		{"shard", bytes.Repeat([]byte("shard"), 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := sha256.Sum256(append([]byte{0}, tt.value...))
+			if got := MerkleLeaf(HashFunc{}, tt.value); !bytes.Equal(got, want[:]) {
+				t.Errorf("leaf %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestMerkleLeafNotNode(t *testing.T) {
+	left, right := MerkleLeaf(HashSHA256, []byte("left")), MerkleLeaf(HashSHA256, []byte("right"))
+	tree := NewMerkleTree([][]byte{left, right})
+	//a shard holding the content of an internal node does not hash to it
+	forged := append(append([]byte{1}, left...), right...)
+	if bytes.Equal(MerkleLeaf(HashSHA256, forged), tree.Root()) {
+		t.Fatal("leaf of a forged shard equals the root")
+	}
+	if VerifyMerkleProof(tree.Root(), MerkleLeaf(HashSHA256, forged), 0, 1, nil) {
+		t.Fatal("forged shard verified as a tree of one shard")
+	}
+}
+
+func TestMerkleCommitment(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		framed bool
+		hf     HashFunc
+	}{
+		{"empty", 0, false, HashFunc{}},
+		{"one shard", 500, false, HashFunc{}},
+		{"odd shards", 4500, false, HashFunc{}},
+		{"framed", 4500, true, HashFunc{}},
+		{"SHA3-256", 4500, false, HashSHA3_256},
+		{"Keccak-256", 4500, false, HashKeccak256},
+		{"BLAKE2b-256", 4500, true, HashBLAKE2b256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, tt.length)
+			out := filepath.Join(filepath.Dir(in), "out")
+			root, err := ProcessFileWithCommitment(context.Background(), in, out, identity, 4, 1000, tt.framed, true, tt.hf, WriteTruncate, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, err := BuildMerkleTree(out, 1000, tt.framed, tt.hf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tree.Root(), root) {
+				t.Fatalf("root %x, committed %x", tree.Root(), root)
+			}
+			//the manifest is written with the same algorithm
+			size := 1000
+			if tt.framed {
+				size = 0
+			}
+			if err := VerifyManifest(out, out+ManifestSuffix, size); err != nil {
+				t.Fatal(err)
+			}
+			if tt.hf.New != nil && tt.length > 0 {
+				tree, err := BuildMerkleTree(out, 1000, tt.framed, HashFunc{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(tree.Root(), root) {
+					t.Fatal("same root with SHA-256")
+				}
+			}
+			data, err := ioutil.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shards := (tt.length + 999) / 1000
+			for i := 0; i < shards; i++ {
+				value := data[i*1000:]
+				if len(value) > 1000 {
+					value = value[:1000]
+				}
+				proof, err := tree.MerkleProof(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !VerifyMerkleProofWithHash(tt.hf.orDefault(), root, MerkleLeaf(tt.hf, value), i, shards, proof) {
+					t.Errorf("proof of shard %d rejected", i)
+				}
+			}
+		})
+	}
+}
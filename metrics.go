@@ -0,0 +1,171 @@
+package ledger
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+//Metrics counters of a run, updated atomically while it goes on so that
+//they can be read at any time from another goroutine (see Snapshot)
+//pass it in ProcessOptions.Metrics; a Metrics describes a single run at a time
+type Metrics struct {
+	//all the fields are accessed with sync/atomic, the 64 bit ones first
+	//to keep them aligned on 32 bit platforms
+	start           int64
+	bytesRead       int64
+	bytesWritten    int64
+	shardsRead      int64
+	shardsProcessed int64
+	shardsWritten   int64
+	busyWorkers     int64
+	workers         int64
+}
+
+//MetricsSnapshot values of the Metrics of a run at a given time
+type MetricsSnapshot struct {
+	//Elapsed time since the run started
+	Elapsed time.Duration
+	//BytesRead bytes read from the input
+	BytesRead int64
+	//BytesWritten bytes written on the output, length prefixes included
+	BytesWritten int64
+	//ShardsRead shards handed to the workers
+	ShardsRead int64
+	//ShardsWritten shards written on the output
+	ShardsWritten int64
+	//InFlight shards handed to the workers and not yet written
+	InFlight int64
+	//WriteQueue shards processed and waiting to be written, either for a
+	//slower shard with lower index or for the writer
+	WriteQueue int64
+	//BusyWorkers workers processing a shard
+	BusyWorkers int64
+	//Workers workers of the run
+	Workers int64
+}
+
+//Snapshot read the current values of the metrics
+//InFlight and WriteQueue tell where a run is slow: a full write queue means
+//a slow writer, busy workers with an empty queue slow processing, and idle
+//workers a slow input
+//return the values, read one by one, so they can be slightly inconsistent
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		BytesRead:     atomic.LoadInt64(&m.bytesRead),
+		BytesWritten:  atomic.LoadInt64(&m.bytesWritten),
+		ShardsRead:    atomic.LoadInt64(&m.shardsRead),
+		ShardsWritten: atomic.LoadInt64(&m.shardsWritten),
+		BusyWorkers:   atomic.LoadInt64(&m.busyWorkers),
+		Workers:       atomic.LoadInt64(&m.workers),
+	}
+	if start := atomic.LoadInt64(&m.start); start != 0 {
+		s.Elapsed = time.Since(time.Unix(0, start))
+	}
+	s.InFlight = s.ShardsRead - s.ShardsWritten
+	s.WriteQueue = atomic.LoadInt64(&m.shardsProcessed) - s.ShardsWritten
+	if s.InFlight < 0 {
+		s.InFlight = 0
+	}
+	if s.WriteQueue < 0 {
+		s.WriteQueue = 0
+	}
+	return s
+}
+
+//ReadRate bytes read per second since the start of the run
+func (s MetricsSnapshot) ReadRate() float64 {
+	return perSecond(s.BytesRead, s.Elapsed)
+}
+
+//WriteRate bytes written per second since the start of the run
+func (s MetricsSnapshot) WriteRate() float64 {
+	return perSecond(s.BytesWritten, s.Elapsed)
+}
+
+//Utilization fraction of the workers processing a shard, between 0 and 1
+func (s MetricsSnapshot) Utilization() float64 {
+	if s.Workers == 0 {
+		return 0
+	}
+	return float64(s.BusyWorkers) / float64(s.Workers)
+}
+
+//perSecond rate of a counter
+//count value of the counter
+//elapsed time taken to reach it
+//return count per second, 0 if no time elapsed
+func perSecond(count int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+//begin reset the metrics at the start of a run
+//workers number of workers of the run
+func (m *Metrics) begin(workers int) {
+	if m == nil {
+		return
+	}
+	for _, counter := range []*int64{&m.bytesRead, &m.bytesWritten, &m.shardsRead, &m.shardsProcessed, &m.shardsWritten, &m.busyWorkers} {
+		atomic.StoreInt64(counter, 0)
+	}
+	atomic.StoreInt64(&m.workers, int64(workers))
+	atomic.StoreInt64(&m.start, time.Now().UnixNano())
+}
+
+//reader count the bytes read from r
+//r input of the run
+//return r, wrapped if m is not nil
+func (m *Metrics) reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return countingReader{r, &m.bytesRead}
+}
+
+//startShard record that a worker took a shard
+func (m *Metrics) startShard() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.shardsRead, 1)
+	atomic.AddInt64(&m.busyWorkers, 1)
+}
+
+//endShard record that a worker finished a shard
+//processed true if the shard was processed and goes on to the writer
+func (m *Metrics) endShard(processed bool) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.busyWorkers, -1)
+	if processed {
+		atomic.AddInt64(&m.shardsProcessed, 1)
+	}
+}
+
+//written record a shard written
+//bytes bytes written for the shard
+func (m *Metrics) written(bytes int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesWritten, bytes)
+	atomic.AddInt64(&m.shardsWritten, 1)
+}
+
+//countingReader reader adding the bytes read to a counter
+type countingReader struct {
+	//r underlying reader
+	r io.Reader
+	//count counter, updated atomically
+	count *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
@@ -0,0 +1,64 @@
+//go:build prometheus
+// +build prometheus
+
+package ledger
+
+import "github.com/prometheus/client_golang/prometheus"
+
+//metricsCollector prometheus.Collector exporting a Metrics
+type metricsCollector struct {
+	//metrics metrics exported
+	metrics *Metrics
+	//descriptors of the exported metrics
+	bytesRead, bytesWritten, shardsRead, shardsWritten *prometheus.Desc
+	inFlight, writeQueue, busyWorkers, workers         *prometheus.Desc
+}
+
+//NewMetricsCollector build a Prometheus collector of the metrics of a run
+//metrics metrics to export, read with Snapshot at every scrape
+//namespace prefix of the names of the exported metrics, can be empty
+//it is only built with the prometheus build tag, so that the package does
+//not depend on the Prometheus client otherwise
+//return the collector, to register with prometheus.MustRegister
+func NewMetricsCollector(metrics *Metrics, namespace string) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "ledger", name), help, nil, nil)
+	}
+	return &metricsCollector{
+		metrics:       metrics,
+		bytesRead:     desc("read_bytes_total", "Bytes read from the input."),
+		bytesWritten:  desc("written_bytes_total", "Bytes written on the output."),
+		shardsRead:    desc("read_shards_total", "Shards handed to the workers."),
+		shardsWritten: desc("written_shards_total", "Shards written on the output."),
+		inFlight:      desc("shards_in_flight", "Shards handed to the workers and not yet written."),
+		writeQueue:    desc("write_queue_shards", "Shards processed and waiting to be written."),
+		busyWorkers:   desc("busy_workers", "Workers processing a shard."),
+		workers:       desc("workers", "Workers of the run."),
+	}
+}
+
+//Describe send the descriptors of the exported metrics
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.bytesRead, c.bytesWritten, c.shardsRead, c.shardsWritten, c.inFlight, c.writeQueue, c.busyWorkers, c.workers} {
+		ch <- d
+	}
+}
+
+//Collect send the current values of the metrics
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.metrics.Snapshot()
+	counter := func(d *prometheus.Desc, value int64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(value))
+	}
+	gauge := func(d *prometheus.Desc, value int64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(value))
+	}
+	counter(c.bytesRead, s.BytesRead)
+	counter(c.bytesWritten, s.BytesWritten)
+	counter(c.shardsRead, s.ShardsRead)
+	counter(c.shardsWritten, s.ShardsWritten)
+	gauge(c.inFlight, s.InFlight)
+	gauge(c.writeQueue, s.WriteQueue)
+	gauge(c.busyWorkers, s.BusyWorkers)
+	gauge(c.workers, s.Workers)
+}
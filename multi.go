@@ -0,0 +1,95 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+//ProcessFiles process several files concurrently into a single output file
+//inputs paths to the input files, processed in the given order
+//outputFile path to output file, it must be different from every input
+//process function that processes each chunk
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of chunks to process
+//the shard indices increase across the files, and each file starts a new
+//chunk: if a file does not end on a chunk boundary its last chunk is
+//shorter, and the next file is not mixed into it, so the output is the
+//concatenation of the outputs of ProcessFile on each file, with the indices
+//of each file following those of the previous one; since the shards are
+//written unframed, values after a shorter chunk are not aligned to size
+//the output is synced to stable storage before returning
+//return the first error encountered reading the inputs or writing the output
+func ProcessFiles(inputs []string, outputFile string, process ProcessFunc, num, size int) (err error) {
+	if size <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	//the output is overwritten, so it cannot be one of the inputs
+	if ofi, err := os.Stat(outputFile); err == nil {
+		for _, inputFile := range inputs {
+			if ifi, err := os.Stat(inputFile); err == nil && os.SameFile(ifi, ofi) {
+				return errors.New("input and output are the same file")
+			}
+		}
+	}
+	//open output file
+	out, err := os.OpenFile(outputFile, WriteTruncate.openFlags(), OutputPerm)
+	if err != nil {
+		return fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//close output on exit
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fileError(ErrCloseOutput, "error closing file", cerr)
+		}
+	}()
+	//index of the first shard of the next file
+	first := 0
+	for _, inputFile := range inputs {
+		written, err := processInto(inputFile, out, process, num, size, first)
+		if err != nil {
+			return err
+		}
+		first += written
+	}
+	//report success only once the output is durable
+	if err := syncOutput(out); err != nil {
+		return err
+	}
+	logln("file written successfully!")
+	return nil
+}
+
+//processInto process a file appending the result to an open output
+//inputFile path to input file
+//out output file, positioned where the result is written
+//process function that processes each chunk
+//num number of chunks to process concurrently
+//size size of chunks to process
+//first index of the first shard of the file
+//return the number of shards written, or the first error encountered
+func processInto(inputFile string, out *os.File, process ProcessFunc, num, size, first int) (int, error) {
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return 0, err
+	}
+	//close file on exit
+	defer file.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buffers := newChunkBuffers(size)
+	results, streamErr := processStream(ctx, file, process, num, size, first, buffers, nil, lateShards{})
+	written := 0
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writeOrdered(results, out, first, false, -1, func(shardsDone, _ int, _ int64) {
+			written = shardsDone
+		}, cancel, buffers)
+	}()
+	if err := waitProcessing(context.Background(), streamErr, writeErr); err != nil {
+		return 0, fmt.Errorf("%s: %w", inputFile, err)
+	}
+	return written, nil
+}
@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"os"
+	"time"
+)
+
+//DefaultChunkSize chunk size used when ProcessOptions.ChunkSize is 0
+const DefaultChunkSize = 4096
+
+//ProcessOptions settings of ProcessFileWithOptions
+//the zero value of every field selects its default, so that only the
+//settings that differ from the defaults need to be given
+type ProcessOptions struct {
+	//Workers number of chunks to process concurrently, 0 for runtime.NumCPU();
+	//fewer are started for small files, see MinShardsPerWorker
+	Workers int
+	//ChunkSize size of chunks to process, 0 for DefaultChunkSize
+	ChunkSize int
+	//Framed write each processed shard prefixed by its length, necessary if
+	//the process function changes the length of the shards
+	Framed bool
+	//Manifest also write outputFile+ManifestSuffix (see ProcessFile)
+	Manifest bool
+	//Hash algorithm of the digests in the manifest, recorded in it so that
+	//VerifyManifest uses the same, the zero value for HashSHA256
+	Hash HashFunc
+	//Resume checkpoint the shards written and continue an interrupted run
+	//(see ProcessFile)
+	Resume bool
+	//Mode how an existing output file is treated, WriteTruncate by default
+	Mode WriteMode
+	//Perm permissions of the output file and manifest if they are created,
+	//0 for OutputPerm
+	Perm os.FileMode
+	//Progress callback reporting the writing progress, nil for none
+	Progress ProgressFunc
+	//NoSync return without flushing the output and manifest to stable
+	//storage: by default they are synced, with their directory, before
+	//success is reported, so that a crash right after cannot lose them;
+	//skipping the sync saves a few milliseconds per run on disks and more
+	//on network storage, but suits only runs that can be redone
+	NoSync bool
+	//Retry policy of the writes that fail with transient errors, the zero
+	//value for WriteRetry
+	Retry RetryPolicy
+	//Metrics counters updated during the run, to be read concurrently with
+	//Metrics.Snapshot, nil for none
+	Metrics *Metrics
+	//BytesPerSecond maximum rate at which the input is read, 0 for no limit;
+	//the rest of the pipeline is slowed by backpressure, so it caps the use
+	//of the disk and of the CPU without buffering more shards
+	BytesPerSecond int64
+	//InputHash hash written with every byte of the input, in order, as it
+	//is read for processing, nil for none: once the run succeeds its Sum is
+	//the digest of the whole input, obtained without a second pass, which a
+	//resumed run completes reading the part processed before
+	InputHash hash.Hash
+	//FlushTimeout time waited for the next shard in index order once the
+	//previous one is yielded, reading and processing it, 0 to wait
+	//indefinitely: a later shard aborts the run with ErrShardTimeout, so a
+	//stuck process function is detected instead of the following shards
+	//being buffered up to MaxReorder; the run returns at once, leaving the
+	//stuck call running, as ShardTimeout does
+	FlushTimeout time.Duration
+	//ShardTimeout time allowed to the process function for a single shard,
+	//0 for no limit: a call running longer aborts the run with an
+	//IndexError naming the shard and wrapping ErrShardTimeout, so that a
+	//call that never returns, as one to an unresponsive HSM, does not hang
+	//the run; the call itself cannot be interrupted and is left running
+	ShardTimeout time.Duration
+	//SkipLate with FlushTimeout, go on without a late shard instead of
+	//failing, as soon as some following shard is processed, and list it in
+	//Result.Skipped; only ProcessFileToSink supports it, since a file cannot
+	//have gaps; the run still ends only once every call to the process
+	//function has returned, skipped shards included, so it needs a process
+	//function that eventually returns, and a late last shard is waited for
+	//since no following shard shows that it is late
+	SkipLate bool
+	//Preallocate expected size of the output, reserved on disk before the
+	//processing starts (see OutputSize), 0 for none: a full disk then
+	//fails the run at once, not hours later; the reservation does not
+	//change the size of the file and is a no-op outside Linux
+	Preallocate int64
+	//MaxOutputSize maximum size of the output, 0 for no limit: a write that
+	//would grow it past the limit aborts the run with ErrOutputTooLarge,
+	//as a safety valve against a runaway input
+	MaxOutputSize int64
+	//Zeroize key material handed over to the run, for example the
+	//KeyedProcess used as process function: each is zeroized when the run
+	//returns, successful or not, nil for none
+	Zeroize []Zeroizer
+	//clock clock of FlushTimeout, BytesPerSecond and Retry, nil for the
+	//system clock, replaced to drive their timing in the tests
+	clock clock
+}
+
+//withDefaults replace the zero settings with their defaults
+//return the settings, or an error wrapping ErrInvalidSize if ChunkSize is negative
+func (opts ProcessOptions) withDefaults() (ProcessOptions, error) {
+	if opts.ChunkSize < 0 {
+		return opts, fmt.Errorf("%w: %d", ErrInvalidSize, opts.ChunkSize)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.Perm == 0 {
+		opts.Perm = OutputPerm
+	}
+	opts.Retry = opts.Retry.orDefault()
+	return opts, nil
+}
+
+//ProcessFileWithOptions read file and process it concurrently
+//then collect results and write on file, as ProcessFile
+//ctx context to cancel the processing
+//inputFile path to input file, it must be a regular file (see ErrNotRegular)
+//outputFile path to output file, it must be different from inputFile
+//process function that processes each chunk
+//opts settings of the processing, ProcessOptions{} for the defaults
+//return what was written, or the first error encountered reading the input
+//or writing the output
+func ProcessFileWithOptions(ctx context.Context, inputFile, outputFile string, process ProcessFunc, opts ProcessOptions) (Result, error) {
+	defer zeroizeAll(opts.Zeroize)
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return Result{}, err
+	}
+	return processFile(ctx, inputFile, outputFile, process, opts)
+}
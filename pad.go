@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+//padMarker byte closing the value of a padded shard, followed by zeros
+const padMarker = 0x80
+
+//ErrBadPadding a shard does not end with the padding of NewPadder
+var ErrBadPadding = errors.New("invalid padding")
+
+//NewPadder build a process function that pads each shard to a multiple of
+//a bucket size, so that the ciphertext length reveals only the bucket
+//bucket size of the buckets, for example 256
+//chain it before the encryption, for example Chain(NewPadder(256), enc), and
+//NewUnpadder after the decryption: the value is followed by the byte 0x80
+//and by zeros up to the next multiple of bucket, so a value of len bytes
+//becomes (len/bucket+1)*bucket bytes long and the padding can be stripped
+//exactly without storing the original length
+//the shards of different buckets have different lengths, so the output must
+//be written with framed shards unless all the chunks fall in the same one
+//return the process function, or an error wrapping ErrInvalidSize if bucket
+//is not positive
+func NewPadder(bucket int) (ProcessFunc, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, bucket)
+	}
+	return func(inp Shard) (Shard, error) {
+		return pad(inp, (len(inp.Value)/bucket+1)*bucket), nil
+	}, nil
+}
+
+//NewPowerOfTwoPadder build a process function that pads each shard to the
+//next power of two, as NewPadder but with buckets growing with the values
+//a value of len bytes becomes the smallest power of two above len, so the
+//overhead is at most the length of the value and the lengths of the
+//ciphertexts are only logarithmic in the range of the plaintext lengths
+//return the process function
+func NewPowerOfTwoPadder() ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		return pad(inp, 1<<bits.Len(uint(len(inp.Value)))), nil
+	}
+}
+
+//pad append the padding to a shard
+//inp shard to pad
+//length padded length, greater than the length of the value
+//return the padded shard, reusing the array of the value if large enough
+func pad(inp Shard, length int) Shard {
+	padded := append(inp.Value, padMarker)
+	for len(padded) < length {
+		padded = append(padded, 0)
+	}
+	return Shard{inp.Index, padded}
+}
+
+//NewUnpadder build a process function that strips the padding of NewPadder
+//or NewPowerOfTwoPadder
+//the process function fails with an error wrapping ErrBadPadding if a shard
+//does not end with 0x80 followed only by zeros, aborting ProcessFile
+//return the process function
+func NewUnpadder() ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		end := len(inp.Value) - 1
+		for end >= 0 && inp.Value[end] == 0 {
+			end--
+		}
+		if end < 0 || inp.Value[end] != padMarker {
+			return Shard{}, ErrBadPadding
+		}
+		return Shard{inp.Index, inp.Value[:end]}, nil
+	}
+}
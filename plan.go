@@ -0,0 +1,61 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//Plan check that a file can be processed, without processing it
+//inputFile path to input file
+//outputFile path to output file, it must be different from inputFile
+//size size of chunks to process
+//the input must be readable and the output writable, either as an existing
+//file, which is left untouched, or as a new file in its directory;
+//a warning is logged if the last chunk is partial
+//return the number of shards the processing would produce and the byte size
+//of the input, or the first problem found
+func Plan(inputFile, outputFile string, size int) (shards int, inputBytes int64, err error) {
+	if size <= 0 {
+		return 0, 0, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	//the input must be readable
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	ifi, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err = file.Read(make([]byte, 1)); err != nil && ifi.Size() > 0 {
+		return 0, 0, fileError(ErrReadInput, "error reading file", err)
+	}
+	//the output must be writable
+	if ofi, err := os.Stat(outputFile); err == nil {
+		if os.SameFile(ifi, ofi) {
+			return 0, 0, errors.New("input and output are the same file")
+		}
+		out, err := os.OpenFile(outputFile, os.O_WRONLY, 0)
+		if err != nil {
+			return 0, 0, fmt.Errorf("output not writable: %w", err)
+		}
+		out.Close()
+	} else {
+		tmp, err := ioutil.TempFile(filepath.Dir(outputFile), ".plan")
+		if err != nil {
+			return 0, 0, fmt.Errorf("output not writable: %w", err)
+		}
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	inputBytes = ifi.Size()
+	shards = int(shardCount(inputBytes, int64(size)))
+	if inputBytes%int64(size) != 0 {
+		logln(fmt.Sprintf("warning: the last chunk has %d bytes instead of %d", inputBytes%int64(size), size))
+	}
+	return shards, inputBytes, nil
+}
@@ -0,0 +1,71 @@
+package ledger
+
+import "sync"
+
+//chunkPools pools of chunk buffers, one *sync.Pool for each chunk size
+var chunkPools sync.Map
+
+//chunkBuffers pooled buffers of the chunks read by a run
+//a buffer is taken from the pool when its chunk is read and handed back
+//only once the shard processed from it has been written, since the process
+//function may return its input array (see ProcessFunc); the buffers of the
+//shards never written, as after an error, are left to the garbage collector
+//a nil *chunkBuffers allocates a fresh buffer for every chunk
+type chunkBuffers struct {
+	//pool of the buffers of the chunk size
+	pool *sync.Pool
+	//size of the chunks
+	size int
+	//mutex guarding held
+	mutex sync.Mutex
+	//buffers of the shards read and not yet written, by index
+	held map[int]*[]byte
+}
+
+//newChunkBuffers prepare the pooled buffers of a run
+//size size of the chunks, 0 for framed input
+//return the buffers, or nil if size is not positive since framed shards
+//have variable length
+func newChunkBuffers(size int) *chunkBuffers {
+	if size <= 0 {
+		return nil
+	}
+	pool, _ := chunkPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, size)
+			return &buffer
+		},
+	})
+	return &chunkBuffers{pool: pool.(*sync.Pool), size: size, held: make(map[int]*[]byte)}
+}
+
+//get take the buffer of a chunk
+//index index of the chunk
+//return a buffer of size bytes, owned by the shard of the given index
+func (b *chunkBuffers) get(index int) []byte {
+	if b == nil {
+		return nil
+	}
+	buffer := b.pool.Get().(*[]byte)
+	b.mutex.Lock()
+	b.held[index] = buffer
+	b.mutex.Unlock()
+	return (*buffer)[:b.size]
+}
+
+//release hand the buffer of a chunk back to the pool
+//index index of the shard just written
+//the buffer must not be referenced anymore, neither by the shard read nor
+//by the one processed from it
+func (b *chunkBuffers) release(index int) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	buffer, ok := b.held[index]
+	delete(b.held, index)
+	b.mutex.Unlock()
+	if ok {
+		b.pool.Put(buffer)
+	}
+}
@@ -0,0 +1,140 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+//invertInPlace process function inverting the bits of the input array and
+//returning it, so the output shares the buffer of the chunk
+func invertInPlace(inp Shard) (Shard, error) {
+	for i := range inp.Value {
+		inp.Value[i] = ^inp.Value[i]
+	}
+	return inp, nil
+}
+
+//copySink ShardSink concatenating copies of the shards
+type copySink struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (s *copySink) Put(index int, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data = append(s.data, data...)
+	return nil
+}
+
+//meant to be run with -race too: a buffer handed back to the pool before
+//its shard is written would be overwritten by a later chunk
+func TestChunkBuffersReturnedInput(t *testing.T) {
+	in := writeInput(t, 64*2000+17)
+	input, err := ioutil.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverted := append([]byte(nil), input...)
+	invertInPlace(Shard{0, inverted})
+	tests := []struct {
+		name    string
+		process ProcessFunc
+		want    []byte
+	}{
+		{"input returned", identity, input},
+		{"input modified and returned", invertInPlace, inverted},
+	}
+	out := filepath.Join(filepath.Dir(in), "out")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//the runs share the pool of the chunk size
+			for run := 0; run < 3; run++ {
+				if _, err := ProcessFile(context.Background(), in, out, tt.process, 8, 64, false, false, false, WriteTruncate, nil); err != nil {
+					t.Fatal(err)
+				}
+				output, err := ioutil.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(output, tt.want) {
+					t.Fatal("ProcessFile: output differs")
+				}
+				sink := &copySink{}
+				if _, err := ProcessFileToSink(context.Background(), in, sink, tt.process, ProcessOptions{Workers: 8, ChunkSize: 64}); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(sink.data, tt.want) {
+					t.Fatal("ProcessFileToSink: output differs")
+				}
+				if err := ioutil.WriteFile(out, input, 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := ProcessInPlace(out, tt.process, 8, 64); err != nil {
+					t.Fatal(err)
+				}
+				if output, err = ioutil.ReadFile(out); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(output, tt.want) {
+					t.Fatal("ProcessInPlace: output differs")
+				}
+			}
+		})
+	}
+}
+
+func TestChunkBuffersHeld(t *testing.T) {
+	b := newChunkBuffers(16)
+	//a buffer held by a shard is never handed to another one
+	first := b.get(0)
+	second := b.get(1)
+	if len(first) != 16 || len(second) != 16 || &first[0] == &second[0] {
+		t.Fatal("buffer shared by two held shards")
+	}
+	b.release(0)
+	b.release(1)
+	if len(b.held) != 0 {
+		t.Fatalf("%d buffers still held", len(b.held))
+	}
+	//releasing twice or a shard never read is harmless
+	b.release(0)
+	b.release(7)
+	if newChunkBuffers(0) != nil || newChunkBuffers(0).get(0) != nil {
+		t.Fatal("buffers pooled for framed input")
+	}
+}
+
+//benchBuffer keeps the buffers of the benchmarks on the heap
+var benchBuffer []byte
+
+func BenchmarkChunkBuffers(b *testing.B) {
+	const size = 64 * 1024
+	b.Run("pooled", func(b *testing.B) {
+		buffers := newChunkBuffers(size)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buffer := buffers.get(i)
+			buffer[0] = byte(i)
+			benchBuffer = buffer
+			buffers.release(i)
+		}
+	})
+	b.Run("allocated", func(b *testing.B) {
+		var buffers *chunkBuffers
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buffer := buffers.get(i)
+			if buffer == nil {
+				buffer = make([]byte, size)
+			}
+			buffer[0] = byte(i)
+			benchBuffer = buffer
+			buffers.release(i)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+//ErrOutputTooLarge the output would grow past ProcessOptions.MaxOutputSize
+var ErrOutputTooLarge = errors.New("output larger than the maximum size")
+
+//OutputSize size of the output of a fixed-size format, to be preallocated
+//inputSize size of the input file
+//size size of the input chunks
+//shardSize size of the processed shards of whole chunks, for example
+//AESGCMShardSize(size)
+//the final partial chunk is assumed to grow by the same shardSize-size bytes
+//return the size of the concatenated shards, or -1 if size is not positive
+func OutputSize(inputSize int64, size, shardSize int) int64 {
+	if size <= 0 {
+		return -1
+	}
+	full, rest := inputSize/int64(size), inputSize%int64(size)
+	total := full * int64(shardSize)
+	if rest > 0 {
+		total += rest + int64(shardSize-size)
+	}
+	return total
+}
+
+//preallocate reserve the disk space of the output before writing it
+//out output file
+//size bytes to reserve from the start of the file, 0 or negative for none
+//the space is reserved without changing the size of the file, where the
+//system supports it (see reserveSpace), so that a full disk is detected
+//before the processing starts and the file is less fragmented
+//return an error if the space cannot be reserved
+func preallocate(out *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	if err := reserveSpace(out, size); err != nil {
+		return fileError(ErrWriteOutput, fmt.Sprintf("error preallocating %d bytes", size), err)
+	}
+	return nil
+}
+
+//limitedWriter writer failing before writing past a limit
+type limitedWriter struct {
+	//w underlying writer
+	w io.Writer
+	//remaining bytes that can still be written
+	remaining int64
+	//limit total size allowed, for the error message
+	limit int64
+}
+
+//limitOutput limit the bytes written on a writer
+//w writer to limit
+//limit maximum total size of the output, 0 or negative for no limit
+//written bytes of the output already written, by a previous run
+//return the limited writer, or w itself if there is no limit
+func limitOutput(w io.Writer, limit, written int64) io.Writer {
+	if limit <= 0 {
+		return w
+	}
+	return &limitedWriter{w, limit - written, limit}
+}
+
+//Write write p, or nothing if it would exceed the limit
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, fmt.Errorf("%w: %d bytes", ErrOutputTooLarge, lw.limit)
+	}
+	n, err := lw.w.Write(p)
+	lw.remaining -= int64(n)
+	return n, err
+}
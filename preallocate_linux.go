@@ -0,0 +1,22 @@
+package ledger
+
+import (
+	"os"
+	"syscall"
+)
+
+//fallocKeepSize FALLOC_FL_KEEP_SIZE, reserve the blocks without extending
+//the file
+const fallocKeepSize = 0x1
+
+//reserveSpace reserve the blocks of the first size bytes of a file with
+//fallocate, keeping its size
+//file systems that do not support fallocate are not an error, the output
+//is then just written without reservation
+func reserveSpace(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
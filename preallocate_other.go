@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package ledger
+
+import "os"
+
+//reserveSpace reserve the blocks of the first size bytes of a file
+//no portable call reserves them without extending the file, which would
+//break the resuming of the runs, so nothing is done on these systems
+func reserveSpace(file *os.File, size int64) error {
+	return nil
+}
@@ -1,8 +1,7 @@
-package main
+package ledger
 
 import (
 	"crypto/rand"
-	"fmt"
 	"io/ioutil"
 
 	curve "github.com/gaetanorusso/public_ledger_sensitive_data/miracl/go/core/BN254"
@@ -53,7 +52,7 @@ func GenExp() *curve.BIG {
 	for curve.Comp(r, curve.NewBIGint(1)) <= 0 {
 		_, err := rand.Read(entropy)
 		if err != nil {
-			fmt.Println("Error generating random exponent:", err)
+			logln("Error generating random exponent:", err)
 			panic(err)
 		}
 		r = curve.FromBytes(entropy)
@@ -68,7 +67,7 @@ func GenExp() *curve.BIG {
 //s old time-key
 //sNew new time-key
 //returns shard struct with same index and the encoding of the new masking shard
-func shardUpdate(index int, old *curve.ECP2, s, sNew *curve.BIG) shard {
+func shardUpdate(index int, old *curve.ECP2, s, sNew *curve.BIG) Shard {
 	inv := curve.NewBIGcopy(s)
 	inv.Invmodp(ORDER)
 	new := curve.G2mul(old, sNew)
@@ -76,7 +75,7 @@ func shardUpdate(index int, old *curve.ECP2, s, sNew *curve.BIG) shard {
 	//encode
 	encoded := make([]byte, 2*curve.MODBYTES+1)
 	new.ToBytes(encoded, true)
-	return shard{index, string(encoded)}
+	return Shard{index, encoded}
 }
 
 //FracMult multiplies element for fraction num/den
@@ -155,7 +154,7 @@ func OneTimePad(data []byte, eps *curve.ECP2, key *curve.ECP) []byte {
 func FileDigest(filename string) []byte {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		fmt.Println("File reading error", err)
+		logln("File reading error", err)
 		return nil
 	}
 	h := Hash(data)
@@ -0,0 +1,125 @@
+package ledger
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+//decryptingReader serve the processed shards of a file one at a time
+type decryptingReader struct {
+	//file being read
+	file *os.File
+	//buffered reader of file
+	reader *bufio.Reader
+	//function applied to each shard
+	process ProcessFunc
+	//size of the shards, 0 if framed
+	size int
+	//index of the next shard to read
+	next int
+	//processed bytes not yet served
+	leftover []byte
+	//error to return once leftover is served, io.EOF at the end of the file
+	err error
+}
+
+//NewDecryptingReader open a file to read its processed shards as a stream
+//filePath path to the file written by ProcessFile
+//process function applied to each shard, typically a decryptor
+//size size of the shards, 0 if the file was written with framed shards
+//the shards are read and processed lazily, one at a time, as Read is called,
+//so that the file is never loaded whole in memory: the bytes of a shard that
+//do not fit in the buffer passed to Read are kept for the next calls
+//Read returns io.EOF only after the last byte of the last shard has been
+//served, an error wrapping ErrShortValue if the file is truncated, or the
+//error of a process function that fails or panics, as ProcessFile does
+//return the reader, to be closed after use, or the error opening the file
+func NewDecryptingReader(filePath string, process ProcessFunc, size int) (io.ReadCloser, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	return &decryptingReader{file: file, reader: bufio.NewReader(file), process: process, size: size}, nil
+}
+
+//Read serve the processed bytes, reading the next shard when needed
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.leftover) == 0 && d.err == nil {
+		d.leftover, d.err = d.readShard()
+	}
+	if len(d.leftover) == 0 {
+		return 0, d.err
+	}
+	n := copy(p, d.leftover)
+	d.leftover = d.leftover[n:]
+	return n, nil
+}
+
+//readShard read and process the next shard
+//return the processed value, or io.EOF if there are no more shards
+func (d *decryptingReader) readShard() ([]byte, error) {
+	length := int64(d.size)
+	if d.size == 0 {
+		var err error
+		length, err = readFrameHeader(d.reader, int64(d.next))
+		if err != nil {
+			return nil, err
+		}
+	}
+	buffer := make([]byte, length)
+	n, err := io.ReadFull(d.reader, buffer)
+	switch {
+	case n == 0 && d.size > 0 && (err == io.EOF || err == io.ErrUnexpectedEOF):
+		//no data left, even if the reader reports it as unexpected
+		return nil, io.EOF
+	case err == io.ErrUnexpectedEOF && d.size > 0:
+		//the last chunk can be shorter
+		buffer = buffer[:n]
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, fmt.Errorf("%w: value %d has %d of %d bytes", ErrShortValue, d.next, n, length)
+	case err != nil:
+		return nil, fileError(ErrReadInput, "error reading file", err)
+	}
+	pt, err := safeProcess(d.process, Shard{d.next, buffer})
+	if err != nil {
+		return nil, err
+	}
+	d.next++
+	return pt.Value, nil
+}
+
+//Close close the file
+func (d *decryptingReader) Close() error {
+	return d.file.Close()
+}
+
+//DecryptTo decrypt a file concurrently writing the plaintext on a writer
+//ctx context to cancel the processing
+//encryptedFile path to the file written by ProcessFile
+//w where to write the plaintext, for example a network connection
+//decrypt function that decrypts each shard
+//num number of shards to decrypt concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of the shards, 0 if the file was written with framed shards
+//the shards are decrypted concurrently but written on w strictly in index
+//order, so that w receives the same stream a sequential decryption would
+//write, though a failure can leave the part written before it on w
+//return the first error encountered reading, decrypting or writing
+func DecryptTo(ctx context.Context, encryptedFile string, w io.Writer, decrypt ProcessFunc, num, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	file, err := openRegular(encryptedFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	return ProcessReader(ctx, file, w, decrypt, num, size, false, nil)
+}
@@ -0,0 +1,87 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+//Reshard process a file again with a different chunk size, for example to
+//encrypt with 4096 byte chunks a file encrypted with 1024 byte chunks,
+//without writing the plaintext anywhere
+//inputFile path to the file to reshard, it must be a regular file
+//outputFile path to the output file, it can be inputFile itself
+//oldSize size of the shards of inputFile, as given to ProcessFile to undo
+//the processing, for example AESGCMShardSize(1024), 0 if it was written
+//with framed shards
+//newSize size of the chunks of the plaintext processed into the output
+//process function that processes each new chunk, typically an encryptor
+//unprocess function that undoes the processing of each shard of inputFile,
+//typically the decryptor matching the encryptor that wrote it
+//the shards of inputFile are unprocessed concurrently and their values
+//streamed in order into the chunks of newSize, which are processed
+//concurrently: a new chunk spans as many old values as needed, and an old
+//value ends up in as many chunks as it spans, so the sizes need not divide
+//each other; only the last chunk can be shorter, as in ProcessFile
+//the output is framed if and only if inputFile is, and it is written on
+//outputFile+TempSuffix, renamed over outputFile once complete
+//return the first error encountered unprocessing, processing or writing,
+//or an error wrapping ErrInvalidSize for a negative oldSize or a newSize
+//that is not positive
+func Reshard(inputFile, outputFile string, oldSize, newSize int, process, unprocess ProcessFunc) error {
+	if oldSize < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, oldSize)
+	}
+	if newSize <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, newSize)
+	}
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	values, unprocessErr := processStream(ctx, file, unprocess, 0, oldSize, 0, nil, nil, lateShards{})
+	//stream the old values in order to the chunking of the new shards
+	pr, pw := io.Pipe()
+	feedErr := make(chan error, 1)
+	go func() {
+		var err error
+		for pt := range values {
+			if err == nil {
+				_, err = pw.Write(pt.Value)
+			}
+		}
+		if err == nil {
+			err = <-unprocessErr
+		}
+		pw.CloseWithError(err)
+		feedErr <- err
+	}()
+	//open temporary output file
+	out, err := createTemp(outputFile, WriteTruncate, OutputPerm)
+	if err == nil {
+		err = ProcessReader(ctx, pr, out, process, 0, newSize, oldSize == 0, nil)
+		//move the output into place only once it is complete
+		if err == nil {
+			err = commitTemp(out, outputFile, WriteTruncate, true)
+		} else {
+			out.Close()
+		}
+		if err != nil {
+			os.Remove(out.Name())
+		}
+	}
+	//stop unprocessing if the output failed
+	pr.CloseWithError(io.ErrClosedPipe)
+	cancel()
+	//an unprocessing error is the cause of the failure of the output
+	if ferr := <-feedErr; ferr != nil && ferr != io.ErrClosedPipe && ferr != context.Canceled {
+		return ferr
+	}
+	return err
+}
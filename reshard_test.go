@@ -0,0 +1,162 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReshard(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldSize int
+		newSize int
+		length  int
+		framed  bool
+	}{
+		{"growing, not dividing", 3, 5, 23, false},
+		{"shrinking, not dividing", 5, 3, 23, false},
+		{"four old per new", 1024, 4096, 10000, false},
+		{"four new per old", 4096, 1024, 10000, false},
+		{"exact multiple", 4, 8, 32, false},
+		{"final partial shard", 8, 4, 30, false},
+		{"shorter than a shard", 7, 16, 5, false},
+		{"empty", 3, 5, 0, false},
+		{"framed", 3, 5, 23, true},
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+	encrypt, err := NewAESGCMEncryptor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypt, err := NewAESGCMDecryptor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			plain := make([]byte, tt.length)
+			for i := range plain {
+				plain[i] = byte(i * 7)
+			}
+			in := filepath.Join(dir, "in")
+			if err := ioutil.WriteFile(in, plain, 0600); err != nil {
+				t.Fatal(err)
+			}
+			enc := filepath.Join(dir, "enc")
+			opts := ProcessOptions{ChunkSize: tt.oldSize, Framed: tt.framed, NoSync: true}
+			if _, err := ProcessFileWithOptions(context.Background(), in, enc, encrypt, opts); err != nil {
+				t.Fatal(err)
+			}
+			oldSize, newSize := AESGCMShardSize(tt.oldSize), AESGCMShardSize(tt.newSize)
+			if tt.framed {
+				oldSize, newSize = 0, 0
+			}
+			out := filepath.Join(dir, "out")
+			if err := Reshard(enc, out, oldSize, tt.newSize, encrypt, decrypt); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(out + TempSuffix); !os.IsNotExist(err) {
+				t.Errorf("temporary file left: %v", err)
+			}
+			//decrypt the new shards, recording their lengths
+			var mu sync.Mutex
+			lengths := map[int]int{}
+			record := func(inp Shard) (Shard, error) {
+				pt, err := decrypt(inp)
+				mu.Lock()
+				lengths[pt.Index] = len(pt.Value)
+				mu.Unlock()
+				return pt, err
+			}
+			file, err := os.Open(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var got bytes.Buffer
+			if err := ProcessReader(context.Background(), file, &got, record, 0, newSize, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), plain) {
+				t.Fatalf("resharded file decrypts to %d bytes differing from the %d of the original", got.Len(), len(plain))
+			}
+			shards := (tt.length + tt.newSize - 1) / tt.newSize
+			if len(lengths) != shards {
+				t.Fatalf("%d shards, want %d", len(lengths), shards)
+			}
+			for i := 0; i < shards; i++ {
+				want := tt.newSize
+				if i == shards-1 && tt.length%tt.newSize != 0 {
+					want = tt.length % tt.newSize
+				}
+				if lengths[i] != want {
+					t.Errorf("shard %d has %d bytes, want %d", i, lengths[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestReshardErrors(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	encrypt, _ := NewAESGCMEncryptor(key)
+	decrypt, _ := NewAESGCMDecryptor(key)
+	in := filepath.Join(dir, "in")
+	if err := ioutil.WriteFile(in, make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	enc := filepath.Join(dir, "enc")
+	if _, err := ProcessFileWithOptions(context.Background(), in, enc, encrypt, ProcessOptions{ChunkSize: 10, NoSync: true}); err != nil {
+		t.Fatal(err)
+	}
+	//a shard that fails authentication
+	data, err := ioutil.ReadFile(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	tampered := filepath.Join(dir, "tampered")
+	if err := ioutil.WriteFile(tampered, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	failing := func(Shard) (Shard, error) {
+		return Shard{}, errors.New("failing")
+	}
+	tests := []struct {
+		name             string
+		input            string
+		oldSize, newSize int
+		process          ProcessFunc
+		check            func(error) bool
+	}{
+		{"negative old size", enc, -1, 16, encrypt, func(err error) bool { return errors.Is(err, ErrInvalidSize) }},
+		{"zero new size", enc, AESGCMShardSize(10), 0, encrypt, func(err error) bool { return errors.Is(err, ErrInvalidSize) }},
+		{"unauthenticated shard", tampered, AESGCMShardSize(10), 16, encrypt, func(err error) bool {
+			var af ErrAuthFailure
+			return errors.As(err, &af) && af.Index == 9
+		}},
+		{"failing process", enc, AESGCMShardSize(10), 16, failing, func(err error) bool { return err != nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, "out")
+			err := Reshard(tt.input, out, tt.oldSize, tt.newSize, tt.process, decrypt)
+			if !tt.check(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for _, name := range []string{out, out + TempSuffix} {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("%s left by a failed run: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package ledger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//ProgressSuffix suffix appended to the output file name to get its checkpoint
+const ProgressSuffix = ".progress"
+
+//checkpointInterval number of shards written between two checkpoints
+const checkpointInterval = 64
+
+//checkpoint state of an output file that is being written
+type checkpoint struct {
+	//index of the last shard written, -1 if none
+	last int
+	//size of the output after the last shard
+	offset int64
+	//true if the last shard was built from a partial chunk,
+	//which means that the whole input was processed
+	partial bool
+}
+
+//readCheckpoint read the checkpoint of an output file
+//outputFile path of the output file
+//return the checkpoint and true if it exists, an empty checkpoint and false otherwise
+func readCheckpoint(outputFile string) (checkpoint, bool, error) {
+	cp := checkpoint{-1, 0, false}
+	content, err := ioutil.ReadFile(outputFile + ProgressSuffix)
+	if os.IsNotExist(err) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, fileError(ErrReadInput, "error reading checkpoint", err)
+	}
+	var kind string
+	_, err = fmt.Sscanf(string(content), "%d %d %s", &cp.last, &cp.offset, &kind)
+	if err != nil || cp.last < -1 || cp.offset < 0 || (kind != "full" && kind != "partial") {
+		return cp, false, fmt.Errorf("malformed checkpoint %s", outputFile+ProgressSuffix)
+	}
+	cp.partial = kind == "partial"
+	return cp, true, nil
+}
+
+//writeCheckpoint save the checkpoint of an output file
+//outputFile path of the output file
+//cp checkpoint to save
+//the checkpoint is written on a temporary file and renamed, so that an
+//interruption never leaves a corrupt checkpoint
+func writeCheckpoint(outputFile string, cp checkpoint) error {
+	kind := "full"
+	if cp.partial {
+		kind = "partial"
+	}
+	tmp := outputFile + ProgressSuffix + ".tmp"
+	content := fmt.Sprintf("%d %d %s\n", cp.last, cp.offset, kind)
+	if err := ioutil.WriteFile(tmp, []byte(content), OutputPerm); err != nil {
+		return fileError(ErrWriteOutput, "error writing checkpoint", err)
+	}
+	if err := os.Rename(tmp, outputFile+ProgressSuffix); err != nil {
+		return fileError(ErrWriteOutput, "error writing checkpoint", err)
+	}
+	return nil
+}
+
+//removeCheckpoint delete the checkpoint of an output file, if any
+//outputFile path of the output file
+func removeCheckpoint(outputFile string) error {
+	if err := os.Remove(outputFile + ProgressSuffix); err != nil && !os.IsNotExist(err) {
+		return fileError(ErrWriteOutput, "error removing checkpoint", err)
+	}
+	return nil
+}
+
+//checkpointer wrap a progress callback to checkpoint the shards written
+//outputFile path of the output file
+//start checkpoint the writing starts from
+//inputSize size of the input file, to detect the final partial chunk
+//size size of the input chunks
+//sync function flushing the output to stable storage, nil for none
+//progress callback to wrap, called first with the same counts
+//return the callback to pass to the writer, which counts from start
+//a checkpoint is saved every checkpointInterval shards and at completion,
+//each time after syncing the output, so that a crash never leaves a
+//checkpoint pointing past the shards that reached the disk
+func checkpointer(outputFile string, start checkpoint, inputSize int64, size int, sync func() error, progress ProgressFunc) ProgressFunc {
+	previous := -1
+	return func(shardsDone, totalShards int, bytesWritten int64) {
+		progress(shardsDone, totalShards, bytesWritten)
+		//the completion call repeats the count of the last shard
+		completed := shardsDone == previous
+		previous = shardsDone
+		if shardsDone == 0 || !completed && shardsDone%checkpointInterval != 0 {
+			return
+		}
+		if sync != nil {
+			if err := sync(); err != nil {
+				logln(err)
+				return
+			}
+		}
+		last := start.last + shardsDone
+		cp := checkpoint{last, start.offset + bytesWritten, int64(last+1)*int64(size) > inputSize}
+		if err := writeCheckpoint(outputFile, cp); err != nil {
+			logln(err)
+		}
+	}
+}
+
+//ResumeFrom read the checkpoint left by ProcessFile with resume enabled
+//outputFile path of the output file
+//return the index of the last shard written on outputFile, -1 if there is no
+//checkpoint; ProcessFile with resume continues with the following shard,
+//reading the input from (lastCompletedIndex+1)*size
+func ResumeFrom(outputFile string) (lastCompletedIndex int, err error) {
+	cp, _, err := readCheckpoint(outputFile)
+	if err != nil {
+		return -1, err
+	}
+	return cp.last, nil
+}
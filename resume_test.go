@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointerSync(t *testing.T) {
+	tests := []struct {
+		name    string
+		syncErr error
+		want    bool
+	}{
+		{"synced", nil, true},
+		{"sync failing", errors.New("sync failing"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			syncs := 0
+			sync := func() error {
+				//the checkpoint follows the sync, never precedes it
+				if _, err := os.Stat(out + ProgressSuffix); !os.IsNotExist(err) {
+					t.Errorf("checkpoint written before sync %d: %v", syncs, err)
+				}
+				syncs++
+				return tt.syncErr
+			}
+			written := checkpointer(out, checkpoint{-1, 0, false}, 1000, 10, sync, func(int, int, int64) {})
+			for i := 1; i < checkpointInterval; i++ {
+				written(i, 100, int64(i*10))
+			}
+			if syncs != 0 {
+				t.Fatalf("%d syncs before the first checkpoint", syncs)
+			}
+			written(checkpointInterval, 100, checkpointInterval*10)
+			if syncs != 1 {
+				t.Fatalf("%d syncs at the first checkpoint, want 1", syncs)
+			}
+			cp, found, err := readCheckpoint(out)
+			if err != nil || found != tt.want {
+				t.Fatalf("checkpoint found %v, want %v: %v", found, tt.want, err)
+			}
+			if found && (cp.last != checkpointInterval-1 || cp.offset != checkpointInterval*10) {
+				t.Errorf("checkpoint %+v", cp)
+			}
+		})
+	}
+}
+
+func TestProcessFileCheckpointRemoved(t *testing.T) {
+	failing := func(inp Shard) (Shard, error) {
+		if inp.Index == 500 {
+			return Shard{}, errors.New("failing")
+		}
+		return inp, nil
+	}
+	in := writeInput(t, 10000)
+	out := filepath.Join(filepath.Dir(in), "out")
+	tests := []struct {
+		name       string
+		process    ProcessFunc
+		opts       ProcessOptions
+		checkpoint bool
+	}{
+		{"interrupted", failing, ProcessOptions{}, true},
+		{"resumed to completion", identity, ProcessOptions{}, false},
+		{"completed without sync", identity, ProcessOptions{NoSync: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Workers, opts.ChunkSize, opts.Resume = 4, 10, true
+			_, err := ProcessFileWithOptions(context.Background(), in, out, tt.process, opts)
+			if (err != nil) != tt.checkpoint {
+				t.Fatalf("ProcessFile: %v", err)
+			}
+			if _, err := os.Stat(out + ProgressSuffix); os.IsNotExist(err) == tt.checkpoint {
+				t.Fatalf("checkpoint left %v, want %v: %v", err == nil, tt.checkpoint, err)
+			}
+			if !tt.checkpoint {
+				assertSameFile(t, out, in)
+			}
+		})
+	}
+}
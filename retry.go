@@ -0,0 +1,99 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//RetryPolicy how transient write failures are retried
+//the zero value makes a single attempt
+type RetryPolicy struct {
+	//MaxAttempts maximum number of attempts, the first one included,
+	//0 or 1 for no retry
+	MaxAttempts int
+	//BaseDelay wait before the first retry
+	BaseDelay time.Duration
+	//Factor multiplier of the wait after every retry, 1 or less for a
+	//constant wait
+	Factor float64
+}
+
+//WriteRetry policy of the writes to the output files and to the shard
+//sinks, unless ProcessOptions.Retry is set
+var WriteRetry = RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, Factor: 2}
+
+//orDefault the policy to use
+//return the policy, or WriteRetry if it is the zero value
+func (p RetryPolicy) orDefault() RetryPolicy {
+	if p == (RetryPolicy{}) {
+		return WriteRetry
+	}
+	return p
+}
+
+//do run an operation, retrying it while it fails with retryable errors
+//clk clock of the waits between the attempts, nil for the system clock
+//op operation to run, it must be safe to repeat
+//return nil as soon as op succeeds, its error if it is not retryable, or an
+//error with the number of attempts wrapping the last one if all of them fail
+func (p RetryPolicy) do(clk clock, op func() error) error {
+	clk = orRealClock(clk)
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		clk.Sleep(delay)
+		if p.Factor > 1 {
+			delay = time.Duration(float64(delay) * p.Factor)
+		}
+	}
+}
+
+//isRetryable report whether an error is transient
+//err error to classify
+//return true for timeouts and temporary errors, as those of the network
+//and the interrupted system calls, false otherwise and for the cancellation
+//of the run
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+//retryWriter writer retrying the writes that fail with retryable errors
+type retryWriter struct {
+	//w underlying writer, a failed write is continued after the bytes it wrote
+	w io.Writer
+	//policy retry policy of the writes
+	policy RetryPolicy
+	//clock clock of the waits between the attempts, nil for the system clock
+	clock clock
+}
+
+//Write write p, continuing from where a failed attempt stopped
+func (rw retryWriter) Write(p []byte) (int, error) {
+	done := 0
+	err := rw.policy.do(rw.clock, func() error {
+		n, err := rw.w.Write(p[done:])
+		done += n
+		return err
+	})
+	return done, err
+}
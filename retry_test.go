@@ -0,0 +1,65 @@
+package ledger
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// timeoutError transient error, retried by RetryPolicy
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "i/o timeout"
+}
+
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+func TestRetryBackoff(t *testing.T) {
+	permanent := errors.New("permanent")
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		//failures number of failing attempts before success, -1 for always
+		failures     int
+		err          error
+		wantSlept    []time.Duration
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"exponential", RetryPolicy{4, 10 * ms, 2}, -1, timeoutError{}, []time.Duration{10 * ms, 20 * ms, 40 * ms}, 4, true},
+		{"constant", RetryPolicy{4, 10 * ms, 1}, 2, timeoutError{}, []time.Duration{10 * ms, 10 * ms}, 3, false},
+		{"fractional factor", RetryPolicy{3, 10 * ms, 1.5}, -1, timeoutError{}, []time.Duration{10 * ms, 15 * ms}, 3, true},
+		{"not retryable", RetryPolicy{4, 10 * ms, 2}, -1, permanent, nil, 1, true},
+		{"single attempt", RetryPolicy{}, -1, timeoutError{}, nil, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeClock()
+			attempts := 0
+			err := tt.policy.do(fc, func() error {
+				attempts++
+				if tt.failures < 0 || attempts <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want wrapping %v", err, tt.err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if !reflect.DeepEqual(fc.slept, tt.wantSlept) {
+				t.Errorf("slept %v, want %v", fc.slept, tt.wantSlept)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+//ErrRoundTripMismatch the decrypted file differs from the original one
+var ErrRoundTripMismatch = errors.New("decrypted data differs from the original")
+
+//VerifyRoundTrip check that an encrypted file decrypts back to its original
+//originalFile path to the plaintext file
+//encryptedFile path to the file written by ProcessFile encrypting originalFile
+//decrypt function that decrypts each shard
+//size size of the shards of encryptedFile, 0 if it was written with framed shards
+//the shards are decrypted concurrently and compared in order with the bytes
+//of originalFile, the final partial shard included, without writing anything
+//return nil if the decrypted data is exactly originalFile, an error wrapping
+//ErrRoundTripMismatch with the offset of the first differing byte, or the
+//first error encountered reading or decrypting
+func VerifyRoundTrip(originalFile, encryptedFile string, decrypt ProcessFunc, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	orig, err := openRegular(originalFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer orig.Close()
+	enc, err := openRegular(encryptedFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer enc.Close()
+	//stop decrypting at the first mismatch
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, streamErr := processStream(ctx, enc, decrypt, 0, size, 0, nil, nil, lateShards{})
+	reader := bufio.NewReader(orig)
+	offset := int64(0)
+	var expected []byte
+	var mismatch error
+	for pt := range results {
+		if mismatch != nil {
+			continue
+		}
+		if cap(expected) < len(pt.Value) {
+			expected = make([]byte, len(pt.Value))
+		}
+		expected = expected[:len(pt.Value)]
+		n, err := io.ReadFull(reader, expected)
+		if i := firstDifference(expected[:n], pt.Value[:n]); i >= 0 {
+			mismatch = fmt.Errorf("%w at byte %d, in shard %d", ErrRoundTripMismatch, offset+int64(i), pt.Index)
+		} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			mismatch = fmt.Errorf("%w: original ends at byte %d, in shard %d", ErrRoundTripMismatch, offset+int64(n), pt.Index)
+		} else if err != nil {
+			mismatch = fileError(ErrReadInput, "error reading file", err)
+		}
+		offset += int64(n)
+		if mismatch != nil {
+			cancel()
+		}
+	}
+	if err := <-streamErr; err != nil && mismatch == nil {
+		return err
+	}
+	if mismatch != nil {
+		return mismatch
+	}
+	//the original must not go on after the decrypted data
+	if _, err := reader.ReadByte(); err != io.EOF {
+		if err != nil {
+			return fileError(ErrReadInput, "error reading file", err)
+		}
+		return fmt.Errorf("%w: original goes on after byte %d", ErrRoundTripMismatch, offset)
+	}
+	return nil
+}
+
+//firstDifference position of the first byte where two slices differ
+//a, b slices of the same length
+//return the position, or -1 if the slices are equal
+func firstDifference(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+//VerifyEncryptedFile check the authentication tag of every shard of a file
+//encrypted by NewAESGCMEncryptor, without writing any plaintext
+//filePath path to the file written by ProcessFile
+//key AES key used for encryption
+//num number of shards to check concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of the encrypted shards (see AESGCMShardSize), 0 if the file was
+//written with framed shards
+//every shard is decrypted and its plaintext discarded, and the check goes on
+//after a failure, so one pass finds all the shards that are damaged or were
+//encrypted with another key, to be targeted by a re-encryption
+//return nil if every shard authenticates, an IndexErrors with an entry for
+//every shard that fails, in index order, or the error of the key or
+//encountered reading the file
+func VerifyEncryptedFile(filePath string, key []byte, num, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	decrypt, err := NewAESGCMDecryptor(key)
+	if err != nil {
+		return err
+	}
+	//open input file
+	file, err := openRegular(filePath)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	var mutex sync.Mutex
+	var failed IndexErrors
+	//the workers record the failures instead of stopping the stream
+	check := func(inp Shard) (Shard, error) {
+		if _, err := safeProcess(decrypt, inp); err != nil {
+			mutex.Lock()
+			failed = append(failed, &IndexError{int64(inp.Index), err})
+			mutex.Unlock()
+		}
+		return Shard{inp.Index, nil}, nil
+	}
+	results, streamErr := processStream(context.Background(), file, check, num, size, 0, nil, nil, lateShards{})
+	for range results {
+	}
+	if err := <-streamErr; err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+		return failed
+	}
+	return nil
+}
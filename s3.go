@@ -0,0 +1,249 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//s3KeyDigits number of digits of the index in the object keys, so that the
+//keys sort lexically in index order
+const s3KeyDigits = 10
+
+//S3Sink ShardSink storing every shard as an object of an S3 bucket
+//the requests are signed with AWS Signature Version 4 and use path-style
+//URLs, so that any S3-compatible service can be used
+//shard i is stored under the key Prefix+ShardFilePrefix+i, with i
+//zero-padded to 10 digits
+type S3Sink struct {
+	//Endpoint base URL of the service, for example https://s3.eu-west-1.amazonaws.com
+	Endpoint string
+	//Region region of the bucket, part of the signature
+	Region string
+	//Bucket name of the bucket
+	Bucket string
+	//Prefix prepended to the object keys, for example "ledger/file1/"
+	Prefix string
+	//AccessKeyID identifier of the access key signing the requests
+	AccessKeyID string
+	//SecretAccessKey secret of the access key
+	SecretAccessKey string
+	//SessionToken token of temporary credentials, empty if none
+	SessionToken string
+	//Client HTTP client sending the requests, nil for http.DefaultClient
+	Client *http.Client
+}
+
+//Key object key of a shard
+//index index of the shard
+//return the key, without the bucket
+func (s *S3Sink) Key(index int) string {
+	return fmt.Sprintf("%s%s%0*d", s.Prefix, ShardFilePrefix, s3KeyDigits, index)
+}
+
+//Put store a shard as an object, overwriting the object of a previous run
+//index index of the shard
+//data content of the object
+//return an error describing the response if the object was not stored,
+//an *S3Error if the service refused it
+func (s *S3Sink) Put(index int, data []byte) error {
+	resp, err := s.do(http.MethodPut, s.Key(index), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+//Stored number of shards already in the bucket
+//the shards are stored in index order, so they form a run from index 0 and
+//the end of the run is found with a logarithmic number of HEAD requests
+//return the number of shards, or an error if a request fails
+func (s *S3Sink) Stored() (int, error) {
+	//find an absent shard doubling the index, then bisect
+	present, absent := -1, 0
+	for {
+		ok, err := s.exists(absent)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		present, absent = absent, 2*absent+1
+	}
+	for absent-present > 1 {
+		middle := present + (absent-present)/2
+		ok, err := s.exists(middle)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			present = middle
+		} else {
+			absent = middle
+		}
+	}
+	return absent, nil
+}
+
+//exists check whether the object of a shard is in the bucket
+//index index of the shard
+//return true if it is, or an error if the request fails
+func (s *S3Sink) exists(index int) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.Key(index), nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, s3Error(resp)
+}
+
+//do send a signed request for an object
+//method HTTP method
+//key key of the object
+//body payload of the request, nil for none
+//return the response, to be closed by the caller, or the error of the client
+func (s *S3Sink) do(method, key string, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	base := strings.TrimSuffix(endpoint.EscapedPath(), "/")
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket + "/" + key
+	endpoint.RawPath = base + "/" + s3Escape(s.Bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+//sign add the AWS Signature Version 4 headers to a request
+//req request to sign
+//body payload of the request
+//now time of the signature, in UTC
+func (s *S3Sink) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	//the host and the x-amz headers are signed, in lexical order
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	//the signing key is derived from the secret for the day, region and service
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{day, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+//hmacSHA256 compute the HMAC-SHA256 of a message
+//key key of the HMAC
+//message message to authenticate
+//return the tag
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, message)
+	return mac.Sum(nil)
+}
+
+//s3Escape escape an object key as required by the signature
+//key key to escape
+//every byte but the unreserved characters and the slashes is percent-encoded
+//return the escaped key
+func s3Escape(key string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+//S3Error unexpected response of the service
+type S3Error struct {
+	//StatusCode HTTP status of the response
+	StatusCode int
+	//Message request, status and beginning of the body, which holds the
+	//error code of S3
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	return e.Message
+}
+
+//Temporary report whether the request can be retried: the service is
+//throttling or failing, as opposed to refusing the request
+func (e *S3Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+//s3Error describe an unexpected response of the service
+//resp response received
+//return an *S3Error
+func s3Error(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := fmt.Sprintf("S3 %s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(body))
+	return &S3Error{resp.StatusCode, msg}
+}
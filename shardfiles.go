@@ -0,0 +1,401 @@
+package ledger
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//ShardFilePrefix prefix of the names of the files written by ProcessFileToShards,
+//followed by the zero-padded index of the shard
+const ShardFilePrefix = "shard."
+
+//ShardCountFile name of the file where ProcessFileToShards records the
+//number of shard files written, which is the last file written
+const ShardCountFile = "shard_count"
+
+//shardFileDigits minimum number of digits of the index in the shard file names
+const shardFileDigits = 6
+
+//ShardFileReaders number of shard files read concurrently by ReadShardFiles
+var ShardFileReaders = 16
+
+//ProcessFileToShards process a file concurrently writing each shard on its own file
+//inputFile path to input file
+//outputDir directory where the shard files are written, created if missing
+//process function that processes each chunk
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of chunks to process
+//shard i is written on outputDir/ShardFilePrefix+i, with i zero-padded to
+//at least 6 digits and to the same width for all the shards of the file,
+//so that the names sort lexically in index order
+//the shard files of a previous run in outputDir are removed first, so that
+//a shorter input does not leave stale shards behind, and once every shard
+//is written their number is recorded in outputDir/ShardCountFile, so that
+//ReassembleShards notices missing final shards
+//return the paths of the files written in index order, or the first error
+//encountered, in which case some shard files may have been written but the
+//count is not; a shard file failing to be written stops the run at once
+func ProcessFileToShards(inputFile, outputDir string, process ProcessFunc, num, size int) ([]string, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	//close file on exit
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	//pad the indices to the width of the highest one
+	total := shardCount(fi.Size(), int64(size))
+	digits := len(strconv.FormatInt(total-1, 10))
+	if digits < shardFileDigits {
+		digits = shardFileDigits
+	}
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fileError(ErrOpenOutput, "error creating directory", err)
+	}
+	if err := removeShardFiles(outputDir); err != nil {
+		return nil, err
+	}
+	//the reading and processing stop as soon as a shard file fails
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, streamErr := processStream(ctx, file, process, num, size, 0, nil, nil, lateShards{})
+	var paths []string
+	var writeErr error
+	for ct := range results {
+		if writeErr != nil {
+			continue
+		}
+		path := filepath.Join(outputDir, fmt.Sprintf("%s%0*d", ShardFilePrefix, digits, ct.Index))
+		if err := ioutil.WriteFile(path, ct.Value, OutputPerm); err != nil {
+			writeErr = fileError(ErrWriteOutput, "error writing file", err)
+			cancel()
+			continue
+		}
+		paths = append(paths, path)
+	}
+	//the cancellation is caused by the failure of the writing
+	serr := <-streamErr
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	count := fmt.Sprintf("%d\n", len(paths))
+	if err := ioutil.WriteFile(filepath.Join(outputDir, ShardCountFile), []byte(count), OutputPerm); err != nil {
+		return nil, fileError(ErrWriteOutput, "error writing file", err)
+	}
+	return paths, nil
+}
+
+//removeShardFiles delete the shard files and the count of a directory
+//dir directory written by ProcessFileToShards
+//return the error listing dir or removing a file
+func removeShardFiles(dir string) error {
+	found, err := scanShardFiles(dir)
+	if err != nil {
+		return err
+	}
+	paths := []string{filepath.Join(dir, ShardCountFile)}
+	for _, f := range found {
+		paths = append(paths, f.path)
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fileError(ErrOpenOutput, "error removing file", err)
+		}
+	}
+	return nil
+}
+
+//readShardCount read the number of shard files recorded in a directory
+//dir directory written by ProcessFileToShards
+//return the count, or an error wrapping ErrShardOrder if it was not recorded
+func readShardCount(dir string) (int, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ShardCountFile))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%w: no %s, the shard files are incomplete", ErrShardOrder, ShardCountFile)
+	}
+	if err != nil {
+		return 0, fileError(ErrReadInput, "error reading shard count", err)
+	}
+	var count int
+	if _, err := fmt.Sscanf(string(content), "%d", &count); err != nil || count < 0 {
+		return 0, fmt.Errorf("malformed shard count %s", filepath.Join(dir, ShardCountFile))
+	}
+	return count, nil
+}
+
+//ErrShardOrder the shards received are not exactly the expected ones in order
+var ErrShardOrder = errors.New("shards out of order")
+
+//VerifyOrder check that shards came back complete and in index order
+//indices indices of the shards, in the order they were received
+//expectedCount number of shards expected, -1 if unknown, in which case the
+//highest index received sets it and missing final shards go unnoticed
+//the indices must be exactly 0, 1, ..., expectedCount-1
+//return nil if they are, or an error wrapping ErrShardOrder listing the
+//missing, duplicated and out-of-range indices and the first position where
+//an index is lower than the previous one
+func VerifyOrder(indices []int, expectedCount int) error {
+	count := expectedCount
+	if count < 0 {
+		count = 0
+		for _, index := range indices {
+			if index >= count {
+				count = index + 1
+			}
+		}
+	}
+	seen := make(map[int]bool, len(indices))
+	var duplicated, outOfRange []int
+	disorder := -1
+	for pos, index := range indices {
+		switch {
+		case index < 0 || index >= count:
+			outOfRange = append(outOfRange, index)
+		case seen[index]:
+			duplicated = append(duplicated, index)
+		default:
+			seen[index] = true
+		}
+		if disorder < 0 && pos > 0 && index < indices[pos-1] {
+			disorder = pos
+		}
+	}
+	var problems []string
+	if len(seen) < count {
+		var missing []int
+		for i := 0; i < count; i++ {
+			if !seen[i] {
+				missing = append(missing, i)
+			}
+		}
+		problems = append(problems, fmt.Sprintf("missing %v", missing))
+	}
+	if len(duplicated) > 0 {
+		problems = append(problems, fmt.Sprintf("duplicated %v", duplicated))
+	}
+	if len(outOfRange) > 0 {
+		problems = append(problems, fmt.Sprintf("out of range %v", outOfRange))
+	}
+	if disorder >= 0 {
+		problems = append(problems, fmt.Sprintf("index %d received after %d", indices[disorder], indices[disorder-1]))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrShardOrder, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+//shardFile shard file found in a directory
+type shardFile struct {
+	//index index of the shard, parsed from the name
+	index int64
+	//path path to the file
+	path string
+}
+
+//scanShardFiles find the shard files of a directory
+//dir directory written by ProcessFileToShards
+//the files are recognized by name, any other entry is ignored
+//return the shard files in no particular order, or the error reading dir
+func scanShardFiles(dir string) ([]shardFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fileError(ErrReadInput, "error reading directory", err)
+	}
+	var found []shardFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, ShardFilePrefix) {
+			continue
+		}
+		index, err := strconv.ParseInt(strings.TrimPrefix(name, ShardFilePrefix), 10, 64)
+		if err != nil || index < 0 {
+			continue
+		}
+		found = append(found, shardFile{index, filepath.Join(dir, name)})
+	}
+	return found, nil
+}
+
+//shardFiles list the shard files of a directory
+//dir directory written by ProcessFileToShards
+//return the paths of the shard files in index order, or an error wrapping
+//ErrShardOrder if an index is missing, duplicated or beyond the recorded
+//count (see VerifyOrder)
+func shardFiles(dir string) ([]string, error) {
+	count, err := readShardCount(dir)
+	if err != nil {
+		return nil, err
+	}
+	found, err := scanShardFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(a, b int) bool {
+		return found[a].index < found[b].index
+	})
+	//the names of the files are the only record of the indices
+	indices := make([]int, len(found))
+	paths := make([]string, len(found))
+	for i, f := range found {
+		if f.index > math.MaxInt32 {
+			return nil, fmt.Errorf("%w: shard file %s", ErrInvalidIndex, f.path)
+		}
+		indices[i] = int(f.index)
+		paths[i] = f.path
+	}
+	if err := VerifyOrder(indices, count); err != nil {
+		return nil, fmt.Errorf("shard files in %s: %w", dir, err)
+	}
+	return paths, nil
+}
+
+//ReassembleShards concatenate the files written by ProcessFileToShards
+//dir directory containing the shard files
+//outputFile path to output file
+//the shard files are found by name and concatenated in index order, so
+//the output is what ProcessFile would have written without framing
+//return an error wrapping ErrShardOrder if a shard file is missing or
+//duplicated, or if the count of ShardCountFile is missing, before anything
+//is written, or the error reading a shard file
+func ReassembleShards(dir, outputFile string) (err error) {
+	paths, err := shardFiles(dir)
+	if err != nil {
+		return err
+	}
+	//open output file
+	out, err := os.OpenFile(outputFile, WriteTruncate.openFlags(), OutputPerm)
+	if err != nil {
+		return fileError(ErrOpenOutput, "error opening file", err)
+	}
+	//close output on exit
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fileError(ErrCloseOutput, "error closing file", cerr)
+		}
+	}()
+	w := bufio.NewWriter(out)
+	for _, path := range paths {
+		if err := appendFile(w, path); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fileError(ErrWriteOutput, "error writing file", err)
+	}
+	return nil
+}
+
+//appendFile copy a whole file
+//w where to copy the file
+//path path to the file to copy
+//return the error encountered reading or writing
+func appendFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fileError(ErrOpenInput, "error opening file", err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("error copying %s: %w", path, err)
+	}
+	return nil
+}
+
+//ReadShardFiles read a batch of shards from the files written by
+//ProcessFileToShards
+//dir directory containing the shard files
+//indices indices of the desired shards
+//the directory is listed once, then the files are read concurrently by
+//ShardFileReaders workers, so that a range of records stored on slow or
+//distributed storage is fetched without waiting for each file in turn
+//return the shards read, by index; if some cannot be read they are missing
+//from the map and the error is an IndexErrors with an entry for each of
+//them, wrapping ErrInvalidIndex for the negative indices, os.ErrNotExist for
+//the shards without a file, or the read error; the error listing dir fails
+//the whole batch
+func ReadShardFiles(dir string, indices []int64) (map[int64][]byte, error) {
+	found, err := scanShardFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[int64]string, len(found))
+	for _, f := range found {
+		paths[f.index] = f.path
+	}
+	values := make(map[int64][]byte, len(indices))
+	var failed IndexErrors
+	var mutex sync.Mutex
+	requests := make(chan int64)
+	var wg sync.WaitGroup
+	workers := ShardFileReaders
+	if workers <= 0 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range requests {
+				value, err := ioutil.ReadFile(paths[index])
+				if err != nil {
+					err = fileError(ErrReadInput, "error reading shard file", err)
+				}
+				mutex.Lock()
+				if err != nil {
+					failed = append(failed, &IndexError{index, err})
+				} else {
+					values[index] = value
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	//the indices without a file fail without reaching the workers
+	var missing IndexErrors
+	//each index is read once, even if requested more times
+	seen := make(map[int64]bool, len(indices))
+	for _, index := range indices {
+		if seen[index] {
+			continue
+		}
+		seen[index] = true
+		switch _, ok := paths[index]; {
+		case index < 0:
+			missing = append(missing, &IndexError{index, fmt.Errorf("%w: index %d", ErrInvalidIndex, index)})
+		case !ok:
+			missing = append(missing, &IndexError{index, fmt.Errorf("shard file not found: %w", os.ErrNotExist)})
+		default:
+			requests <- index
+		}
+	}
+	close(requests)
+	wg.Wait()
+	failed = append(failed, missing...)
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+		return values, failed
+	}
+	return values, nil
+}
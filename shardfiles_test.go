@@ -0,0 +1,110 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProcessFileToShardsStale(t *testing.T) {
+	dir := t.TempDir()
+	shards := filepath.Join(dir, "shards")
+	//each run leaves only its own shards, whatever the previous one wrote
+	for _, length := range []int{10000, 5000, 0, 150} {
+		in := writeInput(t, length)
+		paths, err := ProcessFileToShards(in, shards, identity, 4, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := scanShardFiles(shards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := (length + 99) / 100
+		if len(paths) != want || len(found) != want {
+			t.Fatalf("%d bytes: %d paths and %d shard files, want %d", length, len(paths), len(found), want)
+		}
+		out := filepath.Join(dir, "out")
+		if err := ReassembleShards(shards, out); err != nil {
+			t.Fatal(err)
+		}
+		assertSameFile(t, out, in)
+	}
+}
+
+func TestReassembleShardsCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(dir string, paths []string) string
+		err    error
+	}{
+		{"complete", func(string, []string) string { return "" }, nil},
+		{"final shard missing", func(_ string, paths []string) string { return paths[len(paths)-1] }, ErrShardOrder},
+		{"first shard missing", func(_ string, paths []string) string { return paths[0] }, ErrShardOrder},
+		{"count missing", func(dir string, _ []string) string { return filepath.Join(dir, ShardCountFile) }, ErrShardOrder},
+	}
+	in := writeInput(t, 1050)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			shards := filepath.Join(dir, "shards")
+			paths, err := ProcessFileToShards(in, shards, identity, 4, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path := tt.remove(shards, paths); path != "" {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out := filepath.Join(dir, "out")
+			err = ReassembleShards(shards, out)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.err == nil {
+				assertSameFile(t, out, in)
+			} else if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("output written: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessFileToShardsWriteFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		//failing index of the shard whose file cannot be written
+		failing int
+	}{
+		{"first shard", 0},
+		{"later shard", 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 100000)
+			shards := filepath.Join(filepath.Dir(in), "shards")
+			//a directory in the place of the shard file fails its write
+			blocked := filepath.Join(shards, fmt.Sprintf("%s%06d", ShardFilePrefix, tt.failing))
+			if err := os.MkdirAll(blocked, 0700); err != nil {
+				t.Fatal(err)
+			}
+			var processed int64
+			process := func(inp Shard) (Shard, error) {
+				atomic.AddInt64(&processed, 1)
+				return inp, nil
+			}
+			_, err := ProcessFileToShards(in, shards, process, 4, 10)
+			if !errors.Is(err, ErrWriteOutput) {
+				t.Fatalf("err = %v, want %v", err, ErrWriteOutput)
+			}
+			//the reading stops within the window of the shards in flight
+			if n := atomic.LoadInt64(&processed); n >= 10000/2 {
+				t.Errorf("%d of 10000 shards processed after the failure", n)
+			}
+		})
+	}
+}
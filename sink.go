@@ -0,0 +1,154 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ShardSink destination of the processed shards, one object per shard,
+//instead of a local output file
+type ShardSink interface {
+	//Put store the processed shard of the given index
+	//data must not be kept after Put returns, since its buffer is reused
+	Put(index int, data []byte) error
+}
+
+//ResumableSink ShardSink that can tell how far a previous run got
+type ResumableSink interface {
+	ShardSink
+	//Stored number of shards already stored, from index 0 without gaps
+	Stored() (int, error)
+}
+
+//ProcessFileToSink read file and process it concurrently
+//then collect results and store them in a ShardSink
+//ctx context to cancel the processing
+//inputFile path to input file, it must be a regular file (see ErrNotRegular)
+//sink where the shards are stored, calling Put in index order from a
+//single goroutine, again on the same shard if it fails with a transient error
+//(see ProcessOptions.Retry)
+//process function that processes each chunk
+//opts settings of the processing as in ProcessFileWithOptions: each shard is
+//a separate object, so Framed and Mode do not apply and Manifest is not
+//supported; Resume continues after the shards already stored, it requires
+//a ResumableSink; SkipLate stores the following shards without the late
+//ones, which are never passed to Put
+//return what was stored, counting bytes as the length of the shards, or the
+//first error encountered reading the input or storing the shards
+func ProcessFileToSink(ctx context.Context, inputFile string, sink ShardSink, process ProcessFunc, opts ProcessOptions) (res Result, err error) {
+	start := time.Now()
+	defer zeroizeAll(opts.Zeroize)
+	opts, err = opts.withDefaults()
+	if err != nil {
+		return res, err
+	}
+	if opts.Manifest {
+		return res, errors.New("manifest not supported for shard sinks")
+	}
+	size := opts.ChunkSize
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return res, err
+	}
+	//close file on exit
+	defer file.Close()
+	total := -1
+	if fi, err := file.Stat(); err == nil {
+		total = int(shardCount(fi.Size(), int64(size)))
+	}
+	//skip the shards stored by a previous run
+	first := 0
+	if opts.Resume {
+		resumable, ok := sink.(ResumableSink)
+		if !ok {
+			return res, errors.New("shard sink cannot resume")
+		}
+		if first, err = resumable.Stored(); err != nil {
+			return res, fmt.Errorf("error resuming: %w", err)
+		}
+		offset, err := valueOffset(int64(first), int64(size))
+		if err != nil {
+			return res, err
+		}
+		if err := skipInput(file, offset, opts.InputHash); err != nil {
+			return res, err
+		}
+	}
+	res.ShardsWritten = first
+	//process file, until the sink fails
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	buffers := newChunkBuffers(size)
+	input := hashInput(throttle(streamCtx, opts.clock, file, opts.BytesPerSecond), opts.InputHash)
+	late := lateShards{timeout: opts.FlushTimeout, clock: opts.clock, shard: opts.ShardTimeout}
+	if opts.SkipLate {
+		//called by the ordering goroutine, which ends before processStream reports
+		late.skip = func(index int) {
+			res.Skipped = append(res.Skipped, index)
+		}
+	}
+	remaining := -1
+	if total >= 0 {
+		remaining = total - first
+	}
+	results, streamErr := processStream(streamCtx, input, process, fileWorkers(opts.Workers, remaining), size, first, buffers, opts.Metrics, late)
+	retry := opts.Retry
+	putErr := make(chan error, 1)
+	put := func(ct Shard) error {
+		err := retry.do(opts.clock, func() error {
+			return sink.Put(ct.Index, ct.Value)
+		})
+		if err != nil {
+			//stop processing the remaining shards
+			cancel()
+			return fmt.Errorf("error storing shard %d: %w", ct.Index, err)
+		}
+		res.ShardsWritten++
+		res.BytesWritten += int64(len(ct.Value))
+		opts.Metrics.written(int64(len(ct.Value)))
+		buffers.release(ct.Index)
+		if opts.Progress != nil {
+			opts.Progress(res.ShardsWritten, total, res.BytesWritten)
+		}
+		return nil
+	}
+	go func() {
+		if opts.SkipLate {
+			//the shards come in order, with gaps where they were skipped
+			putErr <- putAll(results, put)
+			return
+		}
+		hint := 0
+		if total > first {
+			hint = total - first
+		}
+		putErr <- orderResults(context.Background(), results, first, hint, lateShards{}, put)
+	}()
+	if err := waitProcessing(ctx, streamErr, putErr); err != nil {
+		return res, err
+	}
+	res.Duration = time.Since(start)
+	logln("shards stored successfully!")
+	return res, nil
+}
+
+//putAll store shards as they come
+//results channel of the shards, always drained
+//put function storing a shard
+//return the first error returned by put
+func putAll(results <-chan Shard, put func(Shard) error) error {
+	//drain results on exit so that the producers never block
+	defer func() {
+		for range results {
+		}
+	}()
+	for ct := range results {
+		if err := put(ct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
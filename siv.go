@@ -0,0 +1,197 @@
+package ledger
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+//AESSIVOverhead bytes added by the AES-SIV encryptor to each shard:
+//the synthetic IV, which is also the authentication tag
+const AESSIVOverhead = aes.BlockSize
+
+//aesSIV AES-SIV as defined in RFC 5297
+type aesSIV struct {
+	//cipher of the first half of the key, used by S2V
+	mac cipher.Block
+	//cipher of the second half of the key, used by CTR
+	ctr cipher.Block
+}
+
+//newAESSIV build AES-SIV from the key
+//key 32, 48 or 64 bytes, for AES-128, AES-192 or AES-256:
+//the first half is the S2V key, the second half the CTR key
+//return the AES-SIV instance or the error for an invalid key
+func newAESSIV(key []byte) (*aesSIV, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, fmt.Errorf("invalid AES-SIV key: %d bytes instead of 32, 48 or 64", len(key))
+	}
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &aesSIV{mac, ctr}, nil
+}
+
+//dbl multiply a block by x in GF(2^128), as defined in RFC 5297
+func dbl(block []byte) []byte {
+	res := make([]byte, aes.BlockSize)
+	carry := block[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		res[i] = block[i]<<1 | block[i+1]>>7
+	}
+	res[aes.BlockSize-1] = block[aes.BlockSize-1]<<1 ^ carry*0x87
+	return res
+}
+
+//cmac compute AES-CMAC as defined in RFC 4493
+//data message to authenticate
+//return the 16 byte tag
+func (siv *aesSIV) cmac(data []byte) []byte {
+	//compute subkeys
+	zero := make([]byte, aes.BlockSize)
+	l := make([]byte, aes.BlockSize)
+	siv.mac.Encrypt(l, zero)
+	k1 := dbl(l)
+	k2 := dbl(k1)
+	//split in blocks, the last one is complete and not empty if possible
+	n := (len(data) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(data)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, aes.BlockSize)
+	if complete {
+		copy(last, data[(n-1)*aes.BlockSize:])
+		xorInto(last, k1)
+	} else {
+		rest := data[(n-1)*aes.BlockSize:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorInto(last, k2)
+	}
+	//CBC-MAC of the blocks
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		xorInto(x, data[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		siv.mac.Encrypt(x, x)
+	}
+	xorInto(x, last)
+	siv.mac.Encrypt(x, x)
+	return x
+}
+
+//xorInto xor src into dst, which is at least as long as src
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+//s2v compute the synthetic IV as defined in RFC 5297
+//ad associated data components, can be empty
+//plaintext last component
+//return the synthetic IV
+func (siv *aesSIV) s2v(ad [][]byte, plaintext []byte) []byte {
+	d := siv.cmac(make([]byte, aes.BlockSize))
+	for _, component := range ad {
+		d = dbl(d)
+		xorInto(d, siv.cmac(component))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		//xor d into the last 16 bytes
+		t = append([]byte(nil), plaintext...)
+		xorInto(t[len(t)-aes.BlockSize:], d)
+	} else {
+		t = dbl(d)
+		padded := make([]byte, aes.BlockSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		xorInto(t, padded)
+	}
+	return siv.cmac(t)
+}
+
+//ctrXor encrypt or decrypt with CTR mode starting from the synthetic IV
+//v synthetic IV
+//data data to process
+//return the processed data
+func (siv *aesSIV) ctrXor(v, data []byte) []byte {
+	//clear the 31st and 63rd bit from the right of the counter
+	q := append([]byte(nil), v...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	res := make([]byte, len(data))
+	cipher.NewCTR(siv.ctr, q).XORKeyStream(res, data)
+	return res
+}
+
+//seal encrypt and authenticate the plaintext
+//ad associated data components
+//plaintext data to encrypt
+//return V || C
+func (siv *aesSIV) seal(ad [][]byte, plaintext []byte) []byte {
+	v := siv.s2v(ad, plaintext)
+	return append(v, siv.ctrXor(v, plaintext)...)
+}
+
+//open decrypt and verify a ciphertext produced by seal
+//ad associated data components used to seal
+//ciphertext V || C
+//return the plaintext or an error if authentication fails
+func (siv *aesSIV) open(ad [][]byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < AESSIVOverhead {
+		return nil, errors.New("ciphertext too short")
+	}
+	v := ciphertext[:AESSIVOverhead]
+	plaintext := siv.ctrXor(v, ciphertext[AESSIVOverhead:])
+	if subtle.ConstantTimeCompare(v, siv.s2v(ad, plaintext)) != 1 {
+		return nil, errors.New("message authentication failed")
+	}
+	return plaintext, nil
+}
+
+//NewAESSIVEncryptor build a process function that encrypts each shard with AES-SIV (RFC 5297)
+//key 32, 48 or 64 bytes, for AES-128, AES-192 or AES-256 in SIV mode
+//the encryption is deterministic: no nonce is used, and identical plaintext
+//shards are encrypted into identical ciphertext shards, so equal records can
+//be detected on the ledger without decrypting them; this means that the
+//ciphertexts leak which shards are equal: use NewAESGCMEncryptor when this
+//is not acceptable
+//each output shard is V || ciphertext, AESSIVOverhead bytes longer than the input one
+//return the process function, or an error if the key has the wrong length
+func NewAESSIVEncryptor(key []byte) (ProcessFunc, error) {
+	siv, err := newAESSIV(key)
+	if err != nil {
+		return nil, err
+	}
+	return func(inp Shard) (Shard, error) {
+		return Shard{inp.Index, siv.seal(nil, inp.Value)}, nil
+	}, nil
+}
+
+//NewAESSIVDecryptor build a process function that decrypts shards encrypted by NewAESSIVEncryptor
+//key key used for encryption
+//the process function fails with an ErrAuthFailure if a shard is too short
+//or fails authentication, aborting ProcessFile
+//return the process function, or an error if the key has the wrong length
+func NewAESSIVDecryptor(key []byte) (ProcessFunc, error) {
+	siv, err := newAESSIV(key)
+	if err != nil {
+		return nil, err
+	}
+	return func(inp Shard) (Shard, error) {
+		pt, err := siv.open(nil, inp.Value)
+		if err != nil {
+			return Shard{}, ErrAuthFailure{inp.Index, err}
+		}
+		return Shard{inp.Index, pt}, nil
+	}, nil
+}
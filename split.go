@@ -1,153 +1,1774 @@
-package main
+package ledger
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
+	"math/bits"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-type shard struct {
-	index int
-	value string
+//ErrInvalidIndex the requested index is not valid
+var ErrInvalidIndex = errors.New("invalid index")
+
+//ErrInvalidSize the size of the chunks or values is not positive
+var ErrInvalidSize = errors.New("invalid chunk size")
+
+//ErrShortValue the file ends in the middle of the requested value
+var ErrShortValue = errors.New("incomplete value")
+
+//ErrNotRegular the input is not a regular file
+var ErrNotRegular = errors.New("not a regular file")
+
+//ErrVariableLength shards of different length written without framing,
+//which could not be read back as fixed-size values
+var ErrVariableLength = errors.New("shards of variable length need the framed format")
+
+//Shard chunk of the input, or the result of processing it, with its position
+type Shard struct {
+	//Index position of the chunk in the input, from 0
+	Index int
+	//Value content of the shard
+	Value []byte
+}
+
+//OutputPerm permissions of the output files created by this package
+//the default 0600 keeps the processed sensitive data readable only by the
+//owner; as for any created file the process umask is applied on top of it,
+//and existing files that are overwritten keep their permissions
+var OutputPerm os.FileMode = 0600
+
+//MaxReorder maximum number of shards, besides the ones being processed,
+//that ProcessStream holds while waiting for a slower shard with lower index:
+//when the window is full the reading stops, so the workers block instead of
+//the memory growing, which stays proportional to (num+MaxReorder)*size
+var MaxReorder = 1024
+
+//MaxInFlightBytes maximum number of input bytes that ProcessStream holds at
+//any time, counting the chunks being processed and the ones waiting to be
+//yielded in order, 0 or negative for no limit
+//it bounds memory, while num bounds CPU parallelism: the two are independent
+//and the tighter one wins, so with a budget below num*size fewer than num
+//chunks are processed concurrently, and at least one chunk is always in flight
+//even if size exceeds the budget; processed shards larger than their input
+//chunk, and the buffers of the reader and writer, are not counted
+var MaxInFlightBytes int64
+
+//ReadAhead number of chunks that ProcessStream reads ahead of the workers,
+//0 or negative to read as many chunks ahead as there are workers
+//it is independent of the number of workers: read-ahead hides the latency
+//of the storage, keeping it busy while the workers are, and the workers
+//saturate the CPU, so slow storage wants a deep read-ahead even with few
+//workers; the chunks read ahead count towards MaxInFlightBytes
+var ReadAhead int
+
+//MinShardsPerWorker minimum number of shards of the input for each worker
+//of ProcessFile and ProcessFileToSink: for a file too small to keep the
+//requested workers busy fewer are started, down to a single one, since for
+//small files starting the workers costs more than processing the shards;
+//the output does not depend on the number of workers, 0 or negative to
+//always start the requested number
+var MinShardsPerWorker = 4
+
+//WriteMode how an existing output file is treated
+type WriteMode int
+
+const (
+	//WriteTruncate overwrite an existing output file, truncating it
+	WriteTruncate WriteMode = iota
+	//WriteExclusive fail if the output file already exists,
+	//so that a previous result is never clobbered
+	WriteExclusive
+)
+
+//openFlags flags to open a new output file in this mode
+func (mode WriteMode) openFlags() int {
+	if mode == WriteExclusive {
+		return os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	return os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+}
+
+//ProgressFunc callback reporting the progress of the writing
+//shardsDone number of shards written so far
+//totalShards number of shards to write, -1 if unknown
+//bytesWritten number of bytes written so far
+type ProgressFunc func(shardsDone, totalShards int, bytesWritten int64)
+
+//ProcessFunc function that processes a shard
+//it returns the processed shard, or an error that aborts the whole run, for
+//example when a shard fails authentication; use Infallible to adapt the
+//process functions that cannot fail
+//the indices are 0-based and contiguous: shard i holds the i-th chunk of the
+//input of the run, counting the chunks processed before a resume and those
+//of the previous files in ProcessFiles, so they can derive per-shard values;
+//the shards are processed concurrently, so not in index order, but each
+//index is processed once in a run
+//the value of the input shard belongs to the function, which can modify it
+//or reuse its array for the output, as the decryptors do, but must not keep
+//it after returning, since its buffer is reused once the output is written
+type ProcessFunc func(Shard) (Shard, error)
+
+//Infallible adapt a process function that cannot fail to a ProcessFunc
+//process function that processes a shard
+//return the ProcessFunc applying process and never failing
+func Infallible(process func(Shard) Shard) ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		return process(inp), nil
+	}
+}
+
+//ShardMeta position of a shard in its run
+type ShardMeta struct {
+	//Index index of the shard, 0-based and contiguous (see ProcessFunc)
+	Index int
+	//Total number of shards of the run, -1 if unknown
+	Total int
+}
+
+//MetaProcessFunc process function that also receives the position of the shard
+type MetaProcessFunc func(Shard, ShardMeta) (Shard, error)
+
+//WithMeta adapt a MetaProcessFunc to a ProcessFunc
+//process function that processes a shard knowing its position
+//total number of shards of the run, for example the shards returned by
+//Plan, -1 if unknown
+//return the ProcessFunc passing the position of each shard to process
+func WithMeta(process MetaProcessFunc, total int) ProcessFunc {
+	if total < 0 {
+		total = -1
+	}
+	return func(inp Shard) (Shard, error) {
+		return process(inp, ShardMeta{inp.Index, total})
+	}
+}
+
+//Result what ProcessFile wrote, when it fails the part written before the error
+type Result struct {
+	//ShardsWritten number of shards in the output file
+	ShardsWritten int
+	//BytesWritten byte size of the output file (length prefixes included if framed)
+	BytesWritten int64
+	//Duration time taken by the call
+	Duration time.Duration
+	//Skipped indices of the shards skipped because late, in increasing order
+	//(see ProcessOptions.SkipLate)
+	Skipped []int
 }
 
-//ReadChunks read file to process chunks concurrently
-//filename path of file to read
+//ReadChunksFrom read chunks to process them concurrently
+//ctx context that stops the reading when cancelled
+//r reader of the data to split in chunks, for example a file
+//or an in-memory buffer
 //output channel where the chunks are fed for concurrent processing
 //size length in bytes of each chunk
-func readChunks(filename string, output chan shard, size int) {
-	//close channel on exit to signal end of input operations
-	defer close(output)
-	//open filename
-	file, err := os.Open(filename)
+//every chunk is size bytes long except the last one, which holds the
+//remaining len%size bytes if the length of the data is not a multiple of size
+//return the first error encountered while reading, an error wrapping
+//ErrInvalidSize if size is not positive,
+//or ctx.Err() if the context is cancelled before the end of the data
+func ReadChunksFrom(ctx context.Context, r io.Reader, output chan Shard, size int) error {
+	return readChunksFrom(ctx, r, output, size, 0, nil, nil)
+}
+
+//IterShards read the shards of a file lazily, one at a time
+//ctx context that stops the reading when cancelled
+//filePath path to the file, it must be a regular file (see ErrNotRegular)
+//size size of the shards, 0 if the file was written with framed shards
+//the shards are read as they are consumed, each in its own buffer that the
+//consumer can keep, so ranging over them holds only one shard in memory
+//return a channel yielding the shards in index order, closed at the end of
+//the file, on error or when ctx is cancelled, and a channel where exactly one
+//value is sent after that: the first error encountered opening or reading
+//the file, ctx.Err() if the iteration was cancelled, or nil
+func IterShards(ctx context.Context, filePath string, size int) (<-chan Shard, <-chan error) {
+	output := make(chan Shard)
+	errChannel := make(chan error, 1)
+	file, err := openRegular(filePath)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return
+		close(output)
+		errChannel <- err
+		return output, errChannel
 	}
-	//close file on exit
-	defer func() {
-		if err = file.Close(); err != nil {
-			fmt.Println("Error closing file:", err)
+	go func() {
+		//close file on exit
+		defer file.Close()
+		if size == 0 {
+			errChannel <- readFramesFrom(ctx, file, output, 0, nil)
+			return
 		}
+		errChannel <- readChunksFrom(ctx, file, output, size, 0, nil, nil)
 	}()
+	return output, errChannel
+}
+
+//readChunksFrom read chunks to process them concurrently
+//parameters as in ReadChunksFrom, plus:
+//first index of the first chunk read
+//window semaphore acquired before feeding each chunk, in index order,
+//nil not to limit the chunks fed
+//buffers pool of the chunk buffers, released by the writer, nil to allocate
+//a fresh buffer for every chunk
+//the channel is closed both at the end of the data and on error, so the
+//error returned is the only way to tell a complete input from a truncated
+//one: the callers must check it before reporting success
+//return nil at the end of the data, the first error encountered while
+//reading, or ctx.Err() if the context is cancelled before the end of the data
+func readChunksFrom(ctx context.Context, r io.Reader, output chan Shard, size, first int, window chan struct{}, buffers *chunkBuffers) error {
+	//close channel on exit to signal end of input operations
+	defer close(output)
+	//empty chunks would be read forever
+	if size <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
 	//buffered reading
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, size)
-	for i := 0; ; i++ {
+	reader := bufio.NewReader(r)
+	for i := first; ; i++ {
+		//stop reading as soon as the context is cancelled
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		//every chunk has its own buffer, owned by the shard it is fed in
+		buffer := buffers.get(i)
+		if buffer == nil {
+			buffer = make([]byte, size)
+		}
 		n, err := io.ReadFull(reader, buffer)
-		if err != nil && err != io.ErrUnexpectedEOF {
-			if err != io.EOF {
-				fmt.Println("Error reading file:", err)
+		partial := false
+		switch {
+		case err == nil:
+			//full chunk, more data may follow
+		case n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF):
+			//clean end of the data: the previous chunk was the last one,
+			//so a length multiple of size gives no empty final chunk;
+			//some readers report the end as ErrUnexpectedEOF even with
+			//nothing read, which must not give an empty shard either
+			buffers.release(i)
+			return nil
+		case err == io.ErrUnexpectedEOF:
+			//clean end of the data after a final partial chunk of
+			//n < size bytes, which is still fed
+			partial = true
+		default:
+			//genuine read error partway through the data, the chunks
+			//fed so far are not the whole input: fail the processing
+			buffers.release(i)
+			return fmt.Errorf("error reading file at chunk %d: %w", i, err)
+		}
+		//wait for room in the window
+		if window != nil {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			break
-		} else {
-			//feed chunk to channel
-			output <- shard{i, string(buffer[0:n])}
+		}
+		//feed chunk to channel
+		select {
+		case output <- Shard{i, buffer[0:n]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		//nothing can follow a partial chunk
+		if partial {
+			return nil
 		}
 	}
 }
 
-//WriteResults collect results of concurrent processing and write on file
-//results channel that feeds the results to collect
-//filename path of output file
-//done channel to signal completion: true for success, false for failure
-func writeResults(results chan shard, filename string, done chan bool) {
-	//collect results with a map
-	result := make(map[int]string)
-	for ct := range results {
-		result[ct.index] = ct.value
-	}
-	//open output file
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		fmt.Println(err)
-		done <- false
+//pendingShards shards received out of order, waiting to be emitted
+type pendingShards interface {
+	//put store a shard
+	put(ct Shard)
+	//take remove and return the value of the shard with the given index, if present
+	take(index int) ([]byte, bool)
+	//has report whether the shard with the given index is stored
+	has(index int) bool
+	//size number of shards stored
+	size() int
+}
+
+//mapPending pendingShards for any index
+type mapPending map[int][]byte
+
+func (p mapPending) put(ct Shard) {
+	p[ct.Index] = ct.Value
+}
+
+func (p mapPending) take(index int) ([]byte, bool) {
+	value, ok := p[index]
+	if ok {
+		delete(p, index)
+	}
+	return value, ok
+}
+
+func (p mapPending) has(index int) bool {
+	_, ok := p[index]
+	return ok
+}
+
+func (p mapPending) size() int {
+	return len(p)
+}
+
+//slicePending pendingShards in a slice indexed by the distance from the next
+//shard to emit, which avoids a map insertion per shard when the indices are dense
+//indices too far ahead, or already emitted, are kept in a map
+type slicePending struct {
+	//index of the shard in values[head], the next to emit
+	base int
+	//values of the shards from base, present[i] if values[i] is stored
+	values  [][]byte
+	present []bool
+	//position of base in values, the emitted shards before it are
+	//dropped by moving the following ones to the start, so the arrays are
+	//reused instead of being reallocated as they are consumed
+	head int
+	//number of shards stored in values
+	count int
+	//maximum distance from base stored in values
+	limit int
+	//shards outside [base, base+limit)
+	sparse mapPending
+}
+
+//newPending build the pendingShards for ordering shards
+//first index of the first shard to emit
+//hint number of consecutive indices expected from first, or at most in
+//flight at once, 0 or less if unknown
+//return a slice-backed store covering hint indices ahead if it is known,
+//a map otherwise
+func newPending(first, hint int) pendingShards {
+	if hint <= 0 {
+		return mapPending{}
+	}
+	//the slice grows with the shards actually received
+	capHint := hint
+	if capHint > 1024 {
+		capHint = 1024
+	}
+	return &slicePending{
+		base:    first,
+		values:  make([][]byte, 0, capHint),
+		present: make([]bool, 0, capHint),
+		limit:   hint,
+		sparse:  mapPending{},
+	}
+}
+
+func (p *slicePending) put(ct Shard) {
+	offset := ct.Index - p.base
+	if offset < 0 || offset >= p.limit {
+		p.sparse.put(ct)
 		return
 	}
-	//close file on exit
+	offset += p.head
+	for len(p.values) <= offset {
+		p.values = append(p.values, nil)
+		p.present = append(p.present, false)
+	}
+	if !p.present[offset] {
+		p.count++
+	}
+	p.values[offset] = ct.Value
+	p.present[offset] = true
+}
+
+func (p *slicePending) take(index int) ([]byte, bool) {
+	if index != p.base || len(p.present) <= p.head || !p.present[p.head] {
+		//a shard stored in the map can be the next one, after a shard
+		//received too far ahead
+		value, ok := p.sparse.take(index)
+		if ok && index == p.base {
+			p.advance()
+		}
+		return value, ok
+	}
+	value := p.values[p.head]
+	//release the value and move on to the next index
+	p.values[p.head] = nil
+	p.present[p.head] = false
+	p.count--
+	p.advance()
+	return value, true
+}
+
+//advance move base past the shard just emitted
+func (p *slicePending) advance() {
+	p.base++
+	if p.head == len(p.values) {
+		//no slot for the shard emitted
+		return
+	}
+	p.head++
+	switch {
+	case p.head == len(p.values):
+		p.values, p.present, p.head = p.values[:0], p.present[:0], 0
+	case p.head >= len(p.values)-p.head:
+		//at most as many shards to move as were emitted since the last move
+		n := copy(p.values, p.values[p.head:])
+		copy(p.present, p.present[p.head:])
+		for i := n; i < len(p.values); i++ {
+			p.values[i] = nil
+			p.present[i] = false
+		}
+		p.values, p.present, p.head = p.values[:n], p.present[:n], 0
+	}
+}
+
+func (p *slicePending) has(index int) bool {
+	offset := index - p.base + p.head
+	if offset >= p.head && offset < len(p.present) && p.present[offset] {
+		return true
+	}
+	return p.sparse.has(index)
+}
+
+func (p *slicePending) size() int {
+	return p.count + p.sparse.size()
+}
+
+//lateShards what orderResults does when the next shard to emit is late
+//the zero value waits indefinitely
+type lateShards struct {
+	//timeout time waited for the next shard once the previous one is
+	//emitted, 0 or negative to wait indefinitely
+	timeout time.Duration
+	//skip called with the index of a shard that is late while some following
+	//shard has arrived, to go on without it, which is then dropped if it
+	//arrives; nil to fail with ErrShardTimeout instead
+	skip func(index int)
+	//clock clock measuring the timeout, nil for the system clock
+	clock clock
+	//shard time allowed to the process function for a single shard, 0 or
+	//negative for no limit (see processShard)
+	shard time.Duration
+}
+
+//ErrShardTimeout the next shard in index order was not processed within
+//ProcessOptions.FlushTimeout, or a shard within ProcessOptions.ShardTimeout:
+//the process function may be stuck
+var ErrShardTimeout = errors.New("shard not processed in time")
+
+//orderResults put in index order the results of concurrent processing
+//ctx context that aborts the ordering when cancelled
+//results channel that feeds the results to order, always drained: before
+//returning, except after a timeout, since the late shard may never come,
+//when it is drained in the background
+//first index of the first shard to emit
+//hint number of consecutive shards expected from first, or at most in
+//flight at once, to keep the out-of-order shards in a slice rather than a
+//map, 0 or less if unknown
+//late what to do when the next shard is late, the time spent in emit
+//is not counted
+//emit function called on each shard in index order
+//contiguous runs are emitted as soon as they are complete
+//and only the out-of-order shards are kept in memory
+//return the first error returned by emit, ctx.Err() if the context is
+//cancelled, an error wrapping ErrShardTimeout if a shard is late and
+//late.skip is nil, or an error listing the missing indices if the shards
+//received are not contiguous from first
+func orderResults(ctx context.Context, results <-chan Shard, first, hint int, late lateShards, emit func(Shard) error) error {
+	//drain results on exit so that the producers never block
+	timedOut := false
 	defer func() {
-		if err = file.Close(); err != nil {
-			fmt.Println("Error closing file:", err)
-			done <- false
+		drain := func() {
+			for range results {
+			}
+		}
+		if timedOut {
+			go drain()
+			return
 		}
+		drain()
 	}()
-	//write results on file in the correct order
-	for i := 0; i < len(result); i++ {
-		_, err = file.WriteString(result[i])
+	//the slice store cannot move past a missing index
+	if late.skip != nil {
+		hint = 0
+	}
+	//shards arrived before the next one to emit
+	pending := newPending(first, hint)
+	next := first
+	last := first - 1
+	//the deadline of the next shard, moved whenever a shard is emitted; the
+	//timer is not reset then, but rearmed for the rest of the time on expiry
+	var deadline <-chan time.Time
+	var due time.Time
+	clk := orRealClock(late.clock)
+	restart := func() {}
+	arm := func(time.Duration) {}
+	if late.timeout > 0 {
+		var timer clockTimer
+		arm = func(d time.Duration) {
+			timer = clk.NewTimer(d)
+			deadline = timer.C()
+		}
+		defer func() {
+			timer.Stop()
+		}()
+		restart = func() {
+			due = clk.Now().Add(late.timeout)
+		}
+		restart()
+		arm(late.timeout)
+	}
+	for open := true; open; {
+		waiting := next
+		select {
+		case ct, ok := <-results:
+			if !ok {
+				open = false
+				continue
+			}
+			//stop emitting partial results of a cancelled run
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			//a skipped shard arriving late is dropped
+			if ct.Index >= next {
+				pending.put(ct)
+			}
+			if ct.Index > last {
+				last = ct.Index
+			}
+		case <-deadline:
+			if wait := due.Sub(clk.Now()); wait > 0 {
+				arm(wait)
+				continue
+			}
+			if late.skip == nil {
+				timedOut = true
+				return fmt.Errorf("%w: waited %v for shard %d", ErrShardTimeout, late.timeout, next)
+			}
+			//with nothing behind it the shard may not even exist
+			if pending.size() > 0 {
+				late.skip(next)
+				next++
+			}
+			restart()
+			arm(late.timeout)
+		}
+		//emit the contiguous run starting from the next expected index
+		for value, ok := pending.take(next); ok; value, ok = pending.take(next) {
+			if err := emit(Shard{next, value}); err != nil {
+				return err
+			}
+			next++
+		}
+		if next != waiting {
+			restart()
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	//shards still pending mean that some previous index never arrived
+	if pending.size() > 0 {
+		return fmt.Errorf("missing shards: %v", missingIndices(pending, next, last))
+	}
+	return nil
+}
+
+//missingIndices list the indices absent from the pending shards
+//pending shards received but not yet emitted
+//from first index not emitted
+//to highest index received
+//return the sorted list of indices in [from..to] not present in pending
+func missingIndices(pending pendingShards, from, to int) []int {
+	var missing []int
+	for i := from; i <= to; i++ {
+		if !pending.has(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+//WriteResultsTo collect results of concurrent processing and write them
+//results channel that feeds the results to collect, always drained
+//w where to write the results, for example a file or an in-memory buffer
+//framed true to prefix each shard with its length (see writeFrame)
+//total number of shards expected, -1 if unknown, passed to progress
+//progress callback invoked after every shard written and at completion, can be nil
+//done channel to signal completion: nil for success, the error otherwise
+//exactly one value is sent on done
+func WriteResultsTo(results <-chan Shard, w io.Writer, framed bool, total int, progress ProgressFunc, done chan error) {
+	done <- writeOrdered(results, w, 0, framed, total, progress, nil, nil)
+}
+
+//writeResults collect results of concurrent processing and write on file
+//results channel that feeds the results to collect, always drained
+//filename path of output file
+//mode how an existing output file is treated
+//framed true to prefix each shard with its length (see writeFrame)
+//total number of shards expected, -1 if unknown, passed to progress
+//progress callback invoked after every shard written and at completion, can be nil
+//done channel to signal completion: nil for success, the error otherwise
+//exactly one value is sent on done, nil only after the file is synced to
+//stable storage
+//the writes failing with transient errors are retried (see WriteRetry)
+//the results are written on filename+TempSuffix, renamed to filename only
+//once all of them are written (see commitTemp), so a failed or interrupted
+//run never leaves a partial output under filename
+func writeResults(results <-chan Shard, filename string, mode WriteMode, framed bool, total int, progress ProgressFunc, done chan error) {
+	//open temporary output file
+	file, err := createTemp(filename, mode, OutputPerm)
+	if err != nil {
+		//drain results so that the producers never block
+		for range results {
+		}
+		done <- err
+		return
+	}
+	err = writeOrdered(results, retryWriter{file, WriteRetry, nil}, 0, framed, total, progress, nil, nil)
+	//move the output into place only once it is complete
+	if err == nil {
+		err = commitTemp(file, filename, mode, true)
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	done <- err
+}
+
+//widthCheck check that unframed shards can be told apart once concatenated
+type widthCheck struct {
+	//width length of the shards, -1 before the first
+	width int
+	//short true once a shorter shard, which must be the last, was seen
+	short bool
+}
+
+//newWidthCheck check of a series of shards starting from the first
+func newWidthCheck() *widthCheck {
+	return &widthCheck{-1, false}
+}
+
+//check check the next shard in index order
+//ct shard to check
+//return an error wrapping ErrVariableLength if ct is longer than the
+//first shard or follows a shorter one
+func (c *widthCheck) check(ct Shard) error {
+	if c.width < 0 {
+		c.width = len(ct.Value)
+	}
+	if c.short || len(ct.Value) > c.width {
+		return fmt.Errorf("%w: shard %d has %d bytes instead of %d", ErrVariableLength, ct.Index, len(ct.Value), c.width)
+	}
+	c.short = len(ct.Value) < c.width
+	return nil
+}
+
+//writeOrdered write results of concurrent processing as they arrive
+//results channel that feeds the results to collect, always drained
+//w where to write the results
+//first index of the first shard to write
+//framed true to prefix each shard with its length (see writeFrame)
+//total number of shards expected, -1 if unknown, passed to progress
+//progress callback invoked after every shard written and at completion, can be nil
+//abort function called as soon as writing fails, before the remaining
+//results are drained, to cancel their processing, can be nil
+//buffers pool the results were read with, each buffer is released as soon as
+//its shard is written, can be nil
+//the shards are written in index order (see orderResults)
+//progress is only called from this goroutine, so it needs no synchronization,
+//and it reports the shards and bytes written by this call
+//without framing all the shards but the last must have the same length,
+//and the last cannot be longer, otherwise ErrVariableLength is returned
+//return the first error encountered while writing, or an error listing
+//the missing indices if the shards received are not contiguous from first
+func writeOrdered(results <-chan Shard, w io.Writer, first int, framed bool, total int, progress ProgressFunc, abort func(), buffers *chunkBuffers) error {
+	if progress == nil {
+		progress = func(int, int, int64) {}
+	}
+	written := 0
+	bytesWritten := int64(0)
+	width := newWidthCheck()
+	//a known total makes the indices dense
+	hint := 0
+	if total > first {
+		hint = total - first
+	}
+	write := func(ct Shard) error {
+		if !framed {
+			if err := width.check(ct); err != nil {
+				return err
+			}
+		}
+		var err error
+		if framed {
+			err = writeFrame(w, ct.Value)
+			bytesWritten += FrameHeaderSize
+		} else {
+			_, err = w.Write(ct.Value)
+		}
 		if err != nil {
-			fmt.Println(err)
-			done <- false
-			break
+			return fileError(ErrWriteOutput, "error writing file", err)
+		}
+		//the writer does not retain the value, so its chunk buffer is free
+		buffers.release(ct.Index)
+		written++
+		bytesWritten += int64(len(ct.Value))
+		progress(written, total, bytesWritten)
+		return nil
+	}
+	err := orderResults(context.Background(), results, first, hint, lateShards{}, func(ct Shard) error {
+		err := write(ct)
+		if err != nil && abort != nil {
+			abort()
 		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	//signal succesful completion of writing
-	done <- true
+	//report completion, even when nothing was written
+	progress(written, total, bytesWritten)
+	return nil
 }
 
-//ProcessFile read file and process it concurrently
-//then collect results and write on file
-//inputFile path to input file
-//outputFile path to output file
+//Chain compose process functions into a single one
+//stages process functions applied in the given order to each shard,
+//for example compression before encryption
+//return the function applying all the stages, stopping at the first error
+func Chain(stages ...ProcessFunc) ProcessFunc {
+	return func(inp Shard) (Shard, error) {
+		for _, stage := range stages {
+			var err error
+			inp, err = stage(inp)
+			if err != nil {
+				return inp, err
+			}
+		}
+		return inp, nil
+	}
+}
+
+//ProcessStream read data and process it concurrently
+//ctx context to cancel the processing: when cancelled the reading stops,
+//the pending chunks are drained and ctx.Err() is sent on the error channel
+//r reader of the data to process
 //process function that processes each chunk
-//num number of chunks to process concurrently
-//size size of chunks to process
-func ProcessFile(inputFile, outputFile string, process func(shard) shard, num, size int) {
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of chunks to process, 0 to process the shards of data written
+//with framed shards, stripped of their length prefix
+//at most num+MaxReorder+ReadAhead shards, and no more than MaxInFlightBytes, are read
+//and not yet yielded at any time
+//if process fails or panics on a shard the whole run is aborted with an error
+//return a channel yielding the processed shards in index order, closed when
+//the input is exhausted or ctx is cancelled, and a channel where exactly one
+//value is sent after that: the first error encountered, or nil on success
+func ProcessStream(ctx context.Context, r io.Reader, process ProcessFunc, num, size int) (<-chan Shard, <-chan error) {
+	return processStream(ctx, r, process, num, size, 0, nil, nil, lateShards{})
+}
+
+//processStream read data and process it concurrently
+//parameters as in ProcessStream, plus:
+//first index of the first chunk read from r
+//buffers pool to read the chunks with, nil to allocate them, the consumer of
+//the shards must release them (see writeOrdered)
+//metrics metrics of the reading and processing, the consumer records the
+//shards written, can be nil
+//late what to do when the next shard to yield is late (see orderResults),
+//the skipped shards are missing from the yielded ones
+//return the channel of the processed shards and the error channel
+func processStream(ctx context.Context, r io.Reader, process ProcessFunc, num, size, first int, buffers *chunkBuffers, metrics *Metrics, late lateShards) (<-chan Shard, <-chan error) {
+	//at least one worker is needed to drain the read channel
+	num = workerCount(num)
+	metrics.begin(num)
+	r = metrics.reader(r)
+	//the run is aborted as soon as a shard fails
+	ctx, cancel := context.WithCancel(ctx)
+	var failOnce sync.Once
+	var failErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failErr = err
+			cancel()
+		})
+	}
 	//channels for feeding plaintexts and ciphertexts to the routines
-	readChannel := make(chan shard, num)
-	resultChannel := make(chan shard, num)
-	//read file
-	go readChunks(inputFile, readChannel, size)
+	readChannel := make(chan Shard, readAhead(num))
+	resultChannel := make(chan Shard, num)
+	//unbuffered, so that a shard leaves the window only once the consumer
+	//received it and the shards it holds count in the window
+	orderedChannel := make(chan Shard)
+	errChannel := make(chan error, 1)
+	//shards read and not yet yielded, acquired in index order by the reader
+	//and released in the same order, so the next shard to yield always has
+	//its place in the window
+	window := make(chan struct{}, windowSize(num, size))
+	//read data
+	readErr := make(chan error, 1)
+	go func() {
+		if size == 0 {
+			readErr <- readFramesFrom(ctx, r, readChannel, first, window)
+			return
+		}
+		readErr <- readChunksFrom(ctx, r, readChannel, size, first, window, buffers)
+	}()
 	//concurrently encrypt each shard
 	var wg sync.WaitGroup
 	for i := 0; i < num; i++ {
 		wg.Add(1)
 		go func() {
 			for read := range readChannel {
+				//drain without processing once cancelled
+				if ctx.Err() != nil {
+					continue
+				}
 				//process and feed result to output channel
-				resultChannel <- process(read)
+				metrics.startShard()
+				result, err := processShard(ctx, process, read, late.shard)
+				metrics.endShard(err == nil)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				select {
+				case resultChannel <- result:
+				case <-ctx.Done():
+				}
 			}
 			wg.Done()
 		}()
 	}
+	//signal end of encryption to finalise ordering
+	go func() {
+		wg.Wait()
+		close(resultChannel)
+	}()
+	//order results
+	go func() {
+		defer close(orderedChannel)
+		//a skipped shard was fed, so it frees its place in the window
+		if skip := late.skip; skip != nil {
+			late.skip = func(index int) {
+				<-window
+				skip(index)
+			}
+		}
+		//the window bounds how far ahead the shards can be
+		orderErr := orderResults(ctx, resultChannel, first, cap(window), late, func(ct Shard) error {
+			select {
+			case orderedChannel <- ct:
+				<-window
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		//stop the reader and the workers, which have all returned unless a
+		//shard timed out: its worker may never return, so it is not waited for
+		cancel()
+		readErr := <-readErr
+		//no worker still running can set failErr once it is read
+		failOnce.Do(func() {})
+		//the failure of a shard causes the others, then reading errors,
+		//except for the cancellation following a timeout
+		switch {
+		case failErr != nil:
+			errChannel <- failErr
+		case readErr != nil && !errors.Is(orderErr, ErrShardTimeout):
+			errChannel <- readErr
+		default:
+			errChannel <- orderErr
+		}
+	}()
+	return orderedChannel, errChannel
+}
+
+//processShard apply the process function to a shard within a deadline
+//ctx context of the run
+//process function that processes the shard
+//inp shard to process
+//timeout time allowed to process the shard, 0 or negative for no limit
+//the process function cannot be interrupted, so once the deadline expires
+//it is left running and its result discarded, while the run is aborted
+//return the result of safeProcess, an IndexError wrapping ErrShardTimeout
+//if the deadline expires first, or ctx.Err() if the run is cancelled
+func processShard(ctx context.Context, process ProcessFunc, inp Shard, timeout time.Duration) (Shard, error) {
+	if timeout <= 0 {
+		return safeProcess(process, inp)
+	}
+	shardCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type outcome struct {
+		result Shard
+		err    error
+	}
+	//buffered, so that a call abandoned past its deadline can still return
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := safeProcess(process, inp)
+		done <- outcome{result, err}
+	}()
+	select {
+	case out := <-done:
+		return out.result, out.err
+	case <-shardCtx.Done():
+		if ctx.Err() != nil {
+			return Shard{}, ctx.Err()
+		}
+		return Shard{}, &IndexError{int64(inp.Index), fmt.Errorf("%w: still processing after %v", ErrShardTimeout, timeout)}
+	}
+}
+
+//safeProcess apply the process function to a shard
+//process function that processes the shard
+//inp shard to process
+//return the processed shard, or an error naming the shard if process fails
+//or panics, so that a failing shard aborts the run instead of being lost,
+//wrapping the error or the panic value if it is an error
+func safeProcess(process ProcessFunc, inp Shard) (result Shard, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			//keep errors inspectable with errors.Is and errors.As
+			if rerr, ok := r.(error); ok {
+				err = fmt.Errorf("processing shard %d failed: %w", inp.Index, rerr)
+				return
+			}
+			err = fmt.Errorf("processing shard %d failed: %v", inp.Index, r)
+		}
+	}()
+	result, err = process(inp)
+	if err != nil {
+		return result, fmt.Errorf("processing shard %d failed: %w", inp.Index, err)
+	}
+	return result, nil
+}
+
+//maxReorder size of the reorder window
+//return MaxReorder, or 0 if it is negative
+func maxReorder() int {
+	if MaxReorder < 0 {
+		return 0
+	}
+	return MaxReorder
+}
+
+//readAhead number of chunks read ahead of the workers
+//num number of workers
+//return ReadAhead, or num if it is not positive
+func readAhead(num int) int {
+	if ReadAhead <= 0 {
+		return num
+	}
+	return ReadAhead
+}
+
+//windowSize number of shards that can be read and not yet yielded
+//num number of workers
+//size size of the chunks
+//return num+MaxReorder, plus ReadAhead if set, reduced to fit in
+//MaxInFlightBytes if set, but at least 1
+func windowSize(num, size int) int {
+	window := num + maxReorder()
+	if ReadAhead > 0 {
+		window += ReadAhead
+	}
+	if MaxInFlightBytes > 0 && size > 0 {
+		budget := MaxInFlightBytes / int64(size)
+		if budget < int64(window) {
+			window = int(budget)
+		}
+	}
+	if window < 1 {
+		window = 1
+	}
+	return window
+}
+
+//workerCount number of workers to use for processing
+//num number requested by the caller
+//return num if positive, runtime.NumCPU() otherwise
+func workerCount(num int) int {
+	if num <= 0 {
+		return runtime.NumCPU()
+	}
+	return num
+}
+
+//fileWorkers number of workers to process a file
+//num number of workers requested, as in workerCount
+//shards number of shards left to process, negative if unknown
+//return num, reduced so that each worker has at least MinShardsPerWorker
+//shards, but at least 1
+func fileWorkers(num, shards int) int {
+	num = workerCount(num)
+	if shards < 0 || MinShardsPerWorker <= 0 {
+		return num
+	}
+	needed := (shards + MinShardsPerWorker - 1) / MinShardsPerWorker
+	if needed < 1 {
+		needed = 1
+	}
+	if needed < num {
+		return needed
+	}
+	return num
+}
+
+//ProcessReader read data and process it concurrently
+//then collect results and write them
+//ctx context to cancel the processing: when cancelled the reading stops,
+//the pending chunks are drained and ctx.Err() is returned
+//r reader of the data to process
+//w where to write the processed data
+//process function that processes each chunk
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of chunks to process, 0 if r holds framed shards
+//framed true to write each processed shard prefixed by its length,
+//necessary if process changes the length of the shards, false to write them
+//concatenated as they are
+//progress callback reporting the writing progress, can be nil,
+//the total number of shards is unknown and reported as -1
+//return the first error encountered reading the input or writing the output
+func ProcessReader(ctx context.Context, r io.Reader, w io.Writer, process ProcessFunc, num, size int, framed bool, progress ProgressFunc) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	buffers := newChunkBuffers(size)
+	results, streamErr := processStream(streamCtx, r, process, num, size, 0, buffers, nil, lateShards{})
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writeOrdered(results, w, 0, framed, -1, progress, cancel, buffers)
+	}()
+	return waitProcessing(ctx, streamErr, writeErr)
+}
+
+//ProcessFile read file and process it concurrently
+//then collect results and write on file
+//ctx context to cancel the processing: when cancelled the reading stops,
+//the pending chunks are drained and ctx.Err() is returned
+//inputFile path to input file, it must be a regular file (see ErrNotRegular)
+//outputFile path to output file, it must be different from inputFile
+//process function that processes each chunk
+//num number of chunks to process concurrently, if num <= 0 runtime.NumCPU() is used
+//size size of chunks to process, it must be positive
+//the memory held is bounded by MaxReorder, ReadAhead and MaxInFlightBytes
+//framed true to write each processed shard prefixed by its length,
+//necessary if process changes the length of the shards, false to write them
+//concatenated as they are
+//manifest true to also write outputFile+ManifestSuffix, listing the
+//SHA-256 of every shard written (see VerifyManifest) and the length of the
+//input chunk it comes from (see NewLengthRestorer)
+//resume true to checkpoint the shards written on outputFile+ProgressSuffix
+//and, if a checkpoint of a previous interrupted run exists, to continue from
+//it instead of starting over (see ResumeFrom); when ctx is cancelled the
+//shards already processed in order are written and checkpointed before
+//ctx.Err() is returned, so that the next run continues right after them;
+//the output is synced before every checkpoint, and the checkpoint is removed
+//once the run completes
+//mode how an existing output file (and manifest) is treated, unless a run
+//is resumed, by default WriteTruncate
+//progress callback reporting the writing progress, can be nil,
+//the total number of shards is computed from the size of the input file
+//the output is written on outputFile+TempSuffix and renamed over outputFile
+//once complete (see commitTemp), so a failed or interrupted run never leaves
+//a partial output under outputFile, and an existing output stays as it was;
+//the manifest likewise, renamed just before the output, so that an existing
+//output keeps verifying against its manifest;
+//a resumable run is the exception, writing outputFile in place, since its
+//checkpoints describe the part already written
+//the output and manifest are synced to stable storage before success is
+//reported, ProcessOptions.NoSync skips it
+//the writes failing with transient errors are retried (see WriteRetry)
+//the same options can be passed as a ProcessOptions to ProcessFileWithOptions
+//the output depends only on the input, size, framed and process: every
+//chunk is processed once and written at its index whatever num and the
+//scheduling of the workers, so a deterministic process gives the same
+//bytes, and the same manifest and Merkle root, on every machine; the
+//AEAD encryptors use random nonces unless AEADOptions.Deterministic or
+//AEADOptions.Nonce is set
+//return what was written, or the first error encountered reading the input
+//or writing the output
+func ProcessFile(ctx context.Context, inputFile, outputFile string, process ProcessFunc, num, size int, framed, manifest, resume bool, mode WriteMode, progress ProgressFunc) (Result, error) {
+	return processFile(ctx, inputFile, outputFile, process, ProcessOptions{
+		Workers:   num,
+		ChunkSize: size,
+		Framed:    framed,
+		Manifest:  manifest,
+		Resume:    resume,
+		Mode:      mode,
+		Progress:  progress,
+	})
+}
+
+//processFile read file and process it concurrently
+//then collect results and write on file
+//parameters as in ProcessFileWithOptions, except that opts.ChunkSize must be
+//positive, plus:
+//observers functions called on every processed shard in index order before
+//it is written, from a single goroutine, the first error they return is
+//reported after the writing completes
+//return what was written, or the first error encountered reading the input
+//or writing the output
+func processFile(ctx context.Context, inputFile, outputFile string, process ProcessFunc, opts ProcessOptions, observers ...func(Shard) error) (res Result, err error) {
+	start := time.Now()
+	num, size, framed, manifest, resume, mode, progress := opts.Workers, opts.ChunkSize, opts.Framed, opts.Manifest, opts.Resume, opts.Mode, opts.Progress
+	perm := opts.Perm
+	if perm == 0 {
+		perm = OutputPerm
+	}
+	if size <= 0 {
+		return res, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	if opts.SkipLate {
+		return res, errors.New("late shards can only be skipped for shard sinks")
+	}
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return res, err
+	}
+	//close file on exit
+	defer file.Close()
+	//compute the number of shards to report progress
+	inputSize := int64(-1)
+	total := -1
+	if fi, err := file.Stat(); err == nil {
+		inputSize = fi.Size()
+		total = int(shardCount(inputSize, int64(size)))
+	}
+	//pick up from the checkpoint of a previous run
+	cp := checkpoint{-1, 0, false}
+	found := false
+	if resume {
+		cp, found, err = readCheckpoint(outputFile)
+		if err != nil {
+			return res, err
+		}
+		//the previous run already wrote the final partial shard
+		if found && cp.partial {
+			if err := skipInput(file, inputSize, opts.InputHash); err != nil {
+				return res, err
+			}
+			return Result{ShardsWritten: cp.last + 1, BytesWritten: cp.offset}, nil
+		}
+		//a checkpoint past the end of the input does not belong to it
+		offset, err := valueOffset(int64(cp.last)+1, int64(size))
+		if err != nil || inputSize >= 0 && offset > inputSize {
+			return res, fmt.Errorf("checkpoint of shard %d past the end of %s", cp.last, inputFile)
+		}
+		if err := skipInput(file, offset, opts.InputHash); err != nil {
+			return res, err
+		}
+	}
+	first := cp.last + 1
+	//the output is overwritten, so it cannot be the input itself
+	if ofi, err := os.Stat(outputFile); err == nil {
+		if ifi, err := file.Stat(); err == nil && os.SameFile(ifi, ofi) {
+			return res, errors.New("input and output are the same file")
+		}
+	}
+	//write on a temporary file moved into place once complete, except when
+	//resuming: the checkpoints describe the partial output, so it is written
+	//in place according to mode, keeping the part written before the checkpoint
+	var out *os.File
+	if resume {
+		flag := mode.openFlags()
+		if found {
+			flag = os.O_WRONLY | os.O_CREATE
+		}
+		if out, err = os.OpenFile(outputFile, flag, perm); err != nil {
+			return res, fileError(ErrOpenOutput, "error opening file", err)
+		}
+	} else if out, err = createTemp(outputFile, mode, perm); err != nil {
+		return res, err
+	}
+	committed := false
+	//close output on exit, removing the temporary file unless committed
+	defer func() {
+		if committed {
+			return
+		}
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fileError(ErrCloseOutput, "error closing file", cerr)
+		}
+		if !resume && err != nil {
+			os.Remove(out.Name())
+		}
+	}()
+	if found {
+		if err = out.Truncate(cp.offset); err == nil {
+			_, err = out.Seek(cp.offset, io.SeekStart)
+		}
+		if err != nil {
+			return res, fmt.Errorf("error resuming file: %w", err)
+		}
+	}
+	if err := preallocate(out, opts.Preallocate); err != nil {
+		return res, err
+	}
+	//write the manifest along with the output, on its own temporary file
+	//committed just before the output unless resuming
+	var mf *os.File
+	var mw *bufio.Writer
+	if manifest {
+		hf := opts.Hash.orDefault()
+		if mf, err = openManifest(outputFile, cp.last, resume, mode, perm, hf); err != nil {
+			return res, err
+		}
+		mw = bufio.NewWriter(mf)
+		//flush and close manifest on exit, unless committed
+		defer func() {
+			if committed {
+				return
+			}
+			ferr := mw.Flush()
+			if ferr == nil && err == nil && !opts.NoSync {
+				ferr = mf.Sync()
+			}
+			if cerr := mf.Close(); ferr == nil {
+				ferr = cerr
+			}
+			if ferr != nil && err == nil {
+				err = fileError(ErrWriteOutput, "error writing manifest", ferr)
+			}
+			//a failed run leaves the previous manifest along with its output
+			if !resume && err != nil {
+				os.Remove(mf.Name())
+			}
+		}()
+		observers = append(observers, manifestObserver(mw, size, inputSize, hf))
+	}
+	//report progress from the start of the file, checkpointing if required
+	metrics, lastShards, lastBytes := opts.Metrics, 0, int64(0)
+	written := func(shardsDone, totalShards int, bytesWritten int64) {
+		//the last call reports completion without a new shard
+		if shardsDone > lastShards {
+			metrics.written(bytesWritten - lastBytes)
+		}
+		lastShards, lastBytes = shardsDone, bytesWritten
+		res.ShardsWritten = first + shardsDone
+		res.BytesWritten = cp.offset + bytesWritten
+		if progress != nil {
+			progress(first+shardsDone, totalShards, cp.offset+bytesWritten)
+		}
+	}
+	if resume {
+		var sync func() error
+		if !opts.NoSync {
+			sync = func() error { return syncOutput(out) }
+		}
+		written = checkpointer(outputFile, cp, inputSize, size, sync, written)
+	}
+	//process file, until the writer fails
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	buffers := newChunkBuffers(size)
+	input := hashInput(throttle(streamCtx, opts.clock, file, opts.BytesPerSecond), opts.InputHash)
+	remaining := -1
+	if total >= 0 {
+		remaining = total - first
+	}
+	results, streamErr := processStream(streamCtx, input, process, fileWorkers(num, remaining), size, first, buffers, opts.Metrics, lateShards{timeout: opts.FlushTimeout, clock: opts.clock, shard: opts.ShardTimeout})
+	//let the observers see the ordered shards on their way to the writer
+	observeErr := make(chan error, 1)
+	if len(observers) > 0 {
+		observed := make(chan Shard, cap(results))
+		go func(results <-chan Shard) {
+			defer close(observed)
+			var err error
+			for ct := range results {
+				for _, observe := range observers {
+					if err == nil {
+						err = observe(ct)
+					}
+				}
+				observed <- ct
+			}
+			observeErr <- err
+		}(results)
+		results = observed
+	} else {
+		observeErr <- nil
+	}
 	//collect results and write them on file
-	writingSuccessful := make(chan bool)
-	go writeResults(resultChannel, outputFile, writingSuccessful)
-	//wait for every encryption to finish
-	wg.Wait()
-	//signal end of encryption to finalise result collection and writing
-	close(resultChannel)
-	//wait for writing completion
-	if <-writingSuccessful {
-		fmt.Println("file written successfully!")
+	writeErr := make(chan error, 1)
+	go func() {
+		output := limitOutput(retryWriter{out, opts.Retry.orDefault(), opts.clock}, opts.MaxOutputSize, cp.offset)
+		writeErr <- writeOrdered(results, output, first, framed, total, written, cancel, buffers)
+	}()
+	if err := waitProcessing(ctx, streamErr, writeErr); err != nil {
+		return res, err
+	}
+	if err := <-observeErr; err != nil {
+		return res, err
+	}
+	//report success only once the output is durable
+	if !resume {
+		//the manifest is moved into place first, so an output is never
+		//committed without its manifest
+		if mf != nil {
+			if err := mw.Flush(); err != nil {
+				return res, fileError(ErrWriteOutput, "error writing manifest", err)
+			}
+		}
+		committed = true
+		if mf != nil {
+			if err := commitTemp(mf, outputFile+ManifestSuffix, mode, !opts.NoSync); err != nil {
+				os.Remove(mf.Name())
+				out.Close()
+				os.Remove(out.Name())
+				return res, err
+			}
+		}
+		if err := commitTemp(out, outputFile, mode, !opts.NoSync); err != nil {
+			os.Remove(out.Name())
+			return res, err
+		}
+	} else {
+		if !opts.NoSync {
+			if err := syncOutput(out); err != nil {
+				return res, err
+			}
+		}
+		//the output is complete, a later run starts over
+		if err := removeCheckpoint(outputFile); err != nil {
+			return res, err
+		}
+	}
+	res.Duration = time.Since(start)
+	logln("file written successfully!")
+	return res, nil
+}
+
+//skipInput position the input where a resumed run starts reading
+//file input file, at its start
+//offset offset of the first chunk to read
+//h hash of the input, nil for none: the skipped bytes are read into it, so
+//that it covers the whole input as if the run had not been interrupted
+//return the error seeking or reading the file
+func skipInput(file *os.File, offset int64, h hash.Hash) error {
+	if h == nil {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fileError(ErrReadInput, "error seeking file", err)
+		}
+		return nil
+	}
+	if _, err := io.CopyN(h, file, offset); err != nil {
+		return fileError(ErrReadInput, "error reading file", err)
 	}
+	return nil
+}
+
+//hashInput feed a hash with the input as it is read
+//r reader of the input
+//h hash of the input, nil for none
+//the bytes are hashed in the order they are read, before any chunk is
+//processed, so the workers completing out of order do not affect the digest
+//return the reader to read the input from
+func hashInput(r io.Reader, h hash.Hash) io.Reader {
+	if h == nil {
+		return r
+	}
+	return io.TeeReader(r, h)
+}
+
+//openRegular open an input file, following symbolic links
+//filePath path to the file
+//directories, named pipes, devices and sockets are rejected before opening
+//them, since reading them fails or blocks: use ProcessReader to stream from
+//a pipe
+//return the open file, or an error wrapping ErrNotRegular or the os.Open error
+func openRegular(filePath string) (*os.File, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	mode := fi.Mode()
+	if !mode.IsRegular() {
+		kind := "special file"
+		switch {
+		case mode.IsDir():
+			kind = "directory"
+		case mode&os.ModeNamedPipe != 0:
+			kind = "named pipe"
+		case mode&os.ModeSocket != 0:
+			kind = "socket"
+		case mode&os.ModeDevice != 0:
+			kind = "device"
+		}
+		return nil, fmt.Errorf("%w: %s is a %s", ErrNotRegular, filePath, kind)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	return file, nil
+}
+
+//waitProcessing wait for processing and writing completion
+//ctx context of the caller, whose processing is cancelled by the writer
+//streamErr error channel of ProcessStream
+//writeErr done channel of the writer (see writeOrdered)
+//return the first error, processing errors come first unless they are the
+//cancellation caused by a failure of the writer
+func waitProcessing(ctx context.Context, streamErr <-chan error, writeErr chan error) error {
+	err := <-streamErr
+	werr := <-writeErr
+	if werr != nil && errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+//ShardCount number of shards of a file
+//filePath path to the file
+//size size of the shards, 0 if the file was written with framed shards
+//with fixed-size shards the count is computed from the size of the file, a
+//final partial shard included, so a file of 10 bytes has 4 shards of 3
+//bytes and 5 shards of 2; framed files are scanned (see BuildShardIndex)
+//return the number of shards, or an error wrapping ErrInvalidSize if size
+//is negative, or the error encountered reading the file
+func ShardCount(filePath string, size int64) (int64, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	if size == 0 {
+		idx, err := BuildShardIndex(filePath)
+		if err != nil {
+			return 0, err
+		}
+		return int64(idx.Len()), nil
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return shardCount(fi.Size(), size), nil
+}
+
+//shardCount number of fixed-size shards of some data
+//dataSize byte size of the data
+//size size of the shards, it must be positive
+//return dataSize/size rounded up, since the last shard can be partial
+func shardCount(dataSize, size int64) int64 {
+	count := dataSize / size
+	if dataSize%size != 0 {
+		count++
+	}
+	return count
 }
 
 //ReadValue read a single value from file
 //filePath path to the file containing a series of same-size values
-//index index of the desired value
+//index index of the desired value, negative to count from the end of the
+//file, so -1 is the last value (see ShardCount), which is partial if the
+//file ends in the middle of it
 //size size of the single values
-//return the encoding of the value read
-func ReadValue(filePath string, index, size int64) []byte {
+//if the file starts with a header (see EncryptFileWithHeader) the values
+//are read after it, and size must be the shard size it records
+//return the encoding of the value read, or an error that wraps:
+//	ErrInvalidSize if size is not positive
+//	ErrSizeMismatch if size differs from the one in the file header
+//	ErrInvalidIndex if index is before the first value or the offset overflows
+//	io.EOF if the value is past the end of the file
+//	ErrShortValue if the file ends in the middle of the value
+//	the os.Open or read error otherwise
+func ReadValue(filePath string, index, size int64) ([]byte, error) {
 	//open input file
 	file, err := os.Open(filePath)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return nil
+		return nil, fileError(ErrOpenInput, "error opening file", err)
 	}
 	//close file on exit
-	defer func() {
-		if err = file.Close(); err != nil {
-			fmt.Println("Error closing file:", err)
+	defer file.Close()
+	start, err := valueStart(file, size)
+	if err != nil {
+		return nil, err
+	}
+	index, err = fromEnd(file, start, index, size)
+	if err != nil {
+		return nil, err
+	}
+	return readValueAt(valueSection(file, start), index, size)
+}
+
+//ReadValuePartial read a single value from file as ReadValue, keeping the
+//bytes read when the value is incomplete, to recover what is left of a
+//truncated or damaged file
+//filePath path to the file containing a series of same-size values
+//index index of the desired value, negative to count from the end
+//size size of the single values
+//return the bytes read and their number, which is size on success; if the
+//file ends in the middle of the value, or reading it fails, the bytes read
+//before are returned along with the error wrapping ErrShortValue or the
+//read error, while for the other errors of ReadValue no byte is returned
+func ReadValuePartial(filePath string, index, size int64) (data []byte, n int, err error) {
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	start, err := valueStart(file, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err = fromEnd(file, start, index, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err = readPartialAt(valueSection(file, start), index, size)
+	return data, len(data), err
+}
+
+//fromEnd translate an index counted from the end of a file of values
+//file file containing a series of same-size values
+//start offset of the first value (see valueStart)
+//index index of the value, negative to count from the end
+//size size of the single values
+//return the index counted from the start, unchanged if not negative, or an
+//error wrapping ErrInvalidSize if size is not positive, ErrInvalidIndex if
+//index is before the first value, or the error of the stat
+func fromEnd(file *os.File, start, index, size int64) (int64, error) {
+	if index >= 0 {
+		return index, nil
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	count := shardCount(fi.Size()-start, size)
+	if index < -count {
+		return 0, fmt.Errorf("%w: index %d out of range for %d values", ErrInvalidIndex, index, count)
+	}
+	return count + index, nil
+}
+
+//IndexError error reading the value at a given index
+type IndexError struct {
+	Index int64
+	Err   error
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("value %d: %v", e.Index, e.Err)
+}
+
+func (e *IndexError) Unwrap() error {
+	return e.Err
+}
+
+//IndexErrors errors of all the values that could not be read
+type IndexErrors []*IndexError
+
+func (e IndexErrors) Error() string {
+	msg := make([]string, len(e))
+	for i, err := range e {
+		msg[i] = err.Error()
+	}
+	return strings.Join(msg, "; ")
+}
+
+//Is report whether any of the errors matches target, so that errors.Is
+//looks into every entry
+func (e IndexErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
 		}
-	}()
+	}
+	return false
+}
+
+//As find the first of the errors that matches target, so that errors.As
+//looks into every entry, in index order
+func (e IndexErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+//ReadValues read a batch of values from file
+//filePath path to the file containing a series of same-size values
+//indices indices of the desired values
+//size size of the single values
+//the file is opened once and the values are read in offset order, after the
+//header if any as in ReadValue
+//return the values in the order of indices; if some cannot be read their
+//entries are nil and the error is an IndexErrors with an entry for each of
+//them, wrapping the same errors returned by ReadValue, or an error wrapping
+//ErrSizeMismatch if size differs from the one in the file header
+func ReadValues(filePath string, indices []int64, size int64) ([][]byte, error) {
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	start, err := valueStart(file, size)
+	if err != nil {
+		return nil, err
+	}
+	values := valueSection(file, start)
+	//sort positions by index, and so by offset, for sequential access
+	order := make([]int, len(indices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return indices[order[a]] < indices[order[b]]
+	})
+	read := make([][]byte, len(indices))
+	var failed IndexErrors
+	for _, pos := range order {
+		read[pos], err = readValueAt(values, indices[pos], size)
+		if err != nil {
+			failed = append(failed, &IndexError{indices[pos], err})
+		}
+	}
+	if len(failed) > 0 {
+		return read, failed
+	}
+	return read, nil
+}
+
+//ReadRange read a run of consecutive values from file with a single read
+//filePath path to the file containing a series of same-size values
+//startIndex index of the first desired value
+//count number of desired values
+//size size of the single values
+//the run is clamped at the end of the file: only the values present in full
+//are returned, concatenated, so the number of values read is len(values)/size
+//and it is less than count if the file ends before; the values are read
+//after the header if any, as in ReadValue
+//return the values read, or an error that wraps:
+//	ErrInvalidSize if size is not positive
+//	ErrSizeMismatch if size differs from the one in the file header
+//	ErrInvalidIndex if startIndex or count are negative or the offset overflows
+//	io.EOF if there is no full value at startIndex
+//	the os.Open or read error otherwise
+func ReadRange(filePath string, startIndex, count, size int64) ([]byte, error) {
+	//validate values before computing the offset
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	if startIndex < 0 || count < 0 {
+		return nil, fmt.Errorf("%w: index %d, count %d", ErrInvalidIndex, startIndex, count)
+	}
+	offset, err := valueOffset(startIndex, size)
+	if err != nil {
+		return nil, err
+	}
+	//open input file
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	//close file on exit
+	defer file.Close()
+	start, err := valueStart(file, size)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dataSize := fi.Size() - start
+	//clamp to the values present in full
+	if available := (dataSize - offset) / size; available < count {
+		count = available
+	}
+	if count <= 0 {
+		if count == 0 && dataSize-offset >= size {
+			return []byte{}, nil
+		}
+		return nil, fmt.Errorf("value %d not present: %w", startIndex, io.EOF)
+	}
+	buffer := make([]byte, count*size)
+	n, err := file.ReadAt(buffer, start+offset)
+	if err == io.EOF {
+		//the file was truncated after the stat
+		return buffer[:int64(n)/size*size], nil
+	}
+	if err != nil {
+		return nil, fileError(ErrReadInput, "error reading file", err)
+	}
+	return buffer, nil
+}
+
+//valueOffset offset of a value in a file of same-size values
+//index index of the value, not negative
+//size size of the values, positive
+//return index*size, or an error wrapping ErrInvalidIndex if the offset of
+//the end of the value, (index+1)*size, overflows int64
+func valueOffset(index, size int64) (int64, error) {
+	hi, lo := bits.Mul64(uint64(index), uint64(size))
+	if index < 0 || size <= 0 || hi != 0 || lo > uint64(math.MaxInt64-size) {
+		return 0, fmt.Errorf("%w: offset of index %d with size %d overflows", ErrInvalidIndex, index, size)
+	}
+	return int64(lo), nil
+}
+
+//readValueAt read a single value
+//r where to read the values from
+//index index of the desired value
+//size size of the single values
+//return the value read, or the errors described in ReadValue
+func readValueAt(r io.ReaderAt, index, size int64) ([]byte, error) {
+	value, err := readPartialAt(r, index, size)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+//readPartialAt read a single value, keeping the bytes of an incomplete one
+//r where to read the values from
+//index index of the desired value
+//size size of the single values
+//return the value read, or the bytes read before the end of the file or
+//the read error along with the error, as in ReadValuePartial
+func readPartialAt(r io.ReaderAt, index, size int64) ([]byte, error) {
+	//validate values before computing the offset
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("%w: index %d", ErrInvalidIndex, index)
+	}
+	offset, err := valueOffset(index, size)
+	if err != nil {
+		return nil, err
+	}
 	//offset reading
 	buffer := make([]byte, size)
-	n, err := file.ReadAt(buffer, index*size)
+	n, err := r.ReadAt(buffer, offset)
 	if n < int(size) {
-		fmt.Println("Error reading file: incomplete value!")
-		return nil
+		if err == io.EOF && n == 0 {
+			return nil, fmt.Errorf("value %d not present: %w", index, io.EOF)
+		}
+		if err == io.EOF {
+			return buffer[:n], fmt.Errorf("%w: value %d has %d of %d bytes", ErrShortValue, index, n, size)
+		}
+		return buffer[:n], fileError(ErrReadInput, "error reading file", err)
 	}
-	return buffer
+	return buffer, nil
 }
@@ -0,0 +1,1342 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestOrderResultsFlushTimeout(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name        string
+		skip        bool
+		wantErr     error
+		wantSkipped []int
+	}{
+		{"fail", false, ErrShardTimeout, nil},
+		{"skip", true, nil, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeClock()
+			late := lateShards{timeout: time.Second, clock: fc}
+			var skipped []int
+			if tt.skip {
+				late.skip = func(index int) {
+					skipped = append(skipped, index)
+				}
+			}
+			var emitted []int
+			results := make(chan Shard)
+			done := make(chan error, 1)
+			go func() {
+				done <- orderResults(context.Background(), results, 0, 0, late, func(ct Shard) error {
+					emitted = append(emitted, ct.Index)
+					return nil
+				})
+			}()
+			if d := fc.waitTimer(t); d != time.Second {
+				t.Fatalf("first deadline %v, want %v", d, time.Second)
+			}
+			fc.Advance(600 * ms)
+			results <- Shard{0, nil}
+			//shard 2 is received once shard 0 is emitted and the deadline moved
+			results <- Shard{2, nil}
+			//the first timer expires, but the deadline of shard 1 is 600ms later
+			fc.Advance(400 * ms)
+			if d := fc.waitTimer(t); d != 600*ms {
+				t.Fatalf("rearmed for %v, want %v", d, 600*ms)
+			}
+			fc.Advance(600 * ms)
+			if tt.skip {
+				//shard 2 is emitted and the deadline restarted for shard 3
+				fc.waitTimer(t)
+			}
+			close(results)
+			err := <-done
+			if tt.wantErr == nil && err != nil || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("skipped %v, want %v", skipped, tt.wantSkipped)
+			}
+			if fc.active() != 0 {
+				t.Errorf("%d timers still running", fc.active())
+			}
+		})
+	}
+}
+
+func TestShardTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		//stuck index of the shard whose processing never returns, -1 for none
+		stuck   int
+		wantErr bool
+	}{
+		{"stuck shard", 50 * time.Millisecond, 3, true},
+		{"first shard stuck", 50 * time.Millisecond, 0, true},
+		{"within the deadline", time.Minute, -1, false},
+		{"no deadline", 0, -1, false},
+	}
+	for _, tt := range tests {
+		//the abandoned calls outlive the iteration
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in := filepath.Join(dir, "in")
+			if err := ioutil.WriteFile(in, make([]byte, 100), 0600); err != nil {
+				t.Fatal(err)
+			}
+			release := make(chan struct{})
+			defer close(release)
+			process := func(inp Shard) (Shard, error) {
+				if inp.Index == tt.stuck {
+					<-release
+				}
+				return inp, nil
+			}
+			out := filepath.Join(dir, "out")
+			opts := ProcessOptions{Workers: 4, ChunkSize: 10, ShardTimeout: tt.timeout, NoSync: true}
+			_, err := ProcessFileWithOptions(context.Background(), in, out, process, opts)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi, err := os.Stat(out); err != nil || fi.Size() != 100 {
+					t.Fatalf("output %v, %v", fi, err)
+				}
+				return
+			}
+			var ie *IndexError
+			if !errors.As(err, &ie) || !errors.Is(err, ErrShardTimeout) {
+				t.Fatalf("err = %v, want an IndexError wrapping ErrShardTimeout", err)
+			}
+			if ie.Index != int64(tt.stuck) {
+				t.Errorf("error names shard %d, want %d", ie.Index, tt.stuck)
+			}
+		})
+	}
+}
+
+func TestFlushTimeoutStuckShard(t *testing.T) {
+	tests := []struct {
+		name string
+		//stuck index of the shard whose processing never returns
+		stuck int
+	}{
+		{"first shard stuck", 0},
+		{"later shard stuck", 3},
+	}
+	for _, tt := range tests {
+		//the stuck call outlives the run
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			base := runtime.NumGoroutine()
+			in := writeInput(t, 1000)
+			out := filepath.Join(filepath.Dir(in), "out")
+			release := make(chan struct{})
+			process := func(inp Shard) (Shard, error) {
+				if inp.Index == tt.stuck {
+					<-release
+				}
+				return inp, nil
+			}
+			opts := ProcessOptions{Workers: 4, ChunkSize: 10, FlushTimeout: 50 * time.Millisecond, NoSync: true}
+			done := make(chan error, 1)
+			go func() {
+				_, err := ProcessFileWithOptions(context.Background(), in, out, process, opts)
+				done <- err
+			}()
+			//the run returns while the call is still stuck
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrShardTimeout) {
+					t.Errorf("err = %v, want %v", err, ErrShardTimeout)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("run still waiting for the stuck shard")
+				close(release)
+				<-done
+				return
+			}
+			close(release)
+			//the abandoned worker exits once the call returns
+			waitGoroutines(t, base)
+		})
+	}
+}
+
+func TestMaxReorderWindow(t *testing.T) {
+	defer func(max int) { MaxReorder = max }(MaxReorder)
+	const num, size, shards = 4, 10, 200
+	for _, max := range []int{0, 8, 50} {
+		t.Run(fmt.Sprintf("MaxReorder %d", max), func(t *testing.T) {
+			MaxReorder = max
+			fc := newFakeClock()
+			var started int32
+			process := func(inp Shard) (Shard, error) {
+				atomic.AddInt32(&started, 1)
+				//shard 0 is slow, the following ones wait for it in the window
+				if inp.Index == 0 {
+					<-fc.After(time.Second)
+				}
+				return inp, nil
+			}
+			data := make([]byte, shards*size)
+			out, errc := ProcessStream(context.Background(), bytes.NewReader(data), process, num, size)
+			fc.waitTimer(t)
+			//the reading stops once the window is full
+			window := int32(num + max)
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt32(&started) < window && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			if n := atomic.LoadInt32(&started); n != window {
+				t.Errorf("%d shards started behind the slow one, want %d", n, window)
+			}
+			fc.Advance(time.Second)
+			//a shard leaves the window once received, so no more than the
+			//window are started and not yet received at any time
+			var received int32
+			for ct := range out {
+				if ct.Index != int(received) {
+					t.Fatalf("shard %d received at %d", ct.Index, received)
+				}
+				received++
+				if n := atomic.LoadInt32(&started); n > received+window {
+					t.Fatalf("%d shards in flight, want at most %d", n-received, window)
+				}
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if received != shards {
+				t.Fatalf("%d shards received, want %d", received, shards)
+			}
+		})
+	}
+}
+
+func TestProcessFileDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	plain := make([]byte, 100*1000+123)
+	for i := range plain {
+		plain[i] = byte(i * 31)
+	}
+	if err := ioutil.WriteFile(in, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	deterministic, err := NewAESGCMEncryptorWithOptions(key, AEADOptions{Deterministic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	random, err := NewAESGCMEncryptor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		process ProcessFunc
+		//wantSame true if every run must write the same bytes
+		wantSame bool
+	}{
+		{"deterministic nonces", deterministic, true},
+		{"random nonces", random, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var first, firstRoot []byte
+			for _, num := range []int{1, 2, 8, 32} {
+				out := filepath.Join(dir, fmt.Sprintf("out%d", num))
+				root, err := ProcessFileWithCommitment(context.Background(), in, out, tt.process, num, 1000, false, false, HashFunc{}, WriteTruncate, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				output, err := ioutil.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if first == nil {
+					first, firstRoot = output, root
+					continue
+				}
+				same := bytes.Equal(output, first)
+				if same != tt.wantSame {
+					t.Errorf("num=%d: output identical to num=1 %v, want %v", num, same, tt.wantSame)
+				}
+				if sameRoot := bytes.Equal(root, firstRoot); sameRoot != same {
+					t.Errorf("num=%d: Merkle root identical %v, output identical %v", num, sameRoot, same)
+				}
+			}
+		})
+	}
+}
+
+//writeInput write an input file of the given length in a temporary directory
+//return the path to the file
+func writeInput(t testing.TB, length int) string {
+	t.Helper()
+	plain := make([]byte, length)
+	for i := range plain {
+		plain[i] = byte(i * 13)
+	}
+	in := filepath.Join(t.TempDir(), "in")
+	if err := ioutil.WriteFile(in, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+//identity process function leaving the shards unchanged
+func identity(inp Shard) (Shard, error) {
+	return inp, nil
+}
+
+//waitGoroutines wait for the goroutines started since base was counted to exit
+func waitGoroutines(t *testing.T, base int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines still running, %d before:\n%s", runtime.NumGoroutine(), base, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessFileCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		//cancelAt number of shards written when the context is cancelled, -1 to cancel before starting
+		cancelAt int
+	}{
+		{"before starting", -1},
+		{"after the first shard", 1},
+		{"mid-stream", 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 10000)
+			out := filepath.Join(filepath.Dir(in), "out")
+			base := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelAt < 0 {
+				cancel()
+			}
+			progress := func(shardsDone, totalShards int, bytesWritten int64) {
+				if shardsDone == tt.cancelAt {
+					cancel()
+				}
+			}
+			//slow enough for the cancellation to arrive mid-stream
+			process := func(inp Shard) (Shard, error) {
+				time.Sleep(100 * time.Microsecond)
+				return inp, nil
+			}
+			_, err := ProcessFile(ctx, in, out, process, 4, 10, false, false, false, WriteTruncate, progress)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("err = %v, want %v", err, context.Canceled)
+			}
+			waitGoroutines(t, base)
+		})
+	}
+}
+
+func TestWriteResultsCommitError(t *testing.T) {
+	tests := []struct {
+		name string
+		//conflict true to create the output while the shards are written,
+		//failing the final commit of an exclusive output
+		conflict bool
+	}{
+		{"committed", false},
+		{"commit failing after the writes", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			base := runtime.NumGoroutine()
+			results := make(chan Shard)
+			//room for a second value, which must never be sent
+			done := make(chan error, 2)
+			go writeResults(results, out, WriteExclusive, false, 3, nil, done)
+			for i := 0; i < 3; i++ {
+				results <- Shard{i, []byte{byte(i)}}
+			}
+			if tt.conflict {
+				if err := ioutil.WriteFile(out, []byte("created meanwhile"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(results)
+			err := <-done
+			if tt.conflict != (err != nil) {
+				t.Fatalf("err = %v, want an error %v", err, tt.conflict)
+			}
+			if tt.conflict && !errors.Is(err, ErrWriteOutput) {
+				t.Errorf("err = %v, want %v", err, ErrWriteOutput)
+			}
+			//the writer exits after a single send
+			waitGoroutines(t, base)
+			if len(done) != 0 {
+				t.Errorf("%d more values sent on done", len(done))
+			}
+			if _, err := os.Stat(out + TempSuffix); !os.IsNotExist(err) {
+				t.Errorf("temporary file left: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteResultsMissingIndices(t *testing.T) {
+	tests := []struct {
+		name    string
+		indices []int
+		//wantMissing text of the missing indices in the error, empty for success
+		wantMissing string
+	}{
+		{"contiguous", []int{0, 1, 2}, ""},
+		{"out of order", []int{2, 0, 1}, ""},
+		{"gap", []int{0, 1, 3}, "[2]"},
+		{"gaps", []int{0, 2, 5}, "[1 3 4]"},
+		{"first missing", []int{1}, "[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan Shard, len(tt.indices))
+			for _, i := range tt.indices {
+				results <- Shard{i, []byte{byte(i)}}
+			}
+			close(results)
+			var out bytes.Buffer
+			done := make(chan error, 1)
+			WriteResultsTo(results, &out, false, -1, nil, done)
+			err := <-done
+			if tt.wantMissing == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out.Len() != len(tt.indices) {
+					t.Errorf("%d bytes written, want %d", out.Len(), len(tt.indices))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "missing shards: "+tt.wantMissing) {
+				t.Fatalf("err = %v, want missing shards %s", err, tt.wantMissing)
+			}
+			//no truncated file is left under the output name
+			results = make(chan Shard, len(tt.indices))
+			for _, i := range tt.indices {
+				results <- Shard{i, []byte{byte(i)}}
+			}
+			close(results)
+			path := filepath.Join(t.TempDir(), "out")
+			writeResults(results, path, WriteTruncate, false, -1, nil, done)
+			if err := <-done; err == nil {
+				t.Fatal("writeResults succeeded")
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("output left: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessFileWorkerCount(t *testing.T) {
+	tests := []struct {
+		name        string
+		num         int
+		wantWorkers int
+	}{
+		{"zero", 0, runtime.NumCPU()},
+		{"negative", -3, runtime.NumCPU()},
+		{"one", 1, 1},
+		{"several", 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := workerCount(tt.num); got != tt.wantWorkers {
+				t.Errorf("workerCount(%d) = %d, want %d", tt.num, got, tt.wantWorkers)
+			}
+			in := writeInput(t, 2345)
+			out := filepath.Join(filepath.Dir(in), "out")
+			done := make(chan error, 1)
+			go func() {
+				_, err := ProcessFile(context.Background(), in, out, identity, tt.num, 100, false, false, false, WriteTruncate, nil)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("ProcessFile hangs")
+			}
+			assertSameFile(t, out, in)
+		})
+	}
+}
+
+//assertSameFile check that two files have the same content
+func assertSameFile(t *testing.T, got, want string) {
+	t.Helper()
+	gotData, err := ioutil.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantData, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotData, wantData) {
+		t.Fatalf("%s has %d bytes differing from the %d of %s", got, len(gotData), len(wantData), want)
+	}
+}
+
+//recordLengths process function recording the length of every shard
+//return the process function, leaving the shards unchanged, and the lengths
+//recorded by index
+func recordLengths() (ProcessFunc, map[int]int) {
+	var mu sync.Mutex
+	lengths := map[int]int{}
+	return func(inp Shard) (Shard, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lengths[inp.Index] = len(inp.Value)
+		return inp, nil
+	}, lengths
+}
+
+func TestProcessFilePartialShard(t *testing.T) {
+	tests := []struct {
+		name        string
+		length      int
+		size        int
+		wantLengths []int
+	}{
+		{"partial last shard", 2500, 1000, []int{1000, 1000, 500}},
+		{"exact multiple", 3000, 1000, []int{1000, 1000, 1000}},
+		{"shorter than a shard", 10, 1000, []int{10}},
+		{"single byte shards", 3, 1, []int{1, 1, 1}},
+		{"one byte over", 1001, 1000, []int{1000, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, tt.length)
+			out := filepath.Join(filepath.Dir(in), "out")
+			process, lengths := recordLengths()
+			if _, err := ProcessFile(context.Background(), in, out, process, 4, tt.size, false, false, false, WriteTruncate, nil); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int, len(lengths))
+			for i := range got {
+				got[i] = lengths[i]
+			}
+			if !reflect.DeepEqual(got, tt.wantLengths) {
+				t.Errorf("shard lengths %v, want %v", got, tt.wantLengths)
+			}
+			assertSameFile(t, out, in)
+		})
+	}
+}
+
+func TestProcessFileEmptyAndShorterOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		//existing length of the output before the run, -1 if it does not exist
+		existing int
+		length   int
+	}{
+		{"empty input", -1, 0},
+		{"empty input over a longer output", 5000, 0},
+		{"shorter output", 5000, 1234},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, tt.length)
+			out := filepath.Join(filepath.Dir(in), "out")
+			if tt.existing >= 0 {
+				if err := ioutil.WriteFile(out, bytes.Repeat([]byte{0xff}, tt.existing), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res, err := ProcessFile(context.Background(), in, out, identity, 4, 100, false, false, false, WriteTruncate, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.BytesWritten != int64(tt.length) {
+				t.Errorf("%d bytes written, want %d", res.BytesWritten, tt.length)
+			}
+			//no tail of the previous output is left
+			assertSameFile(t, out, in)
+		})
+	}
+}
+
+func TestProcessFilePermissions(t *testing.T) {
+	tests := []struct {
+		name string
+		perm os.FileMode
+		want os.FileMode
+	}{
+		{"default", 0, OutputPerm},
+		{"owner only", 0600, 0600},
+		{"group readable", 0640, 0640},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 100)
+			out := filepath.Join(filepath.Dir(in), "out")
+			opts := ProcessOptions{ChunkSize: 10, Perm: tt.perm, NoSync: true}
+			if _, err := ProcessFileWithOptions(context.Background(), in, out, identity, opts); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//the umask can only clear bits
+			if got := fi.Mode().Perm(); got&^tt.want != 0 || got&0700 != tt.want&0700 {
+				t.Errorf("permissions %v, want %v", got, tt.want)
+			}
+			if fi.Mode().Perm()&0004 != 0 {
+				t.Errorf("output is world-readable: %v", fi.Mode().Perm())
+			}
+		})
+	}
+	if OutputPerm&0077 != 0 {
+		t.Errorf("OutputPerm %v gives access to other users", OutputPerm)
+	}
+}
+
+func TestProcessFilePanic(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	tests := []struct {
+		name  string
+		index int
+		value interface{}
+	}{
+		{"string at index 2", 2, "boom"},
+		{"error at index 2", 2, sentinel},
+		{"first shard", 0, "boom"},
+		{"last shard", 9, "boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 100)
+			out := filepath.Join(filepath.Dir(in), "out")
+			process := func(inp Shard) (Shard, error) {
+				if inp.Index == tt.index {
+					panic(tt.value)
+				}
+				return inp, nil
+			}
+			_, err := ProcessFile(context.Background(), in, out, process, 4, 10, false, false, false, WriteTruncate, nil)
+			if err == nil {
+				t.Fatal("ProcessFile succeeded")
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("processing shard %d failed", tt.index)) {
+				t.Errorf("err = %v, want naming shard %d", err, tt.index)
+			}
+			if perr, ok := tt.value.(error); ok && !errors.Is(err, perr) {
+				t.Errorf("err = %v, want wrapping %v", err, perr)
+			}
+		})
+	}
+}
+
+func TestInvalidSize(t *testing.T) {
+	in := writeInput(t, 100)
+	out := filepath.Join(filepath.Dir(in), "out")
+	calls := []struct {
+		name string
+		call func(size int) error
+	}{
+		{"ProcessFile", func(size int) error {
+			_, err := ProcessFile(context.Background(), in, out, identity, 4, size, false, false, false, WriteTruncate, nil)
+			return err
+		}},
+		{"ProcessBytes", func(size int) error {
+			_, err := ProcessBytes(make([]byte, 100), identity, size)
+			return err
+		}},
+		{"ReadValue", func(size int) error {
+			_, err := ReadValue(in, 0, int64(size))
+			return err
+		}},
+		{"ReadValue from the end", func(size int) error {
+			_, err := ReadValue(in, -1, int64(size))
+			return err
+		}},
+		{"ReadValues", func(size int) error {
+			_, err := ReadValues(in, []int64{0, 1}, int64(size))
+			//every value fails alike, with an entry of its own
+			var errs IndexErrors
+			if errors.As(err, &errs) && len(errs) == 2 {
+				return errs[1]
+			}
+			return err
+		}},
+		{"OpenValueReader", func(size int) error {
+			r, err := OpenValueReader(in, int64(size))
+			if err == nil {
+				r.Close()
+			}
+			return err
+		}},
+		{"NewProcessingWriter", func(size int) error {
+			_, err := NewProcessingWriter(ioutil.Discard, identity, size).Write([]byte{1})
+			return err
+		}},
+	}
+	for _, size := range []int{-1, 0} {
+		for _, c := range calls {
+			t.Run(fmt.Sprintf("%s size %d", c.name, size), func(t *testing.T) {
+				done := make(chan error, 1)
+				go func() {
+					done <- c.call(size)
+				}()
+				select {
+				case err := <-done:
+					if !errors.Is(err, ErrInvalidSize) {
+						t.Fatalf("err = %v, want %v", err, ErrInvalidSize)
+					}
+				case <-time.After(10 * time.Second):
+					t.Fatal("hangs")
+				}
+			})
+		}
+	}
+}
+
+func TestNotRegular(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	paths := []struct {
+		name string
+		path string
+	}{
+		{"directory", dir},
+		{"link to a directory", link},
+		{"device", os.DevNull},
+	}
+	out := filepath.Join(dir, "out")
+	calls := []struct {
+		name string
+		call func(path string) error
+	}{
+		{"ProcessFile", func(path string) error {
+			_, err := ProcessFile(context.Background(), path, out, identity, 4, 100, false, false, false, WriteTruncate, nil)
+			return err
+		}},
+		{"ProcessInPlace", func(path string) error {
+			return ProcessInPlace(path, identity, 4, 100)
+		}},
+	}
+	for _, p := range paths {
+		if fi, err := os.Stat(p.path); err != nil || fi.Mode().IsRegular() {
+			continue
+		}
+		for _, c := range calls {
+			t.Run(c.name+" "+p.name, func(t *testing.T) {
+				done := make(chan error, 1)
+				go func() {
+					done <- c.call(p.path)
+				}()
+				select {
+				case err := <-done:
+					if !errors.Is(err, ErrNotRegular) {
+						t.Fatalf("err = %v, want %v", err, ErrNotRegular)
+					}
+				case <-time.After(10 * time.Second):
+					t.Fatal("hangs")
+				}
+				if _, err := os.Lstat(out); !os.IsNotExist(err) {
+					t.Fatalf("output created: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestShardCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		size   int64
+		//framed count the shards of the input written with framed shards of
+		//size bytes
+		framed bool
+		want   int64
+	}{
+		{"empty file", 0, 10, false, 0},
+		{"exact multiple", 100, 10, false, 10},
+		{"partial last shard", 101, 10, false, 11},
+		{"shorter than a shard", 3, 10, false, 1},
+		{"framed empty file", 0, 10, true, 0},
+		{"framed exact multiple", 100, 10, true, 10},
+		{"framed partial last shard", 105, 10, true, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeInput(t, tt.length)
+			size := tt.size
+			if tt.framed {
+				out := filepath.Join(filepath.Dir(path), "out")
+				opts := ProcessOptions{ChunkSize: int(tt.size), Framed: true, NoSync: true}
+				if _, err := ProcessFileWithOptions(context.Background(), path, out, identity, opts); err != nil {
+					t.Fatal(err)
+				}
+				path, size = out, 0
+			}
+			got, err := ShardCount(path, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("%d shards, want %d", got, tt.want)
+			}
+		})
+	}
+	if _, err := ShardCount(writeInput(t, 10), -1); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidSize)
+	}
+}
+
+func TestOffsetOverflow(t *testing.T) {
+	tests := []struct {
+		name       string
+		index      int64
+		size       int64
+		wantOffset int64
+		wantErr    bool
+	}{
+		{"small", 3, 10, 30, false},
+		{"last representable", math.MaxInt64/10 - 1, 10, (math.MaxInt64/10 - 1) * 10, false},
+		{"end overflows", math.MaxInt64 / 10, 10, 0, true},
+		{"product overflows", math.MaxInt64 / 2, 4, 0, true},
+		{"product wraps to positive", 1 << 62, 8, 0, true},
+		{"huge size", 1, math.MaxInt64, 0, true},
+		{"negative index", -1, 10, 0, true},
+	}
+	in := writeInput(t, 1000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, err := valueOffset(tt.index, tt.size)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIndex) {
+					t.Fatalf("valueOffset(%d, %d) = %d, %v, want %v", tt.index, tt.size, offset, err, ErrInvalidIndex)
+				}
+				//reading fails too, rather than returning bytes at a wrapped offset
+				if tt.index >= 0 {
+					if value, err := ReadValue(in, tt.index, tt.size); !errors.Is(err, ErrInvalidIndex) {
+						t.Errorf("ReadValue = %d bytes, %v, want %v", len(value), err, ErrInvalidIndex)
+					}
+					if value, err := ReadRange(in, tt.index, 1, tt.size); !errors.Is(err, ErrInvalidIndex) {
+						t.Errorf("ReadRange = %d bytes, %v, want %v", len(value), err, ErrInvalidIndex)
+					}
+				}
+				return
+			}
+			if err != nil || offset != tt.wantOffset {
+				t.Fatalf("valueOffset(%d, %d) = %d, %v, want %d", tt.index, tt.size, offset, err, tt.wantOffset)
+			}
+		})
+	}
+	//a count whose end overflows is clamped to the values present
+	values, err := ReadRange(in, 1, math.MaxInt64, 10)
+	if err != nil || len(values) != 990 {
+		t.Errorf("ReadRange with an overflowing count = %d bytes, %v, want 990", len(values), err)
+	}
+}
+
+func TestProcessFileWriterFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		//output path to the output, relative to the directory of the input
+		output string
+		opts   ProcessOptions
+		want   error
+	}{
+		{"missing directory", "missing/out", ProcessOptions{}, ErrOpenOutput},
+		{"output is a directory", ".", ProcessOptions{}, ErrOpenOutput},
+		{"failing mid-run", "out", ProcessOptions{MaxOutputSize: 5000}, ErrOutputTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 100000)
+			out := filepath.Join(filepath.Dir(in), tt.output)
+			base := runtime.NumGoroutine()
+			opts := tt.opts
+			opts.Workers, opts.ChunkSize, opts.NoSync = 4, 10, true
+			done := make(chan error, 1)
+			go func() {
+				_, err := ProcessFileWithOptions(context.Background(), in, out, identity, opts)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("err = %v, want %v", err, tt.want)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("ProcessFile hangs")
+			}
+			waitGoroutines(t, base)
+		})
+	}
+}
+
+func TestProcessFileAtomicOutput(t *testing.T) {
+	failing := func(inp Shard) (Shard, error) {
+		if inp.Index == 500 {
+			return Shard{}, errors.New("failing")
+		}
+		return inp, nil
+	}
+	tests := []struct {
+		name    string
+		process ProcessFunc
+		opts    ProcessOptions
+		//existing true to run over an existing output, which must be kept
+		existing bool
+	}{
+		{"write error partway", identity, ProcessOptions{MaxOutputSize: 5000}, false},
+		{"process error partway", failing, ProcessOptions{}, false},
+		{"over an existing output", failing, ProcessOptions{}, true},
+		{"exclusive over an existing output", identity, ProcessOptions{Mode: WriteExclusive}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 10000)
+			out := filepath.Join(filepath.Dir(in), "out")
+			previous := []byte("previous output")
+			if tt.existing {
+				if err := ioutil.WriteFile(out, previous, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := tt.opts
+			opts.Workers, opts.ChunkSize = 4, 10
+			if _, err := ProcessFileWithOptions(context.Background(), in, out, tt.process, opts); err == nil {
+				t.Fatal("ProcessFile succeeded")
+			}
+			if _, err := os.Stat(out + TempSuffix); !os.IsNotExist(err) {
+				t.Errorf("temporary file left: %v", err)
+			}
+			data, err := ioutil.ReadFile(out)
+			if !tt.existing {
+				if !os.IsNotExist(err) {
+					t.Fatalf("partial output left: %d bytes, %v", len(data), err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(data, previous) {
+				t.Fatalf("previous output changed to %q, %v", data, err)
+			}
+		})
+	}
+	//a resumable run writes in place, keeping the part to resume from
+	in := writeInput(t, 10000)
+	out := filepath.Join(filepath.Dir(in), "out")
+	opts := ProcessOptions{Workers: 4, ChunkSize: 10, Resume: true}
+	if _, err := ProcessFileWithOptions(context.Background(), in, out, failing, opts); err == nil {
+		t.Fatal("ProcessFile succeeded")
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Size() == 0 {
+		t.Fatalf("no partial output to resume from: %v, %v", fi, err)
+	}
+	if _, err := ProcessFileWithOptions(context.Background(), in, out, identity, opts); err != nil {
+		t.Fatal(err)
+	}
+	assertSameFile(t, out, in)
+}
+
+func TestProcessFileAtomicManifest(t *testing.T) {
+	failing := func(inp Shard) (Shard, error) {
+		if inp.Index == 500 {
+			return Shard{}, errors.New("failing")
+		}
+		return inp, nil
+	}
+	tests := []struct {
+		name    string
+		process ProcessFunc
+		opts    ProcessOptions
+		//wantErr true if the run fails, keeping the previous output and manifest
+		wantErr bool
+	}{
+		{"process error partway", failing, ProcessOptions{}, true},
+		{"write error partway", identity, ProcessOptions{MaxOutputSize: 5000}, true},
+		{"exclusive over an existing output", identity, ProcessOptions{Mode: WriteExclusive}, true},
+		{"success", identity, ProcessOptions{}, false},
+		{"success with another hash", identity, ProcessOptions{Hash: HashBLAKE2b256}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := writeInput(t, 10000)
+			out := filepath.Join(filepath.Dir(in), "out")
+			//a previous output of another input, verified by its manifest
+			previous := writeInput(t, 3000)
+			opts := ProcessOptions{Workers: 4, ChunkSize: 10, Manifest: true}
+			if _, err := ProcessFileWithOptions(context.Background(), previous, out, identity, opts); err != nil {
+				t.Fatal(err)
+			}
+			opts = tt.opts
+			opts.Workers, opts.ChunkSize, opts.Manifest = 4, 10, true
+			_, err := ProcessFileWithOptions(context.Background(), in, out, tt.process, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessFile: %v", err)
+			}
+			for _, name := range []string{out + TempSuffix, out + ManifestSuffix + TempSuffix} {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("temporary file %s left: %v", filepath.Base(name), err)
+				}
+			}
+			want := in
+			if tt.wantErr {
+				want = previous
+			}
+			assertSameFile(t, out, want)
+			if err := VerifyManifest(out, out+ManifestSuffix, 10); err != nil {
+				t.Errorf("output does not match its manifest: %v", err)
+			}
+		})
+	}
+}
+
+//unexpectedEOFReader reader reporting the end of the data as
+//io.ErrUnexpectedEOF, as some readers do even with nothing read
+type unexpectedEOFReader struct {
+	r io.Reader
+}
+
+func (u unexpectedEOFReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestReadChunksShortReads(t *testing.T) {
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"plain", func(r io.Reader) io.Reader { return r }},
+		{"one byte per read", iotest.OneByteReader},
+		{"half reads", iotest.HalfReader},
+		{"data with EOF", iotest.DataErrReader},
+		{"unexpected EOF at the end", func(r io.Reader) io.Reader { return unexpectedEOFReader{r} }},
+		{"one byte then unexpected EOF", func(r io.Reader) io.Reader { return unexpectedEOFReader{iotest.OneByteReader(r)} }},
+	}
+	sizes := []struct {
+		length int
+		size   int
+	}{
+		{0, 1}, {1, 1}, {3, 1}, {0, 3}, {2, 3}, {3, 3}, {4, 3}, {6, 3}, {1000, 7},
+	}
+	for _, reader := range readers {
+		for _, sz := range sizes {
+			t.Run(fmt.Sprintf("%s, %d bytes in chunks of %d", reader.name, sz.length, sz.size), func(t *testing.T) {
+				data := make([]byte, sz.length)
+				for i := range data {
+					data[i] = byte(i)
+				}
+				process, lengths := recordLengths()
+				var out bytes.Buffer
+				err := ProcessReader(context.Background(), reader.wrap(bytes.NewReader(data)), &out, process, 4, sz.size, false, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out.Bytes(), data) {
+					t.Fatalf("output of %d bytes differs from the input", out.Len())
+				}
+				shards := (sz.length + sz.size - 1) / sz.size
+				if len(lengths) != shards {
+					t.Fatalf("%d shards, want %d", len(lengths), shards)
+				}
+				for i, n := range lengths {
+					if n == 0 {
+						t.Errorf("empty shard %d", i)
+					}
+				}
+			})
+		}
+	}
+}
+
+//failingReader reader failing with err once after bytes have been read
+type failingReader struct {
+	r     io.Reader
+	after int
+	err   error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.after <= 0 {
+		return 0, f.err
+	}
+	if len(p) > f.after {
+		p = p[:f.after]
+	}
+	n, err := f.r.Read(p)
+	f.after -= n
+	return n, err
+}
+
+func TestReadChunksReadError(t *testing.T) {
+	injected := errors.New("injected read error")
+	tests := []struct {
+		name string
+		//after bytes read before the error
+		after     int
+		wantChunk int
+	}{
+		{"at the start", 0, 0},
+		{"after 2 chunks", 20, 2},
+		{"within the third chunk", 25, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &failingReader{bytes.NewReader(make([]byte, 100)), tt.after, injected}
+			var out bytes.Buffer
+			err := ProcessReader(context.Background(), r, &out, identity, 4, 10, false, nil)
+			if !errors.Is(err, injected) {
+				t.Fatalf("err = %v, want %v", err, injected)
+			}
+			if want := fmt.Sprintf("at chunk %d", tt.wantChunk); !strings.Contains(err.Error(), want) {
+				t.Errorf("err = %v, want naming the chunk (%s)", err, want)
+			}
+		})
+	}
+	//the error of a reader that times out on its second read
+	r := iotest.TimeoutReader(bytes.NewReader(make([]byte, 100)))
+	if err := ProcessReader(context.Background(), r, ioutil.Discard, identity, 4, 10, false, nil); !errors.Is(err, iotest.ErrTimeout) {
+		t.Fatalf("err = %v, want %v", err, iotest.ErrTimeout)
+	}
+}
+
+func TestSlicePending(t *testing.T) {
+	//the slice store behaves as the map one, whatever the order of the
+	//shards, including the ones outside its window; every index is put once
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 50; run++ {
+		first := rng.Intn(10)
+		slice, sparse := newPending(first, 1+rng.Intn(20)), newPending(first, 0)
+		put := map[int]bool{}
+		next := first
+		for op := 0; op < 2000; op++ {
+			index := next - 2 + rng.Intn(40)
+			if !put[index] && rng.Intn(2) == 0 {
+				put[index] = true
+				value := []byte{byte(index)}
+				slice.put(Shard{index, value})
+				sparse.put(Shard{index, value})
+			}
+			if slice.has(index) != sparse.has(index) {
+				t.Fatalf("has(%d) differs", index)
+			}
+			for {
+				got, ok := slice.take(next)
+				want, wantOK := sparse.take(next)
+				if ok != wantOK || !bytes.Equal(got, want) {
+					t.Fatalf("take(%d) = %v %v, want %v %v", next, got, ok, want, wantOK)
+				}
+				if !ok {
+					break
+				}
+				next++
+			}
+			if slice.size() != sparse.size() {
+				t.Fatalf("size %d, want %d", slice.size(), sparse.size())
+			}
+		}
+	}
+}
+
+//the shards arrive in order, or shuffled within a reorder window as from
+//concurrent workers, and are emitted as soon as the next one is present
+func BenchmarkPendingShards(b *testing.B) {
+	const shards, window = 1 << 20, 64
+	inOrder := make([]int, shards)
+	for i := range inOrder {
+		inOrder[i] = i
+	}
+	shuffled := append([]int(nil), inOrder...)
+	rng := rand.New(rand.NewSource(1))
+	for start := 0; start < shards; start += window {
+		block := shuffled[start : start+window]
+		rng.Shuffle(len(block), func(i, j int) { block[i], block[j] = block[j], block[i] })
+	}
+	value := make([]byte, 16)
+	for _, order := range []struct {
+		name    string
+		indices []int
+	}{{"in order", inOrder}, {"reordered", shuffled}} {
+		for _, store := range []struct {
+			name string
+			hint int
+		}{{"map", 0}, {"slice", window}} {
+			b.Run(order.name+"/"+store.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					pending := newPending(0, store.hint)
+					next := 0
+					for _, index := range order.indices {
+						pending.put(Shard{index, value})
+						for {
+							if _, ok := pending.take(next); !ok {
+								break
+							}
+							next++
+						}
+					}
+					if next != shards || pending.size() != 0 {
+						b.Fatalf("%d shards emitted, %d left", next, pending.size())
+					}
+				}
+			})
+		}
+	}
+}
+
+//stallingReader reader of zeros that stalls on one read out of every,
+//as storage with a high latency behind a cache
+type stallingReader struct {
+	remaining int
+	every     int
+	stall     time.Duration
+	reads     int
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	r.reads++
+	if r.reads%r.every == 0 {
+		time.Sleep(r.stall)
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	r.remaining -= len(p)
+	return len(p), nil
+}
+
+//with few workers, a deep read-ahead keeps them busy through the stalls of
+//the reader, while reading as many chunks ahead as there are workers
+//leaves them waiting for the input
+func BenchmarkReadAhead(b *testing.B) {
+	defer func(ahead int) { ReadAhead = ahead }(ReadAhead)
+	const size, shards, workers = 4096, 1024, 2
+	//CPU-bound, since sleeping for so short a time is not precise
+	process := func(inp Shard) (Shard, error) {
+		for start := time.Now(); time.Since(start) < 200*time.Microsecond; {
+		}
+		return inp, nil
+	}
+	for _, ahead := range []int{0, 16, 256} {
+		b.Run(fmt.Sprintf("read-ahead %d", ahead), func(b *testing.B) {
+			ReadAhead = ahead
+			b.SetBytes(size * shards)
+			for i := 0; i < b.N; i++ {
+				r := &stallingReader{remaining: size * shards, every: 64, stall: 20 * time.Millisecond}
+				if err := ProcessReader(context.Background(), r, ioutil.Discard, process, workers, size, false, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//the chunks are read into pooled buffers and the shards hold them as
+//[]byte, so a process function working in place allocates nothing per shard
+func BenchmarkShardAllocs(b *testing.B) {
+	const size, shards = 4096, 4096
+	in := writeInput(b, size*shards)
+	out := filepath.Join(filepath.Dir(in), "out")
+	for _, p := range []struct {
+		name    string
+		process ProcessFunc
+	}{{"identity", identity}, {"in place", invertInPlace}} {
+		b.Run(p.name, func(b *testing.B) {
+			opts := ProcessOptions{Workers: 4, ChunkSize: size, NoSync: true}
+			b.SetBytes(size * shards)
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessFileWithOptions(context.Background(), in, out, p.process, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*shards), "allocs/shard")
+		})
+	}
+}
+
+//for the small files the worker count is reduced (see MinShardsPerWorker),
+//which is compared with always starting the requested workers
+func BenchmarkProcessFileSizes(b *testing.B) {
+	defer func(min int) { MinShardsPerWorker = min }(MinShardsPerWorker)
+	const size = 1024
+	reduced := MinShardsPerWorker
+	for _, input := range []struct {
+		name   string
+		length int
+	}{{"tiny", 100}, {"medium", 64 * size}, {"large", 16384 * size}} {
+		in := writeInput(b, input.length)
+		out := filepath.Join(filepath.Dir(in), "out")
+		for _, min := range []int{reduced, 0} {
+			name := fmt.Sprintf("%s/%d per worker", input.name, min)
+			if min <= 0 {
+				name = input.name + "/all workers"
+			}
+			b.Run(name, func(b *testing.B) {
+				MinShardsPerWorker = min
+				opts := ProcessOptions{Workers: 16, ChunkSize: size, NoSync: true}
+				b.SetBytes(int64(input.length))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := ProcessFileWithOptions(context.Background(), in, out, identity, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
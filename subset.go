@@ -0,0 +1,204 @@
+package ledger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+//ProcessShards process only some shards of a file, leaving the others untouched
+//inputFile path to the file of shards
+//outputFile path to the output file, it can be inputFile to update it in place
+//indices indices of the shards to process, duplicates are processed once
+//process function that processes each selected shard
+//size size of the shards, 0 if the file was written with framed shards
+//all the selected shards are read and processed before anything is written,
+//so a failing index or shard leaves the output as it was; then
+//	with fixed-size shards every processed shard is written at the offset of
+//	the original one, so it must have the same length (ErrVariableLength
+//	otherwise) and the bytes of the other shards are not rewritten: in place
+//	only the selected shards are overwritten, which is not atomic
+//	with framed shards the processed shards can change length, so the file
+//	is rewritten on a temporary file and renamed (see commitTemp), moving the
+//	offsets of the following shards: any saved ShardIndex must be rebuilt
+//return the first error encountered: an IndexErrors listing the indices that
+//are negative or past the last shard, or the error reading, processing or
+//writing a shard
+func ProcessShards(inputFile, outputFile string, indices []int64, process ProcessFunc, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	//open input file
+	file, err := openRegular(inputFile)
+	if err != nil {
+		return err
+	}
+	//close file on exit
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	selected := sortedIndices(indices)
+	if size == 0 {
+		return processFramedShards(file, outputFile, selected, process)
+	}
+	//read and process the selected shards
+	count := shardCount(fi.Size(), int64(size))
+	if err := checkIndices(selected, count); err != nil {
+		return err
+	}
+	processed := make([][]byte, len(selected))
+	for i, index := range selected {
+		//the last chunk can be partial
+		offset := index * int64(size)
+		value := make([]byte, size)
+		if remaining := fi.Size() - offset; remaining < int64(size) {
+			value = value[:remaining]
+		}
+		if _, err := file.ReadAt(value, offset); err != nil {
+			return fileError(ErrReadInput, "error reading file", err)
+		}
+		ct, err := safeProcess(process, Shard{int(index), value})
+		if err != nil {
+			return err
+		}
+		if len(ct.Value) != len(value) {
+			return fmt.Errorf("%w: shard %d has %d bytes instead of %d", ErrVariableLength, index, len(ct.Value), len(value))
+		}
+		processed[i] = ct.Value
+	}
+	//update the input in place, or a copy of it
+	inPlace := false
+	if ofi, err := os.Stat(outputFile); err == nil {
+		inPlace = os.SameFile(fi, ofi)
+	}
+	var out *os.File
+	if inPlace {
+		out, err = os.OpenFile(outputFile, os.O_WRONLY, 0)
+		if err != nil {
+			return fileError(ErrOpenOutput, "error opening file", err)
+		}
+	} else {
+		if out, err = createTemp(outputFile, WriteTruncate, OutputPerm); err != nil {
+			return err
+		}
+		//remove the copy unless it was moved into place
+		defer os.Remove(out.Name())
+		if _, err := io.Copy(out, io.NewSectionReader(file, 0, fi.Size())); err != nil {
+			out.Close()
+			return fmt.Errorf("error copying file: %w", err)
+		}
+	}
+	for i, index := range selected {
+		if _, err := out.WriteAt(processed[i], index*int64(size)); err != nil {
+			out.Close()
+			return fileError(ErrWriteOutput, "error writing file", err)
+		}
+	}
+	if !inPlace {
+		return commitTemp(out, outputFile, WriteTruncate, true)
+	}
+	if err := syncOutput(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fileError(ErrCloseOutput, "error closing file", err)
+	}
+	return nil
+}
+
+//processFramedShards process some shards of a file written with framed shards
+//file the input file
+//outputFile path to the output file, it can be the input file
+//selected indices of the shards to process, sorted without duplicates
+//process function that processes each selected shard
+//return the first error encountered, as described in ProcessShards
+func processFramedShards(file *os.File, outputFile string, selected []int64, process ProcessFunc) error {
+	idx, err := BuildShardIndex(file.Name())
+	if err != nil {
+		return err
+	}
+	if err := checkIndices(selected, int64(idx.Len())); err != nil {
+		return err
+	}
+	processed := make(map[int][]byte, len(selected))
+	for _, index := range selected {
+		value, err := idx.readAt(file, int(index))
+		if err != nil {
+			return err
+		}
+		ct, err := safeProcess(process, Shard{int(index), value})
+		if err != nil {
+			return err
+		}
+		processed[int(index)] = ct.Value
+	}
+	//rewrite every frame, the processed ones replacing the originals
+	out, err := createTemp(outputFile, WriteTruncate, OutputPerm)
+	if err != nil {
+		return err
+	}
+	//remove the temporary file unless it was moved into place
+	defer os.Remove(out.Name())
+	w := bufio.NewWriter(out)
+	for i := 0; i < idx.Len(); i++ {
+		value, ok := processed[i]
+		if !ok {
+			if value, err = idx.readAt(file, i); err != nil {
+				out.Close()
+				return err
+			}
+		}
+		if err := writeFrame(w, value); err != nil {
+			out.Close()
+			return fileError(ErrWriteOutput, "error writing file", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fileError(ErrWriteOutput, "error writing file", err)
+	}
+	return commitTemp(out, outputFile, WriteTruncate, true)
+}
+
+//sortedIndices sort indices dropping the duplicates
+//indices indices to sort, left unchanged
+//return the distinct indices in increasing order
+func sortedIndices(indices []int64) []int64 {
+	sorted := append([]int64(nil), indices...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a] < sorted[b]
+	})
+	distinct := sorted[:0]
+	for i, index := range sorted {
+		if i == 0 || index != sorted[i-1] {
+			distinct = append(distinct, index)
+		}
+	}
+	return distinct
+}
+
+//checkIndices check that indices refer to existing shards
+//indices indices to check
+//count number of shards
+//return nil, or an IndexErrors with an entry wrapping ErrInvalidIndex for
+//every negative index and io.EOF for every index past the last shard
+func checkIndices(indices []int64, count int64) error {
+	var failed IndexErrors
+	for _, index := range indices {
+		switch {
+		case index < 0:
+			failed = append(failed, &IndexError{index, ErrInvalidIndex})
+		case index >= count:
+			failed = append(failed, &IndexError{index, fmt.Errorf("not present: %w", io.EOF)})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
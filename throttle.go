@@ -0,0 +1,74 @@
+package ledger
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+//throttleSlice fraction of a second of data read at most by a single read of
+//a throttled reader, so that the pacing is smooth even with large chunks
+const throttleSlice = 20
+
+//throttledReader reader of at most rate bytes per second
+//it waits after each read until the limiter grants the bytes read, so a
+//throttled input slows the whole pipeline through its backpressure: the
+//workers and the writer wait for the chunks instead of buffering them
+//the burst of the limiter is a single read, so the time spent waiting for
+//the consumer gives at most a twentieth of a second of credit, and the rate
+//is not exceeded by a burst after a stall
+//the bytes are reserved with rate.Limiter.ReserveN and waited for on the
+//clock of the run, rather than with WaitN, which reads the system clock:
+//this way a fake clock drives the pacing in the tests, and a cancelled wait
+//still returns its reservation to the limiter as WaitN does
+type throttledReader struct {
+	//ctx context that interrupts the waiting when cancelled
+	ctx context.Context
+	//clock clock of the waiting
+	clock clock
+	//r reader throttled
+	r io.Reader
+	//limiter token bucket of the bytes read
+	limiter *rate.Limiter
+	//max bytes read at most by a single read, the burst of limiter
+	max int
+}
+
+//throttle limit the rate of a reader
+//ctx context that interrupts the waiting when cancelled
+//clk clock of the waiting, nil for the system clock
+//r reader to limit
+//bytesPerSecond maximum rate, 0 or negative for no limit
+//return the throttled reader, or r itself if there is no limit
+func throttle(ctx context.Context, clk clock, r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	max := int(bytesPerSecond/throttleSlice + 1)
+	return &throttledReader{ctx: ctx, clock: orRealClock(clk), r: r, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), max), max: max}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.max {
+		p = p[:t.max]
+	}
+	n, err := t.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	//n never exceeds the burst, so the reservation is always granted
+	now := t.clock.Now()
+	reservation := t.limiter.ReserveN(now, n)
+	if wait := reservation.DelayFrom(now); wait > 0 {
+		timer := t.clock.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+		case <-t.ctx.Done():
+			reservation.CancelAt(t.clock.Now())
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
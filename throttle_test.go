@@ -0,0 +1,92 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThrottlePacing(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		rate int64
+		size int
+		//wantReads bytes returned by each read, limited to a twentieth of a second of data
+		wantReads []int
+		//wantWaits wait after each read but the first, which takes the burst
+		//of the limiter, for its bytes to be granted
+		wantWaits []time.Duration
+	}{
+		{"slow", 100, 20, []int{6, 6, 6, 2}, []time.Duration{60 * ms, 60 * ms, 20 * ms}},
+		{"fast", 1000, 100, []int{51, 49}, []time.Duration{49 * ms}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeClock()
+			r := throttle(context.Background(), fc, bytes.NewReader(make([]byte, tt.size)), tt.rate)
+			reads := make(chan int, len(tt.wantReads)+1)
+			go func() {
+				defer close(reads)
+				buffer := make([]byte, tt.size)
+				for {
+					n, err := r.Read(buffer)
+					if n > 0 {
+						reads <- n
+					}
+					if err != nil {
+						if err != io.EOF {
+							t.Error(err)
+						}
+						return
+					}
+				}
+			}()
+			var waits []time.Duration
+			for range tt.wantWaits {
+				d := fc.waitTimer(t)
+				waits = append(waits, d)
+				fc.Advance(d)
+			}
+			var got []int
+			for n := range reads {
+				got = append(got, n)
+			}
+			if !reflect.DeepEqual(got, tt.wantReads) {
+				t.Errorf("reads %v, want %v", got, tt.wantReads)
+			}
+			if !reflect.DeepEqual(waits, tt.wantWaits) {
+				t.Errorf("waits %v, want %v", waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func TestThrottleCancel(t *testing.T) {
+	fc := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := throttle(ctx, fc, bytes.NewReader(make([]byte, 10)), 100)
+	done := make(chan error, 1)
+	go func() {
+		//the first read takes the burst, the second waits
+		buffer := make([]byte, 10)
+		if _, err := r.Read(buffer); err != nil {
+			done <- err
+			return
+		}
+		_, err := r.Read(buffer)
+		done <- err
+	}()
+	fc.waitTimer(t)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	//the timer of the interrupted wait is released
+	if n := fc.active(); n != 0 {
+		t.Errorf("%d timers still running", n)
+	}
+}
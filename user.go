@@ -1,7 +1,8 @@
-package main
+package ledger
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"os"
 	"strconv"
 
@@ -60,20 +61,21 @@ func CountShards(filePath string) int {
 //outputFile path to output file
 //eps masking shards for encryption
 //key encryption key
-func EncryptFile(inputFile, outputFile string, eps []curve.ECP2, key *curve.ECP) {
+//return an error if the file is too big or the processing fails
+func EncryptFile(inputFile, outputFile string, eps []curve.ECP2, key *curve.ECP) error {
 	//check that there are enough masking shards to encrypt
 	numShards := CountShards(inputFile)
 	if numShards > MaxShards {
-		fmt.Println("File too big!")
-		return
+		return errors.New("file too big")
 	}
-	encr := func(inp shard) shard {
+	encr := func(inp Shard) (Shard, error) {
 		//encrypt using appropriate masking shard
-		ct := OneTimePad([]byte(inp.value), &eps[inp.index], key)
+		ct := OneTimePad(inp.Value, &eps[inp.Index], key)
 		//feed result to output channel
-		return shard{inp.index, string(ct)}
+		return Shard{inp.Index, ct}, nil
 	}
-	ProcessFile(inputFile, outputFile, encr, numShards, PadSize)
+	_, err := ProcessFile(context.Background(), inputFile, outputFile, encr, numShards, PadSize, false, false, false, WriteTruncate, nil)
+	return err
 }
 
 //AddBlock encrypt a file and add it to the ledger
@@ -95,7 +97,10 @@ func (u User) AddBlock(ledger Ledger, token *curve.ECP, fileName string) int64 {
 	//compute ciphertext file name
 	ctName := ledger.EncryptPath + strconv.FormatInt(keyIndex, 16) + ".enc"
 	//encrypt file
-	EncryptFile(fileName, ctName, eps[:], key)
+	err := EncryptFile(fileName, ctName, eps[:], key)
+	if err != nil {
+		panic(err)
+	}
 	//compute content concatenating digests
 	//first hash of previous block
 	content := FileDigest(ledger.RootPath + strconv.FormatInt(keyIndex, 16))
@@ -119,7 +124,7 @@ func (u User) AddBlock(ledger Ledger, token *curve.ECP, fileName string) int64 {
 	//close file on exit
 	defer func() {
 		if err = file.Close(); err != nil {
-			fmt.Println("Error closing file:", err)
+			logln("Error closing file:", err)
 		}
 	}()
 	//write content
@@ -0,0 +1,55 @@
+package ledger
+
+import (
+	"fmt"
+	"os"
+)
+
+//ValueReader file of same-size values kept open to serve many reads
+//it is safe for concurrent use, since every read is a single ReadAt
+type ValueReader struct {
+	//file being read
+	file *os.File
+	//size of the values
+	size int64
+	//start offset of the first value, after the header if any
+	start int64
+}
+
+//OpenValueReader open a file of same-size values for repeated reads
+//filePath path to the file containing a series of same-size values
+//size size of the single values, it must match the file header if any
+//return the reader, to be closed after use, or an error wrapping
+//ErrInvalidSize if size is not positive, ErrSizeMismatch if it differs
+//from the one in the file header, or the os.Open error
+func OpenValueReader(filePath string, size int64) (*ValueReader, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(ErrOpenInput, "error opening file", err)
+	}
+	start, err := valueStart(file, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &ValueReader{file, size, start}, nil
+}
+
+//ReadValue read a single value, as ReadValue without reopening the file
+//index index of the desired value, negative to count from the end
+//return the value read, or the errors described in ReadValue
+func (r *ValueReader) ReadValue(index int64) ([]byte, error) {
+	index, err := fromEnd(r.file, r.start, index, r.size)
+	if err != nil {
+		return nil, err
+	}
+	return readValueAt(valueSection(r.file, r.start), index, r.size)
+}
+
+//Close close the file, the reader cannot be used afterwards
+func (r *ValueReader) Close() error {
+	return r.file.Close()
+}
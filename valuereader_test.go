@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestValueReaderConcurrent(t *testing.T) {
+	const size, values = 100, 1000
+	in := writeInput(t, size*values+30)
+	r, err := OpenValueReader(in, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	//the shared reader serves the same values as ReadValue, from any
+	//number of goroutines
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := int64(g); i < values; i += 8 {
+				got, err := r.ReadValue(i)
+				if err != nil {
+					errs <- err
+					return
+				}
+				want, err := ReadValue(in, i, size)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("value %d differs", i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+//a server answering concurrent queries on the same file
+func BenchmarkReadValueConcurrent(b *testing.B) {
+	const size, values = 1024, 4096
+	in := writeInput(b, size*values)
+	b.Run("ReadValue", func(b *testing.B) {
+		b.SetBytes(size)
+		b.RunParallel(func(pb *testing.PB) {
+			for i := int64(0); pb.Next(); i++ {
+				if _, err := ReadValue(in, i%values, size); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("ValueReader", func(b *testing.B) {
+		r, err := OpenValueReader(in, size)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer r.Close()
+		b.SetBytes(size)
+		b.RunParallel(func(pb *testing.PB) {
+			for i := int64(0); pb.Next(); i++ {
+				if _, err := r.ReadValue(i % values); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
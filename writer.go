@@ -0,0 +1,105 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+//ErrWriterClosed Write called on a processing writer after Close
+var ErrWriterClosed = errors.New("write on closed processing writer")
+
+//processingWriter chunk the bytes written into shards and process them
+type processingWriter struct {
+	//w where the processed shards are written
+	w io.Writer
+	//function applied to each shard
+	process ProcessFunc
+	//size of the chunks
+	size int
+	//index of the next shard
+	next int
+	//bytes of the current chunk, not yet processed
+	buffer []byte
+	//first error encountered, returned by every later call
+	err error
+}
+
+//NewProcessingWriter chunk and process a stream on the fly, the counterpart
+//of NewDecryptingReader for the writing side
+//w where to write the processed shards, for example a file or a connection
+//process function applied to each chunk, typically an encryptor
+//size size of the chunks, it must be positive
+//the bytes written are accumulated across Write calls until a whole chunk
+//is available, which is then processed and written on w, so the output is
+//the same ProcessReader would write reading the same stream; Close
+//processes the final partial chunk, if any, and does not close w
+//an invalid size, or the error of a process function that fails or panics
+//or of w, is returned by the current and every later Write and Close
+//return the writer, to be closed to flush the last shard
+func NewProcessingWriter(w io.Writer, process ProcessFunc, size int) io.WriteCloser {
+	pw := &processingWriter{w: w, process: process, size: size}
+	if size <= 0 {
+		pw.err = fmt.Errorf("%w: %d", ErrInvalidSize, size)
+		return pw
+	}
+	pw.buffer = make([]byte, 0, size)
+	return pw
+}
+
+//Write buffer p, processing and writing every chunk it completes
+func (pw *processingWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(pw.buffer[len(pw.buffer):pw.size], p)
+		pw.buffer = pw.buffer[:len(pw.buffer)+n]
+		p = p[n:]
+		if len(pw.buffer) == pw.size {
+			if err := pw.flush(); err != nil {
+				return written, err
+			}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+//flush process the buffered chunk and write it on w
+//return the error processing or writing, also kept in pw.err
+func (pw *processingWriter) flush() error {
+	ct, err := safeProcess(pw.process, Shard{pw.next, pw.buffer})
+	if err == nil {
+		_, err = pw.w.Write(ct.Value)
+		if err != nil {
+			err = fmt.Errorf("error writing shard %d: %w", pw.next, err)
+		}
+	}
+	if err != nil {
+		pw.err = err
+		return err
+	}
+	pw.next++
+	//the shard was written, so the buffer can be reused for the next chunk
+	pw.buffer = pw.buffer[:0]
+	return nil
+}
+
+//Close process and write the final partial chunk, if any
+func (pw *processingWriter) Close() error {
+	if pw.err != nil {
+		if pw.err == ErrWriterClosed {
+			return nil
+		}
+		return pw.err
+	}
+	if len(pw.buffer) > 0 {
+		if err := pw.flush(); err != nil {
+			return err
+		}
+	}
+	pw.err = ErrWriterClosed
+	return nil
+}
@@ -0,0 +1,90 @@
+package ledger
+
+import (
+	"errors"
+	"sync"
+)
+
+//ErrZeroized the key of a process function was wiped, so it cannot process
+//any more shards
+var ErrZeroized = errors.New("key material zeroized")
+
+//Zeroizer holder of key material that can be wiped when no longer needed
+type Zeroizer interface {
+	//Zeroize overwrite the key material with zeros, it can be called
+	//more than once
+	Zeroize()
+}
+
+//Zeroize overwrite a key with zeros
+//key key to wipe, in place
+//the wiping is best-effort: the garbage collector may have moved or copied
+//the key before, and the copies made by the ciphers built from it (such as
+//the AES key schedule) are out of reach, they are only dropped and left to
+//the garbage collector; keys held in strings cannot be wiped at all, since
+//strings are immutable, which is why this package takes keys as []byte
+func Zeroize(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+//KeyedProcess process function built from a key that it owns, so that the
+//key can be wiped as soon as the processing is done
+type KeyedProcess struct {
+	//mutex guarding key and process, held for reading while processing
+	mutex sync.RWMutex
+	//key key material, owned by the KeyedProcess
+	key []byte
+	//process function built from key, nil once zeroized
+	process ProcessFunc
+}
+
+//NewKeyedProcess build a process function that owns its key
+//key key material, the caller hands it over and must not use it afterwards,
+//since it is wiped by Zeroize, or right away if build fails
+//build builder of the process function, for example NewAESGCMEncryptor
+//use the Process method as the process function, and pass the KeyedProcess
+//in ProcessOptions.Zeroize to wipe its key when the run completes
+//return the KeyedProcess, or the error of build
+func NewKeyedProcess(key []byte, build func(key []byte) (ProcessFunc, error)) (*KeyedProcess, error) {
+	process, err := build(key)
+	if err != nil {
+		Zeroize(key)
+		return nil, err
+	}
+	return &KeyedProcess{key: key, process: process}, nil
+}
+
+//Process process a shard with the function built from the key
+//inp shard to process
+//return the processed shard, or ErrZeroized if the key was wiped
+func (k *KeyedProcess) Process(inp Shard) (Shard, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if k.process == nil {
+		return Shard{}, ErrZeroized
+	}
+	return k.process(inp)
+}
+
+//Zeroize wipe the key and drop the process function built from it, which
+//holds the expanded key, waiting for the shards being processed
+//the wiping is best-effort, as described for the Zeroize function
+func (k *KeyedProcess) Zeroize() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	Zeroize(k.key)
+	k.key = nil
+	k.process = nil
+}
+
+//zeroizeAll wipe the key material handed over to a run
+//keys holders of the key material, nil entries are skipped
+func zeroizeAll(keys []Zeroizer) {
+	for _, key := range keys {
+		if key != nil {
+			key.Zeroize()
+		}
+	}
+}